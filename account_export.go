@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// AccountExport is everything held about a user, for them to download before
+// deleting their account. Hashes of passwords, tokens and keys are left out.
+type AccountExport struct {
+	User       ExportedUser       `json:"user"`
+	Links      []ExportedLink     `json:"links"`
+	Clicks     []ExportedClick    `json:"clicks"`
+	Sessions   []ExportedSession  `json:"sessions"`
+	ApiKeys    []ExportedApiKey   `json:"api_keys"`
+	Identities []ExportedIdentity `json:"identities"`
+}
+
+type ExportedUser struct {
+	Id          string     `json:"id"`
+	Email       *string    `json:"email"`
+	IsVerified  bool       `json:"is_verified"`
+	TotpEnabled bool       `json:"totp_enabled"`
+	Locale      string     `json:"locale"`
+	CreatedAt   *time.Time `json:"created_at"`
+}
+
+type ExportedLink struct {
+	Id           string     `json:"id"`
+	Url          *string    `json:"url"`
+	RedirectPath *string    `json:"redirect_path"`
+	Tag          *string    `json:"tag"`
+	ClickCount   int        `json:"click_count"`
+	CreatedAt    *time.Time `json:"created_at"`
+	DeletedAt    *time.Time `json:"deleted_at"`
+}
+
+type ExportedClick struct {
+	Id             string     `json:"id"`
+	LinkId         *string    `json:"link_id"`
+	ClickedOn      *time.Time `json:"clicked_on"`
+	Referrer       *string    `json:"referrer"`
+	UserAgent      *string    `json:"user_agent"`
+	IpAddress      *string    `json:"ip_address"`
+	AcceptLanguage *string    `json:"accept_language"`
+	IsBot          bool       `json:"is_bot"`
+	CountryCode    *string    `json:"country_code"`
+	Region         *string    `json:"region"`
+	City           *string    `json:"city"`
+	DeviceType     *string    `json:"device_type"`
+	Browser        *string    `json:"browser"`
+	OS             *string    `json:"os"`
+}
+
+type ExportedSession struct {
+	Id         string     `json:"id"`
+	UserAgent  *string    `json:"user_agent"`
+	IpAddress  *string    `json:"ip_address"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type ExportedApiKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	CreatedAt  *time.Time `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+}
+
+type ExportedIdentity struct {
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       *string    `json:"email"`
+	CreatedAt   *time.Time `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// writeExportZip writes the export as a zip with a CSV file per kind of record.
+func writeExportZip(w io.Writer, export AccountExport) error {
+	archive := zip.NewWriter(w)
+
+	files := []struct {
+		name    string
+		records interface{}
+	}{
+		{"user.csv", []ExportedUser{export.User}},
+		{"links.csv", export.Links},
+		{"clicks.csv", export.Clicks},
+		{"sessions.csv", export.Sessions},
+		{"api_keys.csv", export.ApiKeys},
+		{"identities.csv", export.Identities},
+	}
+
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("error adding %s to export: %s", file.name, err)
+		}
+
+		err = writeCsv(f, file.records)
+		if err != nil {
+			return fmt.Errorf("error writing %s: %s", file.name, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+// writeCsv writes a slice of structs as CSV, with the fields' JSON names as the header.
+func writeCsv(w io.Writer, records interface{}) error {
+	slice := reflect.ValueOf(records)
+	recordType := slice.Type().Elem()
+
+	writer := csv.NewWriter(w)
+
+	header := []string{}
+	for i := 0; i < recordType.NumField(); i++ {
+		header = append(header, strings.Split(recordType.Field(i).Tag.Get("json"), ",")[0])
+	}
+	writer.Write(header)
+
+	for i := 0; i < slice.Len(); i++ {
+		record := slice.Index(i)
+		row := []string{}
+		for j := 0; j < record.NumField(); j++ {
+			row = append(row, csvValue(record.Field(j)))
+		}
+		writer.Write(row)
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvValue(value reflect.Value) string {
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+
+	if t, ok := value.Interface().(time.Time); ok {
+		return t.UTC().Format(time.RFC3339)
+	}
+
+	return fmt.Sprint(value.Interface())
+}
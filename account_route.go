@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+)
+
+const EMAIL_CHANGE_TOKEN_LENGTH = 48
+
+type ChangePasswordApiRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type ChangeEmailApiRequest struct {
+	NewEmail string `json:"new_email" binding:"required"`
+	Password string `json:"password"`
+}
+
+type SetLocaleApiRequest struct {
+	Locale string `json:"locale" binding:"required"`
+}
+
+// DeleteAccountApiRequest confirms the deletion with the password, or with the
+// account's email for users who only log in with an OIDC provider, who also have to
+// have logged in recently.
+type DeleteAccountApiRequest struct {
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+func (r *Controller) ChangePassword(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	changeRequest := ChangePasswordApiRequest{}
+	if err := c.ShouldBindJSON(&changeRequest); err != nil {
+		log.Printf("invalid change password request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !r.checkCurrentPassword(c, user, changeRequest.CurrentPassword) {
+		return
+	}
+
+	hashedPassword, err := generateHashedPassword(changeRequest.NewPassword)
+	if err != nil {
+		log.Println("error hashing password:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cpr := ChangePasswordRequest{UserId: user.Id, HashedPassword: hashedPassword, CurrentSessionId: c.GetString("sessionId")}
+
+	err = r.Database.ChangePassword(c, cpr)
+	if err != nil {
+		log.Printf("error changing password for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("changed password for user id %s", user.Id)
+
+	c.Status(http.StatusNoContent)
+}
+
+// checkCurrentPassword guards changes to the account, so a stolen access token isn't
+// enough to take it over. Wrong passwords count towards the login lockout.
+func (r *Controller) checkCurrentPassword(c *gin.Context, user UserRecordInDatabase, password string) bool {
+	if user.HashedPassword == "" {
+		log.Printf("user id %s has no password", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Account has no password, use forgot password to set one")
+		return false
+	}
+
+	if user.LockedFor > 0 {
+		log.Printf("user id %s is locked out for %s", user.Id, user.LockedFor)
+		abortTooManyRequests(c, user.LockedFor)
+		return false
+	}
+
+	err := checkPasswordIsCorrect(password, user.HashedPassword)
+	if err != nil {
+		log.Printf("incorrect current password for user id %s: %s", user.Id, err)
+		r.recordFailedLogin(c, user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Incorrect password")
+		return false
+	}
+
+	return true
+}
+
+// checkRecentLogin stands in for checkCurrentPassword for users who only log in with
+// an OIDC provider, so a stolen access token isn't enough for them either. They have
+// to have logged in again within ReauthenticationMaxAge.
+func (r *Controller) checkRecentLogin(c *gin.Context, user UserRecordInDatabase) bool {
+	recent, err := r.Database.IsRecentSession(c, c.GetString("sessionId"), r.ReauthenticationMaxAge)
+	if err != nil {
+		log.Printf("error checking session for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+
+	if !recent {
+		log.Printf("user id %s hasn't logged in within %s", user.Id, r.ReauthenticationMaxAge)
+		c.AbortWithStatusJSON(http.StatusForbidden, "Log in again to do this")
+		return false
+	}
+
+	return true
+}
+
+// ChangeEmail sends a confirmation link to the new address. The email only changes
+// once that's clicked, in ConfirmEmailChange.
+func (r *Controller) ChangeEmail(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	changeRequest := ChangeEmailApiRequest{}
+	if err := c.ShouldBindJSON(&changeRequest); err != nil {
+		log.Printf("invalid change email request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	newEmail := strings.TrimSpace(changeRequest.NewEmail)
+	if !strings.Contains(newEmail, "@") || strings.EqualFold(newEmail, user.Email) {
+		log.Printf("invalid new email %s for user id %s", newEmail, user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid email")
+		return
+	}
+
+	if user.HashedPassword != "" {
+		if !r.checkCurrentPassword(c, user, changeRequest.Password) {
+			return
+		}
+	} else if !r.checkRecentLogin(c, user) {
+		return
+	}
+
+	exists, err := r.Database.EmailExists(c, newEmail)
+	if err != nil {
+		log.Printf("error checking email %s exists: %s", newEmail, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// answered like any other change, so it can't be used to find out whether an
+	// email is registered
+	if exists {
+		log.Printf("not changing email for user id %s as %s exists, emailing its owner", user.Id, newEmail)
+		go r.sendAccountExistsEmail(newEmail)
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	token := uniuri.NewLen(EMAIL_CHANGE_TOKEN_LENGTH)
+	data := EmailChangeEmailData{Url: fmt.Sprintf("%s/%s", r.EmailChangeUri, token), ExpiresIn: r.EmailChangeTokenTtl}
+	ser, err := r.EmailTemplates.Render(EMAIL_TEMPLATE_EMAIL_CHANGE, user.Locale, newEmail, data)
+	if err != nil {
+		log.Printf("error rendering email change confirmation to %s: %s", newEmail, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cecr := CreateEmailChangeRequest{
+		UserId:            user.Id,
+		NewEmail:          newEmail,
+		TokenHash:         hashToken(token),
+		Ttl:               r.EmailChangeTokenTtl,
+		ConfirmationEmail: ser,
+	}
+
+	err = r.Database.CreateEmailChangeRequest(c, cecr)
+	if err != nil {
+		log.Printf("error creating email change request for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	c.Status(http.StatusAccepted)
+}
+
+// SetLocale changes the language the user's emails are sent in.
+func (r *Controller) SetLocale(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	localeRequest := SetLocaleApiRequest{}
+	if err := c.ShouldBindJSON(&localeRequest); err != nil {
+		log.Printf("invalid set locale request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !isSupportedLocale(localeRequest.Locale) {
+		log.Printf("unsupported locale %s for user id %s", localeRequest.Locale, userId)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "locale must be one of "+strings.Join(supportedLocales, ", "))
+		return
+	}
+
+	err = r.Database.SetUserLocale(c, userId, localeRequest.Locale)
+	if err != nil {
+		log.Printf("error setting locale for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (r *Controller) ConfirmEmailChange(c *gin.Context) {
+	token := c.Param("token")
+
+	result, err := r.Database.ConfirmEmailChange(c, hashToken(token))
+	if err != nil {
+		log.Printf("error confirming email change: %s", err)
+		c.Redirect(http.StatusTemporaryRedirect, r.ErrorRedirectUrl)
+		return
+	}
+
+	switch result.Status {
+	case EMAIL_CHANGE_UNKNOWN:
+		log.Println("email change token is unknown, expired or already used")
+		c.Redirect(http.StatusTemporaryRedirect, r.errorRedirectUrlWithReason("invalid_email_change_token"))
+		return
+	case EMAIL_CHANGE_EMAIL_TAKEN:
+		log.Printf("can't change email to %s as it's been taken", result.NewEmail)
+		c.Redirect(http.StatusTemporaryRedirect, r.errorRedirectUrlWithReason("email_taken"))
+		return
+	}
+
+	log.Printf("changed email %s to %s", result.OldEmail, result.NewEmail)
+
+	ser, err := r.EmailTemplates.Render(EMAIL_TEMPLATE_EMAIL_CHANGED, result.Locale, result.OldEmail, EmailChangedEmailData{NewEmail: result.NewEmail})
+	if err == nil {
+		err = r.queueEmail(c, ser)
+	}
+
+	if err != nil {
+		log.Printf("error notifying %s of email change: %s", result.OldEmail, err)
+	}
+
+	c.Redirect(http.StatusTemporaryRedirect, r.EmailVerifiedUrl)
+}
+
+// ExportAccount downloads everything held about the user, as JSON or, with
+// ?format=csv, as a zip of CSV files.
+func (r *Controller) ExportAccount(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		log.Printf("invalid export format %s", format)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "format must be json or csv")
+		return
+	}
+
+	export, err := r.Database.GetAccountExport(c, userId)
+	if err != nil {
+		log.Printf("error exporting account for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	filename := "linkup-export-" + time.Now().UTC().Format("2006-01-02")
+
+	if format == "json" {
+		c.Header("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		c.JSON(http.StatusOK, export)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`.zip"`)
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	err = writeExportZip(c.Writer, export)
+	if err != nil {
+		log.Printf("error writing export for user id %s: %s", userId, err)
+	}
+}
+
+// DeleteAccount deletes the user and everything that belongs to them, links and
+// clicks included. The frontend offers ExportAccount first, as this can't be undone.
+func (r *Controller) DeleteAccount(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	deleteRequest := DeleteAccountApiRequest{}
+	if err := c.ShouldBindJSON(&deleteRequest); err != nil {
+		log.Printf("invalid delete account request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if user.HashedPassword != "" {
+		if !r.checkCurrentPassword(c, user, deleteRequest.Password) {
+			return
+		}
+	} else if !strings.EqualFold(strings.TrimSpace(deleteRequest.Email), user.Email) {
+		log.Printf("email doesn't match for deleting user id %s", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Email doesn't match the account")
+		return
+	} else if !r.checkRecentLogin(c, user) {
+		return
+	}
+
+	workspaces, err := r.Database.GetWorkspaces(c, user.Id)
+	if err != nil {
+		log.Printf("error getting workspaces for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for _, workspace := range workspaces {
+		if workspace.Role == WORKSPACE_ROLE_OWNER && workspace.OwnerCount == 1 && workspace.MemberCount > 1 {
+			log.Printf("user id %s is the only owner of workspace id %s", user.Id, workspace.Id)
+			c.AbortWithStatusJSON(http.StatusConflict, fmt.Sprintf("Make someone else an owner of %s before deleting your account", workspace.Name))
+			return
+		}
+	}
+
+	paths, err := r.Database.DeleteUser(c, user.Id)
+	if err != nil {
+		log.Printf("error deleting user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for _, path := range paths {
+		r.RedirectCache.Remove(path)
+	}
+
+	log.Printf("deleted user id %s along with %d links", user.Id, len(paths))
+
+	c.Status(http.StatusNoContent)
+}
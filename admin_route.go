@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const DEFAULT_OUTBOX_PAGE_SIZE = 50
+const MAX_OUTBOX_PAGE_SIZE = 200
+
+type OutboxMessageResponse struct {
+	Id            string          `json:"id"`
+	Kind          string          `json:"kind"`
+	Payload       json.RawMessage `json:"payload"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+	DeadAt        *time.Time      `json:"dead_at"`
+}
+
+type OutboxStatsResponse struct {
+	Pending         int        `json:"pending"`
+	Dead            int        `json:"dead"`
+	OldestPendingAt *time.Time `json:"oldest_pending_at"`
+}
+
+// requireAdmin only lets through users flagged as admins in the database.
+func (r *Controller) requireAdmin(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	if !user.IsAdmin {
+		log.Printf("user id %s is not an admin", user.Id)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	c.Next()
+}
+
+// GetOutboxMessages lists the outbox's pending messages by default, newest first, or
+// its dead-lettered or delivered ones with ?status=dead or ?status=delivered.
+func (r *Controller) GetOutboxMessages(c *gin.Context) {
+	request := GetOutboxMessagesRequest{Status: c.DefaultQuery("status", OUTBOX_STATUS_PENDING)}
+
+	if request.Status != OUTBOX_STATUS_PENDING && request.Status != OUTBOX_STATUS_DEAD && request.Status != OUTBOX_STATUS_DELIVERED {
+		log.Printf("invalid outbox status %s", request.Status)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "status must be pending, dead or delivered")
+		return
+	}
+
+	if kind := c.Query("kind"); kind != "" {
+		request.Kind = &kind
+	}
+
+	var err error
+	request.Limit, err = strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(DEFAULT_OUTBOX_PAGE_SIZE)))
+	if err != nil || request.Limit < 1 || request.Limit > MAX_OUTBOX_PAGE_SIZE {
+		log.Printf("invalid outbox limit %s", c.Query("limit"))
+		c.AbortWithStatusJSON(http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MAX_OUTBOX_PAGE_SIZE))
+		return
+	}
+
+	request.Offset, err = strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || request.Offset < 0 {
+		log.Printf("invalid outbox offset %s", c.Query("offset"))
+		c.AbortWithStatusJSON(http.StatusBadRequest, "offset must be a positive number")
+		return
+	}
+
+	messages, err := r.Database.GetOutboxMessages(c, request)
+	if err != nil {
+		log.Println("error getting outbox messages: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []OutboxMessageResponse{}
+	for _, message := range messages {
+		response = append(response, OutboxMessageResponse{
+			Id:            message.Id,
+			Kind:          message.Kind,
+			Payload:       message.Payload,
+			Attempts:      message.Attempts,
+			LastError:     message.LastError,
+			NextAttemptAt: message.NextAttemptAt,
+			CreatedAt:     message.CreatedAt,
+			DeliveredAt:   message.DeliveredAt,
+			DeadAt:        message.DeadAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) GetOutboxStats(c *gin.Context) {
+	stats, err := r.Database.GetOutboxStats(c)
+	if err != nil {
+		log.Println("error getting outbox stats: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, OutboxStatsResponse{Pending: stats.Pending, Dead: stats.Dead, OldestPendingAt: stats.OldestPendingAt})
+}
+
+// ReplayOutboxMessage sends a dead-lettered message again, with a fresh set of attempts.
+func (r *Controller) ReplayOutboxMessage(c *gin.Context) {
+	messageId := c.Param("id")
+	if _, err := uuid.Parse(messageId); err != nil {
+		log.Printf("invalid outbox message id %s: %s", messageId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	replayed, err := r.Database.ReplayOutboxMessage(c, messageId)
+	if err != nil {
+		log.Printf("error replaying outbox message %s: %s", messageId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !replayed {
+		log.Printf("outbox message %s not found or not dead-lettered", messageId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	c.Status(http.StatusAccepted)
+}
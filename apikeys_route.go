@@ -0,0 +1,170 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// API keys look like lk_<prefix>_<secret>. The prefix is stored in the clear so a
+// key can be recognised in the list, only a hash of the whole key is kept.
+const API_KEY_PREFIX = "lk_"
+const API_KEY_ID_LENGTH = 8
+const API_KEY_SECRET_LENGTH = 40
+const MAX_API_KEY_NAME_LENGTH = 100
+
+const SCOPE_FULL = "full"
+const SCOPE_READ_ONLY = "read"
+const SCOPE_LINK_CREATE = "link:create"
+
+var apiKeyScopes = []string{SCOPE_FULL, SCOPE_READ_ONLY, SCOPE_LINK_CREATE}
+
+type CreateApiKeyApiRequest struct {
+	Name  string `json:"name" binding:"required"`
+	Scope string `json:"scope"`
+}
+
+type ApiKeyResponse struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scope      string     `json:"scope"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func (r *Controller) CreateApiKey(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apiRequest := CreateApiKeyApiRequest{}
+	err = c.ShouldBindJSON(&apiRequest)
+	if err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if apiRequest.Scope == "" {
+		apiRequest.Scope = SCOPE_FULL
+	}
+
+	if !isValidApiKeyScope(apiRequest.Scope) {
+		log.Printf("invalid api key scope %s", apiRequest.Scope)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "scope must be one of "+strings.Join(apiKeyScopes, ", "))
+		return
+	}
+
+	prefix := API_KEY_PREFIX + uniuri.NewLen(API_KEY_ID_LENGTH)
+	key := prefix + "_" + uniuri.NewLen(API_KEY_SECRET_LENGTH)
+
+	cakr := CreateApiKeyRequest{
+		UserId:  userId,
+		Name:    truncateString(apiRequest.Name, MAX_API_KEY_NAME_LENGTH),
+		Prefix:  prefix,
+		KeyHash: hashToken(key),
+		Scope:   apiRequest.Scope,
+	}
+
+	apiKey, err := r.Database.CreateApiKey(c, cakr)
+	if err != nil {
+		log.Printf("error creating api key for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := toApiKeyResponse(apiKey)
+	response.Key = key
+
+	c.JSON(http.StatusCreated, response)
+}
+
+func (r *Controller) GetApiKeys(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apiKeys, err := r.Database.GetApiKeys(c, userId)
+	if err != nil {
+		log.Printf("error getting api keys for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []ApiKeyResponse{}
+	for _, apiKey := range apiKeys {
+		response = append(response, toApiKeyResponse(apiKey))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) RevokeApiKey(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apiKeyId := c.Param("id")
+	if _, err := uuid.Parse(apiKeyId); err != nil {
+		log.Printf("invalid api key id %s: %s", apiKeyId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	revoked, err := r.Database.RevokeApiKey(c, userId, apiKeyId)
+	if err != nil {
+		log.Printf("error revoking api key id %s for user id %s: %s", apiKeyId, userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		log.Printf("active api key id %s not found for user id %s", apiKeyId, userId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func isValidApiKeyScope(scope string) bool {
+	for _, valid := range apiKeyScopes {
+		if scope == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiKeyPrefix is the part of a key that's safe to log.
+func apiKeyPrefix(key string) string {
+	return truncateString(key, len(API_KEY_PREFIX)+API_KEY_ID_LENGTH)
+}
+
+func toApiKeyResponse(apiKey ApiKeyRecord) ApiKeyResponse {
+	return ApiKeyResponse{
+		Id:         apiKey.Id,
+		Name:       apiKey.Name,
+		Prefix:     apiKey.Prefix,
+		Scope:      apiKey.Scope,
+		CreatedAt:  apiKey.CreatedAt,
+		LastUsedAt: apiKey.LastUsedAt,
+	}
+}
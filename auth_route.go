@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/dchest/uniuri"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -15,8 +19,19 @@ type AuthCreds struct {
 	Password string `json:"password" binding:"required"`
 }
 
+// RegisterRequest's Locale picks the language of the user's emails. When it's missing
+// or not one there are templates for, it's taken from the Accept-Language header.
+type RegisterRequest struct {
+	Email    string `json:"email" binding:"required"`
+	Password string `json:"password" binding:"required"`
+	Locale   string `json:"locale"`
+}
+
+// RegisterUser answers 201 whether or not the email is already registered, so it
+// can't be used to find out which emails are. The owner of an existing one is emailed
+// instead.
 func (r *Controller) RegisterUser(c *gin.Context) {
-	registerRequest := AuthCreds{}
+	registerRequest := RegisterRequest{}
 
 	if err := c.ShouldBindJSON(&registerRequest); err != nil {
 		log.Printf("invalid register request: %s", err)
@@ -25,11 +40,19 @@ func (r *Controller) RegisterUser(c *gin.Context) {
 	}
 
 	if valid := emailAndPasswordAreValid(registerRequest.Email, registerRequest.Password); !valid {
-		log.Printf("invalid email %s or password %s", registerRequest.Email, registerRequest.Password)
+		log.Printf("invalid email %s or empty password", registerRequest.Email)
 		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid email or password")
 		return
 	}
 
+	// hashed before checking the email, so registering an existing one takes as long
+	hashedPassword, err := generateHashedPassword(registerRequest.Password)
+	if err != nil {
+		log.Println("error hashing password:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
 	exists, err := r.Database.EmailExists(c, registerRequest.Email)
 	if err != nil {
 		log.Printf("error checking email %s exists: %s", registerRequest.Email, err)
@@ -38,20 +61,33 @@ func (r *Controller) RegisterUser(c *gin.Context) {
 	}
 
 	if exists {
-		log.Println("email exists:", registerRequest.Email)
-		c.AbortWithStatusJSON(http.StatusBadRequest, "Email exists")
+		log.Printf("email %s exists, emailing its owner rather than registering it", registerRequest.Email)
+		go r.sendAccountExistsEmail(registerRequest.Email)
+		c.Status(http.StatusCreated)
 		return
 	}
 
-	hashedPassword, err := generateHashedPassword(registerRequest.Password)
+	locale := registerRequest.Locale
+	if !isSupportedLocale(locale) {
+		locale = matchLocale(c.GetHeader("Accept-Language"))
+	}
+
+	code := uuid.New().String()
+	verificationEmail, err := r.verificationEmail(registerRequest.Email, code, locale)
 	if err != nil {
-		log.Println("error hashing password:", err)
+		log.Printf("error rendering email confirmation to %s: %s", registerRequest.Email, err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	code := uuid.New().String()
-	cur := CreateUserRequest{Email: registerRequest.Email, Password: hashedPassword, VerificationCode: code}
+	cur := CreateUserRequest{
+		Email:               registerRequest.Email,
+		Password:            hashedPassword,
+		VerificationCode:    code,
+		VerificationCodeTtl: r.VerificationCodeTtl,
+		VerificationEmail:   verificationEmail,
+		Locale:              locale,
+	}
 
 	err = r.Database.CreateUser(c, cur)
 	if err != nil {
@@ -60,19 +96,110 @@ func (r *Controller) RegisterUser(c *gin.Context) {
 		return
 	}
 
-	subject := "Confirm your registration with LinkUp"
-	content_template := "Click this link to confirm your registration with LinkUp: %s/%s"
-	content := fmt.Sprintf(content_template, r.ConfirmationUri, code)
+	r.OutboxDispatcher.Wake()
+
+	c.Status(http.StatusCreated)
+}
 
-	ser := SendEmailRequest{Email: registerRequest.Email, Subject: subject, Content: content}
-	err = r.Emailer.SendEmail(ser)
+const ACCOUNT_EXISTS_EMAIL_TIMEOUT = 30 * time.Second
+
+// sendAccountExistsEmail tells the owner of an email someone tried to register it
+// again, or to change another account's email to it. If the account isn't verified
+// yet, it's most likely them trying again, so the verification email is resent instead.
+func (r *Controller) sendAccountExistsEmail(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ACCOUNT_EXISTS_EMAIL_TIMEOUT)
+	defer cancel()
+
+	result, err := r.Database.GetUser(ctx, email)
 	if err != nil {
-		log.Printf("error sending email confirmation to %s: %s", registerRequest.Email, err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		log.Printf("error fetching user for email %s: %s", email, err)
 		return
 	}
 
-	c.Status(http.StatusCreated)
+	if !result.Found {
+		return
+	}
+
+	if !result.User.IsVerified {
+		r.resendVerificationEmail(email)
+		return
+	}
+
+	ser, err := r.EmailTemplates.Render(EMAIL_TEMPLATE_ACCOUNT_EXISTS, result.User.Locale, email, nil)
+	if err != nil {
+		log.Printf("error rendering account exists email to %s: %s", email, err)
+		return
+	}
+
+	err = r.queueEmail(ctx, ser)
+	if err != nil {
+		log.Printf("error queueing account exists email to %s: %s", email, err)
+		return
+	}
+
+	log.Printf("queued account exists email to %s", email)
+}
+
+func (r *Controller) verificationEmail(email string, code string, locale string) (SendEmailRequest, error) {
+	data := VerificationEmailData{Url: fmt.Sprintf("%s/%s", r.ConfirmationUri, code), ExpiresIn: r.VerificationCodeTtl}
+	return r.EmailTemplates.Render(EMAIL_TEMPLATE_VERIFICATION, locale, email, data)
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+const RESEND_VERIFICATION_TIMEOUT = 30 * time.Second
+
+// ResendVerification always answers 202 so it can't be used to find out whether an
+// email is registered. New codes are only sent once per cooldown for each email.
+func (r *Controller) ResendVerification(c *gin.Context) {
+	resendRequest := ResendVerificationRequest{}
+
+	if err := c.ShouldBindJSON(&resendRequest); err != nil {
+		log.Printf("invalid resend verification request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	go r.resendVerificationEmail(resendRequest.Email)
+
+	c.Status(http.StatusAccepted)
+}
+
+func (r *Controller) resendVerificationEmail(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), RESEND_VERIFICATION_TIMEOUT)
+	defer cancel()
+
+	code := uuid.New().String()
+	ser, err := r.verificationEmail(email, code, r.localeForEmail(ctx, email, DEFAULT_LOCALE))
+	if err != nil {
+		log.Printf("error rendering email confirmation to %s: %s", email, err)
+		return
+	}
+
+	rvcr := RefreshVerificationCodeRequest{
+		Email:             email,
+		VerificationCode:  code,
+		Ttl:               r.VerificationCodeTtl,
+		Cooldown:          r.VerificationCooldown,
+		VerificationEmail: ser,
+	}
+
+	refreshed, err := r.Database.RefreshVerificationCode(ctx, rvcr)
+	if err != nil {
+		log.Printf("error refreshing verification code for email %s: %s", email, err)
+		return
+	}
+
+	if !refreshed {
+		log.Printf("not resending verification to %s as it's unknown, verified or was sent too recently", email)
+		return
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	log.Printf("queued email confirmation to %s", email)
 }
 
 func emailAndPasswordAreValid(email string, password string) bool {
@@ -91,15 +218,25 @@ func generateHashedPassword(password string) (string, error) {
 	return string(hashedPassword), nil
 }
 
+const INVALID_CREDENTIALS_MESSAGE = "Invalid email or password"
+
+// dummyPasswordHash is compared against when the email doesn't exist, so that takes
+// as long as a wrong password and the timing doesn't give away which emails exist.
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("not a real password"), bcrypt.DefaultCost)
+
 func (r *Controller) LoginUser(c *gin.Context) {
 	loginRequest := AuthCreds{}
 
 	if err := c.ShouldBindJSON(&loginRequest); err != nil {
-		log.Println("invalid request: ", loginRequest)
+		log.Printf("invalid login request: %s", err)
 		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid request")
 		return
 	}
 
+	if !checkRateLimit(c, r.LoginRateLimiter, accountRateLimitKey(loginRequest.Email)) {
+		return
+	}
+
 	result, err := r.Database.GetUser(c, loginRequest.Email)
 	if err != nil {
 		log.Printf("error fetching user for email %s: %s", loginRequest.Email, err)
@@ -108,8 +245,26 @@ func (r *Controller) LoginUser(c *gin.Context) {
 	}
 
 	if !result.Found {
+		checkPasswordIsCorrect(loginRequest.Password, string(dummyPasswordHash))
 		log.Printf("email %s doesn't exist", loginRequest.Email)
-		c.AbortWithStatusJSON(http.StatusBadRequest, "Email doesn't exist")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, INVALID_CREDENTIALS_MESSAGE)
+		return
+	}
+
+	err = checkPasswordIsCorrect(loginRequest.Password, result.User.HashedPassword)
+
+	// a locked account answers like a wrong password, even when it's right, so the
+	// lockout doesn't show which emails exist
+	if result.User.LockedFor > 0 {
+		log.Printf("email %s is locked out for %s", loginRequest.Email, result.User.LockedFor)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, INVALID_CREDENTIALS_MESSAGE)
+		return
+	}
+
+	if err != nil {
+		log.Printf("incorrect password for email %s: %s", loginRequest.Email, err)
+		r.recordFailedLogin(c, result.User.Id)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, INVALID_CREDENTIALS_MESSAGE)
 		return
 	}
 
@@ -119,21 +274,128 @@ func (r *Controller) LoginUser(c *gin.Context) {
 		return
 	}
 
-	err = checkPasswordIsCorrect(loginRequest.Password, result.User.HashedPassword)
+	err = r.Database.ResetFailedLogins(c, result.User.Id)
+	if err != nil {
+		log.Printf("error resetting failed logins for email %s: %s", loginRequest.Email, err)
+	}
+
+	if result.User.TotpEnabled {
+		r.requireMfa(c, result.User.Id)
+		return
+	}
+
+	tokens, err := r.issueTokens(c, result.User.Id)
+	if err != nil {
+		log.Printf("error issuing tokens for email %s: %s", loginRequest.Email, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// recordFailedLogin counts towards locking the account. The response is the same
+// either way, the lockout only shows on the next attempt.
+func (r *Controller) recordFailedLogin(c *gin.Context, userId string) {
+	rflr := RecordFailedLoginRequest{
+		UserId:      userId,
+		Threshold:   r.LoginLockoutThreshold,
+		BaseLockout: r.LoginLockoutBase,
+		MaxLockout:  r.LoginLockoutMax,
+	}
+
+	lockedFor, err := r.Database.RecordFailedLogin(c, rflr)
+	if err != nil {
+		log.Printf("error recording failed login for user id %s: %s", userId, err)
+		return
+	}
+
+	if lockedFor > 0 {
+		log.Printf("locked out user id %s for %s", userId, lockedFor)
+	}
+}
+
+// requireMfa answers a correct password with a short lived token that LoginWithMfa
+// exchanges, along with a 2FA code, for the real tokens.
+func (r *Controller) requireMfa(c *gin.Context, userId string) {
+	mfaToken, err := r.TokenClient.GenerateMfaToken(userId)
 	if err != nil {
-		log.Printf("incorrect password %s for email %s: ", loginRequest.Password, err)
-		c.AbortWithStatusJSON(http.StatusBadRequest, "Incorrect password")
+		log.Printf("error generating mfa token for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, MfaRequiredResponse{MfaRequired: true, MfaToken: mfaToken, ExpiresIn: int(r.MfaTokenTtl.Seconds())})
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can only be used once.
+func (r *Controller) RefreshToken(c *gin.Context) {
+	refreshRequest := RefreshTokenRequest{}
+
+	if err := c.ShouldBindJSON(&refreshRequest); err != nil {
+		log.Printf("invalid refresh request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	token, err := r.TokenClient.GenerateToken(result.User.Id)
+	refreshToken := uniuri.NewLen(REFRESH_TOKEN_LENGTH)
+	rsr := RotateSessionRequest{
+		RefreshTokenHash:    hashToken(refreshRequest.RefreshToken),
+		NewRefreshTokenHash: hashToken(refreshToken),
+		Ttl:                 r.RefreshTokenTtl,
+	}
+
+	result, err := r.Database.RotateSession(c, rsr)
 	if err != nil {
-		log.Printf("error generating jwt token for email %s: %s", loginRequest.Email, err)
+		log.Printf("error rotating session: %s", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.String(http.StatusOK, token)
+	if !result.Found {
+		log.Println("refresh token is unknown, expired or revoked")
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	tokens, err := r.newTokenResponse(result.Session.UserId, result.Session.Id, refreshToken)
+	if err != nil {
+		log.Printf("error generating tokens for session id %s: %s", result.Session.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (r *Controller) Logout(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessionId := c.GetString("sessionId")
+	if sessionId == "" {
+		log.Printf("can't log out user id %s as the request isn't from a session", userId)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Not logged in with a session")
+		return
+	}
+
+	_, err = r.Database.RevokeSession(c, userId, sessionId)
+	if err != nil {
+		log.Printf("error revoking session id %s for user id %s: %s", sessionId, userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
 
 func checkPasswordIsCorrect(password string, hashedPassword string) error {
@@ -149,12 +411,141 @@ func (r *Controller) VerifyEmail(c *gin.Context) {
 		return
 	}
 
-	err := r.Database.ConfirmEmailVerified(c, code)
+	if _, err := uuid.Parse(code); err != nil {
+		log.Printf("invalid verification code %s: %s", code, err)
+		c.Redirect(http.StatusTemporaryRedirect, r.errorRedirectUrlWithReason("invalid_verification_code"))
+		return
+	}
+
+	result, err := r.Database.ConfirmEmailVerified(c, code)
 	if err != nil {
 		log.Printf("error confirming email verified for code %s: %s", code, err)
+		c.Redirect(http.StatusTemporaryRedirect, r.ErrorRedirectUrl)
+		return
+	}
+
+	switch result {
+	case VERIFICATION_CODE_EXPIRED:
+		log.Printf("verification code %s has expired", code)
+		c.Redirect(http.StatusTemporaryRedirect, r.errorRedirectUrlWithReason("verification_code_expired"))
+	case VERIFICATION_CODE_UNKNOWN:
+		log.Printf("verification code %s is unknown or already used", code)
+		c.Redirect(http.StatusTemporaryRedirect, r.errorRedirectUrlWithReason("invalid_verification_code"))
+	default:
+		c.Redirect(http.StatusTemporaryRedirect, r.EmailVerifiedUrl)
+	}
+}
+
+// errorRedirectUrlWithReason lets the frontend explain what went wrong, e.g. offer to
+// resend the verification email when the code expired.
+func (r *Controller) errorRedirectUrlWithReason(reason string) string {
+	u, err := url.Parse(r.ErrorRedirectUrl)
+	if err != nil {
+		return r.ErrorRedirectUrl
+	}
+
+	query := u.Query()
+	query.Set("reason", reason)
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+const PASSWORD_RESET_TOKEN_LENGTH = 48
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+type ResetPasswordApiRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required"`
+}
+
+const PASSWORD_RESET_TIMEOUT = 30 * time.Second
+
+// ForgotPassword always answers 202, and before doing any work, so neither the
+// response nor its timing tell whether an email is registered.
+func (r *Controller) ForgotPassword(c *gin.Context) {
+	forgotRequest := ForgotPasswordRequest{}
+
+	if err := c.ShouldBindJSON(&forgotRequest); err != nil {
+		log.Printf("invalid forgot password request: %s", err)
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	c.Redirect(http.StatusTemporaryRedirect, r.EmailVerifiedUrl)
+	go r.sendPasswordReset(forgotRequest.Email)
+
+	c.Status(http.StatusAccepted)
+}
+
+func (r *Controller) sendPasswordReset(email string) {
+	ctx, cancel := context.WithTimeout(context.Background(), PASSWORD_RESET_TIMEOUT)
+	defer cancel()
+
+	result, err := r.Database.GetUser(ctx, email)
+	if err != nil {
+		log.Printf("error fetching user for email %s: %s", email, err)
+		return
+	}
+
+	if !result.Found {
+		log.Printf("not sending password reset as email %s doesn't exist", email)
+		return
+	}
+
+	token := uniuri.NewLen(PASSWORD_RESET_TOKEN_LENGTH)
+	data := PasswordResetEmailData{Url: fmt.Sprintf("%s?token=%s", r.PasswordResetUrl, token), ExpiresIn: r.PasswordResetTokenTtl}
+	ser, err := r.EmailTemplates.Render(EMAIL_TEMPLATE_PASSWORD_RESET, result.User.Locale, email, data)
+	if err != nil {
+		log.Printf("error rendering password reset to %s: %s", email, err)
+		return
+	}
+
+	cprtr := CreatePasswordResetTokenRequest{UserId: result.User.Id, TokenHash: hashToken(token), Ttl: r.PasswordResetTokenTtl, ResetEmail: ser}
+
+	err = r.Database.CreatePasswordResetToken(ctx, cprtr)
+	if err != nil {
+		log.Printf("error creating password reset token for email %s: %s", email, err)
+		return
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	log.Printf("queued password reset to %s", email)
+}
+
+func (r *Controller) ResetPassword(c *gin.Context) {
+	resetRequest := ResetPasswordApiRequest{}
+
+	if err := c.ShouldBindJSON(&resetRequest); err != nil {
+		log.Printf("invalid reset password request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	hashedPassword, err := generateHashedPassword(resetRequest.Password)
+	if err != nil {
+		log.Println("error hashing password:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	rpr := ResetPasswordRequest{TokenHash: hashToken(resetRequest.Token), HashedPassword: hashedPassword}
+
+	reset, err := r.Database.ResetPassword(c, rpr)
+	if err != nil {
+		log.Printf("error resetting password: %s", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !reset {
+		log.Println("invalid, expired or used password reset token")
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid or expired token")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
 }
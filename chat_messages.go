@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Webhook formats. JSON endpoints get the signed WebhookEvent, while Slack and Teams
+// incoming webhooks get a message they can post as is.
+const WEBHOOK_FORMAT_JSON = "json"
+const WEBHOOK_FORMAT_SLACK = "slack"
+const WEBHOOK_FORMAT_TEAMS = "teams"
+
+var webhookFormats = []string{WEBHOOK_FORMAT_JSON, WEBHOOK_FORMAT_SLACK, WEBHOOK_FORMAT_TEAMS}
+
+func isValidWebhookFormat(format string) bool {
+	for _, valid := range webhookFormats {
+		if format == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+type clickFact struct {
+	Title string
+	Value string
+}
+
+func clickHeadline(notification ClickNotification) string {
+	if notification.Tag != "" {
+		return fmt.Sprintf("%s just clicked your link", notification.Tag)
+	}
+
+	return "Your link was just clicked"
+}
+
+// clickFacts are the details shown in chat messages, in the order they're shown.
+func clickFacts(notification ClickNotification) []clickFact {
+	facts := []clickFact{}
+
+	if notification.Tag != "" {
+		facts = append(facts, clickFact{Title: "Tag", Value: notification.Tag})
+	}
+
+	facts = append(facts,
+		clickFact{Title: "Destination", Value: notification.RedirectUrl},
+		clickFact{Title: "Clicks", Value: fmt.Sprintf("%d", notification.ClickCount)},
+	)
+
+	if location := describeLocation(notification.Location); location != "" {
+		facts = append(facts, clickFact{Title: "Location", Value: location})
+	}
+
+	if device := describeDevice(notification.Device); device != "" {
+		facts = append(facts, clickFact{Title: "Device", Value: device})
+	}
+
+	return facts
+}
+
+func describeLocation(location GeoLocation) string {
+	return joinNonEmpty(", ", location.City, location.Region, location.CountryCode)
+}
+
+func describeDevice(device DeviceInfo) string {
+	return joinNonEmpty(" · ", device.DeviceType, device.Browser, device.OS)
+}
+
+func joinNonEmpty(separator string, values ...string) string {
+	parts := []string{}
+	for _, value := range values {
+		if value != "" {
+			parts = append(parts, value)
+		}
+	}
+
+	return strings.Join(parts, separator)
+}
+
+// slackClickMessage is a Block Kit message, with text as the fallback for
+// notifications.
+func slackClickMessage(notification ClickNotification) map[string]any {
+	headline := clickHeadline(notification)
+
+	fields := []map[string]any{}
+	for _, fact := range clickFacts(notification) {
+		fields = append(fields, map[string]any{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", fact.Title, escapeSlackText(fact.Value))})
+	}
+
+	return map[string]any{
+		"text": escapeSlackText(headline),
+		"blocks": []map[string]any{
+			{
+				"type": "section",
+				"text": map[string]any{"type": "mrkdwn", "text": fmt.Sprintf("*%s*", escapeSlackText(headline))},
+			},
+			{
+				"type":   "section",
+				"fields": fields,
+			},
+			{
+				"type": "context",
+				"elements": []map[string]any{
+					{"type": "mrkdwn", "text": fmt.Sprintf("<%s|%s> · LinkUp", notification.TrackedUrl, escapeSlackText(notification.TrackedUrl))},
+				},
+			},
+		},
+	}
+}
+
+func slackTextMessage(text string) map[string]any {
+	return map[string]any{"text": escapeSlackText(text)}
+}
+
+// escapeSlackText escapes the characters Slack treats as markup.
+func escapeSlackText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// teamsClickMessage is an Adaptive Card in the message envelope Teams incoming
+// webhooks and workflows expect.
+func teamsClickMessage(notification ClickNotification) map[string]any {
+	facts := []map[string]any{}
+	for _, fact := range clickFacts(notification) {
+		facts = append(facts, map[string]any{"title": fact.Title, "value": fact.Value})
+	}
+
+	body := []map[string]any{
+		{"type": "TextBlock", "text": clickHeadline(notification), "weight": "Bolder", "size": "Medium", "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+
+	actions := []map[string]any{
+		{"type": "Action.OpenUrl", "title": "Open destination", "url": notification.RedirectUrl},
+	}
+
+	return teamsCardMessage(body, actions)
+}
+
+func teamsTextMessage(text string) map[string]any {
+	return teamsCardMessage([]map[string]any{{"type": "TextBlock", "text": text, "wrap": true}}, []map[string]any{})
+}
+
+func teamsCardMessage(body []map[string]any, actions []map[string]any) map[string]any {
+	return map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{
+			{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"contentUrl":  nil,
+				"content": map[string]any{
+					"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+					"type":    "AdaptiveCard",
+					"version": "1.4",
+					"body":    body,
+					"actions": actions,
+				},
+			},
+		},
+	}
+}
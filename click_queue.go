@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const CLICK_PROCESSING_TIMEOUT = 30 * time.Second
+
+// ClickEvent holds everything the workers need from a redirect request, captured
+// before the handler returns since the gin.Context can't be used afterwards.
+type ClickEvent struct {
+	Record  RedirectRecord
+	Request *http.Request
+	Click   AddLinkClickRequest
+}
+
+// ClickQueue is a bounded in-process queue of clicks processed by a fixed pool of
+// workers. Enqueue never blocks the redirect: when the queue is full the click is
+// dropped and counted, which is what the stats are there to surface.
+type ClickQueue struct {
+	events  chan ClickEvent
+	process func(ctx context.Context, event ClickEvent) error
+	workers int
+	wg      sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+
+	enqueued  atomic.Int64
+	dropped   atomic.Int64
+	processed atomic.Int64
+	failed    atomic.Int64
+}
+
+type ClickQueueStats struct {
+	Capacity  int   `json:"capacity"`
+	Depth     int   `json:"depth"`
+	Workers   int   `json:"workers"`
+	Enqueued  int64 `json:"enqueued"`
+	Dropped   int64 `json:"dropped"`
+	Processed int64 `json:"processed"`
+	Failed    int64 `json:"failed"`
+}
+
+func newClickQueue(size int, workers int, process func(ctx context.Context, event ClickEvent) error) *ClickQueue {
+	q := &ClickQueue{
+		events:  make(chan ClickEvent, size),
+		process: process,
+		workers: workers,
+	}
+
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	return q
+}
+
+func (q *ClickQueue) Enqueue(event ClickEvent) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		q.dropped.Add(1)
+		return false
+	}
+
+	select {
+	case q.events <- event:
+		q.enqueued.Add(1)
+		return true
+	default:
+		q.dropped.Add(1)
+		return false
+	}
+}
+
+func (q *ClickQueue) work() {
+	defer q.wg.Done()
+
+	for event := range q.events {
+		ctx, cancel := context.WithTimeout(context.Background(), CLICK_PROCESSING_TIMEOUT)
+		err := q.process(ctx, event)
+		cancel()
+
+		if err != nil {
+			log.Printf("error processing click for link path %s: %s", event.Record.Path, err)
+			q.failed.Add(1)
+			continue
+		}
+
+		q.processed.Add(1)
+	}
+}
+
+// Shutdown stops accepting clicks and waits for the workers to drain the queue,
+// giving up when ctx is done.
+func (q *ClickQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("click queue not drained, %d clicks left: %s", len(q.events), ctx.Err())
+	}
+}
+
+func (q *ClickQueue) Stats() ClickQueueStats {
+	return ClickQueueStats{
+		Capacity:  cap(q.events),
+		Depth:     len(q.events),
+		Workers:   q.workers,
+		Enqueued:  q.enqueued.Load(),
+		Dropped:   q.dropped.Load(),
+		Processed: q.processed.Load(),
+		Failed:    q.failed.Load(),
+	}
+}
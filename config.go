@@ -0,0 +1,425 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is every setting the application reads. Each field is loaded from its
+// default, then the optional YAML config file, then its environment variable,
+// so the environment always wins. Tags:
+//   - env: environment variable name
+//   - yaml: key in the config file
+//   - default: value used when neither the file nor the environment set one
+//   - required: "true" when an empty/zero value is a configuration error
+//   - min: smallest allowed value for int fields
+//   - secret: "true" to redact the value when the config is printed
+type Config struct {
+	BaseUrl                string `env:"BASE_URL" yaml:"base_url" required:"true"`
+	Port                   string `env:"PORT" yaml:"port" default:"8080"`
+	EmailVerifiedUrl       string `env:"EMAIL_VERIFIED_URL" yaml:"email_verified_url" required:"true"`
+	ErrorRedirectUrl       string `env:"ERROR_REDIRECT_URL" yaml:"error_redirect_url" required:"true"`
+	PasswordResetUrl       string `env:"PASSWORD_RESET_URL" yaml:"password_reset_url" required:"true"`
+	WorkspaceInvitationUrl string `env:"WORKSPACE_INVITATION_URL" yaml:"workspace_invitation_url" required:"true"`
+
+	DatabaseUrl         string        `env:"DATABASE_URL" yaml:"database_url" required:"true" secret:"true"`
+	DbMaxConns          int           `env:"DB_MAX_CONNS" yaml:"db_max_conns" default:"10" min:"1"`
+	DbStatementTimeout  time.Duration `env:"DB_STATEMENT_TIMEOUT" yaml:"db_statement_timeout" default:"10s"`
+	DbHealthCheckPeriod time.Duration `env:"DB_HEALTH_CHECK_PERIOD" yaml:"db_health_check_period" default:"1m"`
+	DbConnectTimeout    time.Duration `env:"DB_CONNECT_TIMEOUT" yaml:"db_connect_timeout" default:"30s"`
+
+	JwtSecret               string   `env:"JWT_SECRET" yaml:"jwt_secret" secret:"true"`
+	JwtSigningKeyFile       string   `env:"JWT_SIGNING_KEY_FILE" yaml:"jwt_signing_key_file"`
+	JwtVerificationKeyFiles []string `env:"JWT_VERIFICATION_KEY_FILES" yaml:"jwt_verification_key_files"`
+	JwtIssuer               string   `env:"JWT_ISSUER" yaml:"jwt_issuer"`
+	JwtAudience             string   `env:"JWT_AUDIENCE" yaml:"jwt_audience"`
+
+	OidcProviders   []OidcProviderConfig `env:"OIDC_PROVIDERS" yaml:"oidc_providers"`
+	OidcRedirectUrl string               `env:"OIDC_REDIRECT_URL" yaml:"oidc_redirect_url"`
+
+	AccessTokenTtl  time.Duration `env:"ACCESS_TOKEN_TTL" yaml:"access_token_ttl" default:"15m"`
+	RefreshTokenTtl time.Duration `env:"REFRESH_TOKEN_TTL" yaml:"refresh_token_ttl" default:"720h"`
+	MfaTokenTtl     time.Duration `env:"MFA_TOKEN_TTL" yaml:"mfa_token_ttl" default:"5m"`
+	TotpIssuer      string        `env:"TOTP_ISSUER" yaml:"totp_issuer" default:"LinkUp"`
+
+	// ReauthenticationMaxAge is how recently users without a password must have logged
+	// in to change their email or delete their account.
+	ReauthenticationMaxAge time.Duration `env:"REAUTHENTICATION_MAX_AGE" yaml:"reauthentication_max_age" default:"5m"`
+
+	EmailBackend   string `env:"EMAIL_BACKEND" yaml:"email_backend" default:"sendgrid"`
+	EmailsFrom     string `env:"EMAILS_FROM" yaml:"emails_from" required:"true"`
+	SendgridApiKey string `env:"SENDGRID_API_KEY" yaml:"sendgrid_api_key" secret:"true"`
+	EmailDirectory string `env:"EMAIL_DIRECTORY" yaml:"email_directory" default:"emails"`
+	SupportEmail   string `env:"SUPPORT_EMAIL" yaml:"support_email"`
+
+	// EmailTemplatesDir holds templates that replace the ones in email_templates, laid
+	// out the same way.
+	EmailTemplatesDir string `env:"EMAIL_TEMPLATES_DIR" yaml:"email_templates_dir"`
+
+	SmtpHost        string        `env:"SMTP_HOST" yaml:"smtp_host"`
+	SmtpPort        int           `env:"SMTP_PORT" yaml:"smtp_port" default:"587" min:"1"`
+	SmtpUsername    string        `env:"SMTP_USERNAME" yaml:"smtp_username"`
+	SmtpPassword    string        `env:"SMTP_PASSWORD" yaml:"smtp_password" secret:"true"`
+	SmtpTls         string        `env:"SMTP_TLS" yaml:"smtp_tls" default:"starttls"`
+	SmtpAuth        string        `env:"SMTP_AUTH" yaml:"smtp_auth" default:"plain"`
+	SmtpTimeout     time.Duration `env:"SMTP_TIMEOUT" yaml:"smtp_timeout" default:"10s"`
+	SmtpIdleTimeout time.Duration `env:"SMTP_IDLE_TIMEOUT" yaml:"smtp_idle_timeout" default:"30s"`
+
+	PasswordResetTokenTtl      time.Duration `env:"PASSWORD_RESET_TOKEN_TTL" yaml:"password_reset_token_ttl" default:"1h"`
+	VerificationCodeTtl        time.Duration `env:"VERIFICATION_CODE_TTL" yaml:"verification_code_ttl" default:"24h"`
+	EmailChangeTokenTtl        time.Duration `env:"EMAIL_CHANGE_TOKEN_TTL" yaml:"email_change_token_ttl" default:"24h"`
+	WorkspaceInvitationTtl     time.Duration `env:"WORKSPACE_INVITATION_TTL" yaml:"workspace_invitation_ttl" default:"168h"`
+	VerificationResendCooldown time.Duration `env:"VERIFICATION_RESEND_COOLDOWN" yaml:"verification_resend_cooldown" default:"1m"`
+
+	AuthRateLimitPerMinute  int           `env:"AUTH_RATE_LIMIT_PER_MINUTE" yaml:"auth_rate_limit_per_minute" default:"60" min:"1"`
+	AuthRateLimitBurst      int           `env:"AUTH_RATE_LIMIT_BURST" yaml:"auth_rate_limit_burst" default:"20" min:"1"`
+	LoginRateLimitPerMinute int           `env:"LOGIN_RATE_LIMIT_PER_MINUTE" yaml:"login_rate_limit_per_minute" default:"5" min:"1"`
+	LoginRateLimitBurst     int           `env:"LOGIN_RATE_LIMIT_BURST" yaml:"login_rate_limit_burst" default:"10" min:"1"`
+	LoginLockoutThreshold   int           `env:"LOGIN_LOCKOUT_THRESHOLD" yaml:"login_lockout_threshold" default:"5" min:"1"`
+	LoginLockoutBase        time.Duration `env:"LOGIN_LOCKOUT_BASE" yaml:"login_lockout_base" default:"1m"`
+	LoginLockoutMax         time.Duration `env:"LOGIN_LOCKOUT_MAX" yaml:"login_lockout_max" default:"1h"`
+
+	RedirectPathLength     int      `env:"REDIRECT_PATH_LENGTH" yaml:"redirect_path_length" required:"true" min:"1"`
+	MaxNumberOfEmailAlerts int      `env:"MAX_NUMBER_OF_EMAIL_ALERTS" yaml:"max_number_of_email_alerts" required:"true" min:"1"`
+	TrustedProxies         []string `env:"TRUSTED_PROXIES" yaml:"trusted_proxies" default:"10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,127.0.0.1,::1"`
+	GeoipDatabasePath      string   `env:"GEOIP_DATABASE_PATH" yaml:"geoip_database_path"`
+
+	ClickQueueSize    int           `env:"CLICK_QUEUE_SIZE" yaml:"click_queue_size" default:"1000" min:"1"`
+	ClickWorkers      int           `env:"CLICK_WORKERS" yaml:"click_workers" default:"4" min:"1"`
+	RedirectCacheSize int           `env:"REDIRECT_CACHE_SIZE" yaml:"redirect_cache_size" default:"10000" min:"0"`
+	RedirectCacheTtl  time.Duration `env:"REDIRECT_CACHE_TTL" yaml:"redirect_cache_ttl" default:"5m"`
+	ShutdownTimeout   time.Duration `env:"SHUTDOWN_TIMEOUT" yaml:"shutdown_timeout" default:"30s"`
+
+	WebhookTimeout              time.Duration `env:"WEBHOOK_TIMEOUT" yaml:"webhook_timeout" default:"10s"`
+	WebhookAllowPrivateNetworks bool          `env:"WEBHOOK_ALLOW_PRIVATE_NETWORKS" yaml:"webhook_allow_private_networks" default:"false"`
+
+	OutboxPollInterval time.Duration `env:"OUTBOX_POLL_INTERVAL" yaml:"outbox_poll_interval" default:"1s"`
+	OutboxBatchSize    int           `env:"OUTBOX_BATCH_SIZE" yaml:"outbox_batch_size" default:"20" min:"1"`
+	OutboxWorkers      int           `env:"OUTBOX_WORKERS" yaml:"outbox_workers" default:"4" min:"1"`
+	OutboxMaxAttempts  int           `env:"OUTBOX_MAX_ATTEMPTS" yaml:"outbox_max_attempts" default:"8" min:"1"`
+	OutboxRetryBase    time.Duration `env:"OUTBOX_RETRY_BASE" yaml:"outbox_retry_base" default:"30s"`
+	OutboxLockTtl      time.Duration `env:"OUTBOX_LOCK_TTL" yaml:"outbox_lock_ttl" default:"2m"`
+	OutboxRetention    time.Duration `env:"OUTBOX_RETENTION" yaml:"outbox_retention" default:"168h"`
+}
+
+// OidcProviderConfig is a "Sign in with ..." provider. In the environment they're
+// listed by name in OIDC_PROVIDERS, e.g. "google,microsoft", with each one's
+// settings in OIDC_<NAME>_ISSUER_URL, OIDC_<NAME>_CLIENT_ID and so on.
+type OidcProviderConfig struct {
+	Name         string `yaml:"name"`
+	IssuerUrl    string `yaml:"issuer_url"`
+	ClientId     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// TrustEmail treats the email as verified when the provider doesn't send an
+	// email_verified claim, as Microsoft doesn't. Only for providers whose emails
+	// are managed by an organisation, like a single tenant Entra ID app.
+	TrustEmail bool `yaml:"trust_email"`
+}
+
+var oidcProviderNamePattern = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+const REDACTED = "[REDACTED]"
+
+// loadConfig returns the configuration along with every problem found in it, so
+// that they can all be fixed in one go rather than one per restart.
+func loadConfig(path string) (*Config, error) {
+	config := &Config{}
+	problems := []error{}
+
+	forEachConfigField(config, func(field reflect.StructField, value reflect.Value) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setConfigValue(value, def); err != nil {
+				problems = append(problems, fmt.Errorf("invalid default for %s: %s", field.Tag.Get("env"), err))
+			}
+		}
+	})
+
+	if path != "" {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("error reading config file %s: %s", path, err))
+		} else if err := yaml.Unmarshal(file, config); err != nil {
+			problems = append(problems, fmt.Errorf("error parsing config file %s: %s", path, err))
+		}
+	}
+
+	forEachConfigField(config, func(field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+		raw := os.Getenv(env)
+		if raw == "" {
+			return
+		}
+
+		if err := setConfigValue(value, raw); err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s: %s", env, err))
+		}
+	})
+
+	if config.DatabaseUrl == "" {
+		config.DatabaseUrl = databaseUrlFromLegacyEnv()
+	}
+
+	if config.SupportEmail == "" {
+		config.SupportEmail = config.EmailsFrom
+	}
+
+	if config.JwtIssuer == "" {
+		config.JwtIssuer = config.BaseUrl
+	}
+
+	if config.JwtAudience == "" {
+		config.JwtAudience = config.BaseUrl
+	}
+
+	problems = append(problems, config.validate()...)
+
+	return config, errors.Join(problems...)
+}
+
+func (c *Config) validate() []error {
+	problems := []error{}
+
+	forEachConfigField(c, func(field reflect.StructField, value reflect.Value) {
+		env := field.Tag.Get("env")
+
+		if field.Tag.Get("required") == "true" && value.IsZero() {
+			problems = append(problems, fmt.Errorf("%s is required", env))
+			return
+		}
+
+		if min, ok := field.Tag.Lookup("min"); ok && value.Kind() == reflect.Int {
+			minimum, _ := strconv.Atoi(min)
+			if value.Int() < int64(minimum) {
+				problems = append(problems, fmt.Errorf("%s must be at least %d, got %d", env, minimum, value.Int()))
+			}
+		}
+	})
+
+	if c.JwtSecret == "" && c.JwtSigningKeyFile == "" {
+		problems = append(problems, fmt.Errorf("JWT_SECRET or JWT_SIGNING_KEY_FILE is required"))
+	}
+
+	for env, val := range map[string]string{
+		"BASE_URL":                 c.BaseUrl,
+		"EMAIL_VERIFIED_URL":       c.EmailVerifiedUrl,
+		"ERROR_REDIRECT_URL":       c.ErrorRedirectUrl,
+		"PASSWORD_RESET_URL":       c.PasswordResetUrl,
+		"OIDC_REDIRECT_URL":        c.OidcRedirectUrl,
+		"WORKSPACE_INVITATION_URL": c.WorkspaceInvitationUrl,
+	} {
+		if val == "" {
+			continue
+		}
+
+		if parsed, err := url.Parse(val); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("%s must be an absolute URL, got %s", env, val))
+		}
+	}
+
+	problems = append(problems, c.validateEmailBackend()...)
+	problems = append(problems, c.validateOidcProviders()...)
+
+	return problems
+}
+
+func (c *Config) validateEmailBackend() []error {
+	problems := []error{}
+
+	switch c.EmailBackend {
+	case EMAIL_BACKEND_SENDGRID:
+		if c.SendgridApiKey == "" {
+			problems = append(problems, fmt.Errorf("SENDGRID_API_KEY is required when EMAIL_BACKEND is %s", EMAIL_BACKEND_SENDGRID))
+		}
+	case EMAIL_BACKEND_SMTP:
+		if c.SmtpHost == "" {
+			problems = append(problems, fmt.Errorf("SMTP_HOST is required when EMAIL_BACKEND is %s", EMAIL_BACKEND_SMTP))
+		}
+
+		if c.SmtpTls != SMTP_TLS_STARTTLS && c.SmtpTls != SMTP_TLS_IMPLICIT && c.SmtpTls != SMTP_TLS_NONE {
+			problems = append(problems, fmt.Errorf("SMTP_TLS must be %s, %s or %s, got %q", SMTP_TLS_STARTTLS, SMTP_TLS_IMPLICIT, SMTP_TLS_NONE, c.SmtpTls))
+		}
+
+		if c.SmtpAuth != SMTP_AUTH_PLAIN && c.SmtpAuth != SMTP_AUTH_LOGIN {
+			problems = append(problems, fmt.Errorf("SMTP_AUTH must be %s or %s, got %q", SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN, c.SmtpAuth))
+		}
+	case EMAIL_BACKEND_FILE:
+		if c.EmailDirectory == "" {
+			problems = append(problems, fmt.Errorf("EMAIL_DIRECTORY is required when EMAIL_BACKEND is %s", EMAIL_BACKEND_FILE))
+		}
+	default:
+		problems = append(problems, fmt.Errorf("EMAIL_BACKEND must be %s, %s or %s, got %q", EMAIL_BACKEND_SENDGRID, EMAIL_BACKEND_SMTP, EMAIL_BACKEND_FILE, c.EmailBackend))
+	}
+
+	return problems
+}
+
+func (c *Config) validateOidcProviders() []error {
+	problems := []error{}
+
+	if len(c.OidcProviders) > 0 && c.OidcRedirectUrl == "" {
+		problems = append(problems, fmt.Errorf("OIDC_REDIRECT_URL is required when there are OIDC_PROVIDERS"))
+	}
+
+	names := map[string]bool{}
+	for _, provider := range c.OidcProviders {
+		if !oidcProviderNamePattern.MatchString(provider.Name) {
+			problems = append(problems, fmt.Errorf("OIDC provider name %q must be lowercase letters, digits and dashes", provider.Name))
+		}
+
+		if names[provider.Name] {
+			problems = append(problems, fmt.Errorf("OIDC provider %s is configured twice", provider.Name))
+		}
+		names[provider.Name] = true
+
+		if parsed, err := url.Parse(provider.IssuerUrl); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("OIDC provider %s issuer URL must be an absolute URL, got %q", provider.Name, provider.IssuerUrl))
+		}
+
+		if provider.ClientId == "" {
+			problems = append(problems, fmt.Errorf("OIDC provider %s client id is required", provider.Name))
+		}
+	}
+
+	return problems
+}
+
+// databaseUrlFromLegacyEnv keeps deployments that only set the DB_* variables the
+// migrations used to read working, now that everything connects with DATABASE_URL.
+func databaseUrlFromLegacyEnv() string {
+	host := os.Getenv("DB_HOST")
+	if host == "" {
+		return ""
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD")),
+		Host:     host + ":" + os.Getenv("DB_PORT"),
+		Path:     "/" + os.Getenv("DB_NAME"),
+		RawQuery: "sslmode=disable",
+	}
+
+	return u.String()
+}
+
+// Redacted renders the config as YAML, as it would be written in a config file,
+// with secrets masked.
+func (c *Config) Redacted() string {
+	redacted := *c
+
+	forEachConfigField(&redacted, func(field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") == "true" && !value.IsZero() {
+			value.SetString(REDACTED)
+		}
+	})
+
+	redacted.OidcProviders = []OidcProviderConfig{}
+	for _, provider := range c.OidcProviders {
+		if provider.ClientSecret != "" {
+			provider.ClientSecret = REDACTED
+		}
+		redacted.OidcProviders = append(redacted.OidcProviders, provider)
+	}
+
+	out, err := yaml.Marshal(&redacted)
+	if err != nil {
+		return fmt.Sprintf("error rendering config: %s", err)
+	}
+
+	return string(out)
+}
+
+// String makes sure printing the config by accident doesn't leak secrets.
+func (c *Config) String() string {
+	return c.Redacted()
+}
+
+func forEachConfigField(config *Config, fn func(field reflect.StructField, value reflect.Value)) {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		fn(value.Type().Field(i), value.Field(i))
+	}
+}
+
+func setConfigValue(value reflect.Value, raw string) error {
+	switch value.Interface().(type) {
+	case time.Duration:
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+	case string:
+		value.SetString(raw)
+	case int:
+		number, err := strconv.Atoi(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(number))
+	case bool:
+		boolean, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(boolean)
+	case []string:
+		items := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	case []OidcProviderConfig:
+		providers, err := oidcProvidersFromEnv(raw)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(providers))
+	default:
+		return fmt.Errorf("unsupported config type %s", value.Type())
+	}
+
+	return nil
+}
+
+func oidcProvidersFromEnv(names string) ([]OidcProviderConfig, error) {
+	providers := []OidcProviderConfig{}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+		provider := OidcProviderConfig{
+			Name:         name,
+			IssuerUrl:    os.Getenv(prefix + "ISSUER_URL"),
+			ClientId:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+
+		if trustEmail := os.Getenv(prefix + "TRUST_EMAIL"); trustEmail != "" {
+			trusted, err := strconv.ParseBool(trustEmail)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %sTRUST_EMAIL: %s", prefix, err)
+			}
+			provider.TrustEmail = trusted
+		}
+
+		providers = append(providers, provider)
+	}
+
+	return providers, nil
+}
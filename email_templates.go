@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+const EMAIL_TEMPLATES_PATH = "email_templates"
+
+const DEFAULT_LOCALE = "en"
+
+var supportedLocales = []string{"en", "es"}
+
+// Each email has a <name>.txt template in every locale's directory, defining its
+// "subject" and "text", and a <name>.html one defining the "content" that goes in
+// that locale's layout.html.
+const EMAIL_TEMPLATE_VERIFICATION = "verification"
+const EMAIL_TEMPLATE_PASSWORD_RESET = "password_reset"
+const EMAIL_TEMPLATE_EMAIL_CHANGE = "email_change"
+const EMAIL_TEMPLATE_EMAIL_CHANGED = "email_changed"
+const EMAIL_TEMPLATE_WORKSPACE_INVITATION = "workspace_invitation"
+const EMAIL_TEMPLATE_CLICK_ALERT = "click_alert"
+const EMAIL_TEMPLATE_DIGEST = "digest"
+const EMAIL_TEMPLATE_ACCOUNT_EXISTS = "account_exists"
+
+var emailTemplateNames = []string{
+	EMAIL_TEMPLATE_VERIFICATION,
+	EMAIL_TEMPLATE_PASSWORD_RESET,
+	EMAIL_TEMPLATE_EMAIL_CHANGE,
+	EMAIL_TEMPLATE_EMAIL_CHANGED,
+	EMAIL_TEMPLATE_WORKSPACE_INVITATION,
+	EMAIL_TEMPLATE_CLICK_ALERT,
+	EMAIL_TEMPLATE_DIGEST,
+	EMAIL_TEMPLATE_ACCOUNT_EXISTS,
+}
+
+type VerificationEmailData struct {
+	Url       string
+	ExpiresIn time.Duration
+}
+
+type PasswordResetEmailData struct {
+	Url       string
+	ExpiresIn time.Duration
+}
+
+type EmailChangeEmailData struct {
+	Url       string
+	ExpiresIn time.Duration
+}
+
+type EmailChangedEmailData struct {
+	NewEmail string
+}
+
+type WorkspaceInvitationEmailData struct {
+	WorkspaceName string
+	Role          string
+	Url           string
+	ExpiresIn     time.Duration
+}
+
+// ClickAlertEmailData's LastAlert is set on the last alert sent for the link.
+type ClickAlertEmailData struct {
+	Path        string
+	Tag         string
+	TrackedUrl  string
+	RedirectUrl string
+	ClickCount  int
+	Location    string
+	Device      string
+	LastAlert   bool
+}
+
+// DigestEmailData summarises the clicks on a user's links over Period. Nothing sends
+// digests yet, so the template is only there to be translated and overridden ahead
+// of that.
+type DigestEmailData struct {
+	Period      time.Duration
+	TotalClicks int
+	Links       []DigestLinkData
+}
+
+type DigestLinkData struct {
+	TrackedUrl  string
+	RedirectUrl string
+	Tag         string
+	Clicks      int
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+// EmailTemplates renders emails in the recipient's locale, as HTML with a plain text
+// alternative.
+type EmailTemplates struct {
+	templates map[string]map[string]emailTemplate
+}
+
+// newEmailTemplates loads every template up front, so a broken one stops the app
+// starting rather than failing when the email is sent. Files in overrideDir take the
+// place of the ones in email_templates.
+func newEmailTemplates(overrideDir string, supportEmail string) *EmailTemplates {
+	if address, err := mail.ParseAddress(supportEmail); err == nil {
+		supportEmail = address.Address
+	}
+
+	t := &EmailTemplates{templates: map[string]map[string]emailTemplate{}}
+
+	for _, locale := range supportedLocales {
+		funcs := map[string]any{
+			"duration":     func(d time.Duration) string { return describeDuration(d, locale) },
+			"supportEmail": func() string { return supportEmail },
+		}
+
+		layout, err := readEmailTemplate(overrideDir, locale, "layout.html")
+		if err != nil {
+			log.Panicf("error reading %s email layout: %s", locale, err)
+		}
+
+		t.templates[locale] = map[string]emailTemplate{}
+
+		for _, name := range emailTemplateNames {
+			template, err := parseEmailTemplate(overrideDir, locale, name, layout, funcs)
+			if err != nil {
+				log.Panicf("error loading %s email template %s: %s", locale, name, err)
+			}
+
+			t.templates[locale][name] = template
+		}
+	}
+
+	if overrideDir != "" {
+		log.Printf("loaded email templates with overrides from %s", overrideDir)
+	}
+
+	return t
+}
+
+func parseEmailTemplate(overrideDir string, locale string, name string, layout string, funcs map[string]any) (emailTemplate, error) {
+	text, err := readEmailTemplate(overrideDir, locale, name+".txt")
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	html, err := readEmailTemplate(overrideDir, locale, name+".html")
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	template := emailTemplate{}
+
+	template.text, err = texttemplate.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	template.html, err = htmltemplate.New("layout").Funcs(funcs).Parse(layout)
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	template.html, err = template.html.Parse(html)
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	for _, block := range []string{"subject", "text"} {
+		if template.text.Lookup(block) == nil {
+			return emailTemplate{}, fmt.Errorf("%s.txt doesn't define %q", name, block)
+		}
+	}
+
+	if template.html.Lookup("content") == nil {
+		return emailTemplate{}, fmt.Errorf("%s.html doesn't define \"content\"", name)
+	}
+
+	return template, nil
+}
+
+func readEmailTemplate(overrideDir string, locale string, file string) (string, error) {
+	if overrideDir != "" {
+		content, err := os.ReadFile(filepath.Join(overrideDir, locale, file))
+		if err == nil {
+			return string(content), nil
+		}
+
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+	}
+
+	content, err := os.ReadFile(filepath.Join(EMAIL_TEMPLATES_PATH, locale, file))
+	return string(content), err
+}
+
+// Render builds the named email to email in locale, or in DEFAULT_LOCALE if that
+// isn't one there are templates for.
+func (t *EmailTemplates) Render(name string, locale string, email string, data any) (SendEmailRequest, error) {
+	templates, found := t.templates[locale]
+	if !found {
+		templates = t.templates[DEFAULT_LOCALE]
+	}
+
+	template, found := templates[name]
+	if !found {
+		return SendEmailRequest{}, fmt.Errorf("no email template %s", name)
+	}
+
+	subject := &bytes.Buffer{}
+	err := template.text.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return SendEmailRequest{}, fmt.Errorf("error rendering %s subject: %s", name, err)
+	}
+
+	text := &bytes.Buffer{}
+	err = template.text.ExecuteTemplate(text, "text", data)
+	if err != nil {
+		return SendEmailRequest{}, fmt.Errorf("error rendering %s text: %s", name, err)
+	}
+
+	html := &bytes.Buffer{}
+	err = template.html.ExecuteTemplate(html, "layout", data)
+	if err != nil {
+		return SendEmailRequest{}, fmt.Errorf("error rendering %s html: %s", name, err)
+	}
+
+	return SendEmailRequest{
+		Email:       email,
+		Subject:     strings.Join(strings.Fields(subject.String()), " "),
+		Content:     strings.TrimSpace(text.String()) + "\n",
+		HtmlContent: html.String(),
+	}, nil
+}
+
+func isSupportedLocale(locale string) bool {
+	for _, supported := range supportedLocales {
+		if locale == supported {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchLocale picks the first supported language in an Accept-Language header,
+// ignoring regions and weights, or DEFAULT_LOCALE if there isn't one.
+func matchLocale(acceptLanguage string) string {
+	for _, tag := range strings.Split(acceptLanguage, ",") {
+		language, _, _ := strings.Cut(strings.TrimSpace(tag), ";")
+		language, _, _ = strings.Cut(language, "-")
+		language = strings.ToLower(language)
+
+		if isSupportedLocale(language) {
+			return language
+		}
+	}
+
+	return DEFAULT_LOCALE
+}
+
+var durationUnits = map[string][3][2]string{
+	"en": {{"day", "days"}, {"hour", "hours"}, {"minute", "minutes"}},
+	"es": {{"día", "días"}, {"hora", "horas"}, {"minuto", "minutos"}},
+}
+
+// describeDuration writes a TTL like 24h as "1 day" rather than Go's "24h0m0s".
+func describeDuration(d time.Duration, locale string) string {
+	units, found := durationUnits[locale]
+	if !found {
+		units = durationUnits[DEFAULT_LOCALE]
+	}
+
+	var count int64
+	var unit [2]string
+	switch {
+	case d >= 24*time.Hour && d%(24*time.Hour) == 0:
+		count, unit = int64(d/(24*time.Hour)), units[0]
+	case d >= time.Hour && d%time.Hour == 0:
+		count, unit = int64(d/time.Hour), units[1]
+	default:
+		count, unit = int64(d.Round(time.Minute)/time.Minute), units[2]
+	}
+
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, unit[0])
+	}
+
+	return fmt.Sprintf("%d %s", count, unit[1])
+}
+
+// localeForEmail is the locale of the user with the email, or fallback when nobody
+// has it.
+func (r *Controller) localeForEmail(ctx context.Context, email string, fallback string) string {
+	result, err := r.Database.GetUser(ctx, email)
+	if err != nil {
+		log.Printf("error fetching user for email %s: %s", email, err)
+		return fallback
+	}
+
+	if !result.Found {
+		return fallback
+	}
+
+	return result.User.Locale
+}
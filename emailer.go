@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email backends. SendGrid and SMTP send emails, while file writes them to
+// EMAIL_DIRECTORY as .eml files for development.
+const EMAIL_BACKEND_SENDGRID = "sendgrid"
+const EMAIL_BACKEND_SMTP = "smtp"
+const EMAIL_BACKEND_FILE = "file"
+
+func newEmailer(config *Config) Emailer {
+	switch config.EmailBackend {
+	case EMAIL_BACKEND_SMTP:
+		return newSmtpEmailer(config)
+	case EMAIL_BACKEND_FILE:
+		return newFileEmailer(config.EmailDirectory, config.EmailsFrom)
+	default:
+		return newSendGridClient(config.SendgridApiKey, config.EmailsFrom)
+	}
+}
+
+// buildEmailMessage renders the email as an RFC 5322 message, the way it's sent over
+// SMTP and written to .eml files.
+func buildEmailMessage(from string, request SendEmailRequest, now time.Time) ([]byte, error) {
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %s: %s", from, err)
+	}
+
+	recipient, err := mail.ParseAddress(request.Email)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient address %s: %s", request.Email, err)
+	}
+
+	domain := sender.Address[strings.LastIndex(sender.Address, "@")+1:]
+
+	message := &bytes.Buffer{}
+	headers := [][2]string{
+		{"From", sender.String()},
+		{"To", recipient.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", request.Subject)},
+		{"Date", now.Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", uuid.NewString(), domain)},
+		{"MIME-Version", "1.0"},
+	}
+
+	for _, header := range headers {
+		fmt.Fprintf(message, "%s: %s\r\n", header[0], header[1])
+	}
+
+	if request.HtmlContent == "" {
+		message.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+		err = writeQuotedPrintable(message, request.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		return message.Bytes(), nil
+	}
+
+	// the last part is the one clients prefer, so the text goes first
+	parts := multipart.NewWriter(message)
+	fmt.Fprintf(message, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", parts.Boundary())
+
+	for _, part := range [][2]string{{"text/plain", request.Content}, {"text/html", request.HtmlContent}} {
+		writer, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part[0] + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating %s part: %s", part[0], err)
+		}
+
+		err = writeQuotedPrintable(writer, part[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = parts.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error closing email parts: %s", err)
+	}
+
+	return message.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, content string) error {
+	body := quotedprintable.NewWriter(w)
+
+	_, err := body.Write([]byte(content))
+	if err != nil {
+		return fmt.Errorf("error encoding email body: %s", err)
+	}
+
+	err = body.Close()
+	if err != nil {
+		return fmt.Errorf("error encoding email body: %s", err)
+	}
+
+	return nil
+}
+
+// FileEmailer writes each email to a .eml file rather than sending it, so the app
+// can be run without an email account. The files open in any mail client.
+type FileEmailer struct {
+	directory string
+	from      string
+}
+
+func newFileEmailer(directory string, from string) *FileEmailer {
+	err := os.MkdirAll(directory, 0o700)
+	if err != nil {
+		log.Panicf("error creating email directory %s: %s", directory, err)
+	}
+
+	log.Printf("writing emails to %s rather than sending them", directory)
+
+	return &FileEmailer{directory: directory, from: from}
+}
+
+func (f *FileEmailer) IsConfigured() bool {
+	return f.directory != "" && f.from != ""
+}
+
+func (f *FileEmailer) SendEmail(request SendEmailRequest) error {
+	now := time.Now().UTC()
+
+	message, err := buildEmailMessage(f.from, request, now)
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102T150405.000Z"), uuid.NewString()[:8])
+	path := filepath.Join(f.directory, name)
+
+	err = os.WriteFile(path, message, 0o600)
+	if err != nil {
+		return fmt.Errorf("error writing email to %s: %s", path, err)
+	}
+
+	log.Printf("wrote email to %s to %s", request.Email, path)
+
+	return nil
+}
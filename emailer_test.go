@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The text has a line over 76 characters, non-ASCII and an "=", which all need
+// encoding as quoted-printable.
+var testEmailRequest = SendEmailRequest{
+	Email:       "Ana Núñez <ana@example.com>",
+	Subject:     "Alguien hizo clic en tu enlace — ¡mira!",
+	Content:     "Hola Ana,\n\nAlguien hizo clic en https://example.com/l/abc?utm_source=email&utm_medium=alert&utm_campaign=otoño desde Bogotá.\n",
+	HtmlContent: "<p>Hola Ana,</p>\n<p>Alguien hizo clic en <a href=\"https://example.com/l/abc?x=1\">tu enlace</a> desde Bogotá.</p>\n",
+}
+
+func readTestEmail(t *testing.T, request SendEmailRequest, now time.Time) *mail.Message {
+	raw, err := buildEmailMessage("Links <links@example.com>", request, now)
+	if err != nil {
+		t.Fatalf("error building message: %s", err)
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+
+	return message
+}
+
+// decodeQuotedPrintable checks no encoded line is too long before decoding the body.
+func decodeQuotedPrintable(t *testing.T, body io.Reader) string {
+	encoded, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("error reading body: %s", err)
+	}
+
+	lines := bufio.NewScanner(strings.NewReader(string(encoded)))
+	for lines.Scan() {
+		if len(lines.Text()) > 76 {
+			t.Errorf("encoded line is %d characters: %s", len(lines.Text()), lines.Text())
+		}
+	}
+
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(string(encoded))))
+	if err != nil {
+		t.Fatalf("error decoding quoted-printable: %s", err)
+	}
+
+	return strings.ReplaceAll(string(decoded), "\r\n", "\n")
+}
+
+func TestBuildEmailMessageHeaders(t *testing.T) {
+	now := time.Date(2024, 3, 5, 14, 30, 0, 0, time.UTC)
+	message := readTestEmail(t, testEmailRequest, now)
+
+	from, err := message.Header.AddressList("From")
+	if err != nil || len(from) != 1 || from[0].Name != "Links" || from[0].Address != "links@example.com" {
+		t.Errorf("From = %v, %v", from, err)
+	}
+
+	to, err := message.Header.AddressList("To")
+	if err != nil || len(to) != 1 || to[0].Name != "Ana Núñez" || to[0].Address != "ana@example.com" {
+		t.Errorf("To = %v, %v", to, err)
+	}
+
+	subject, err := (&mime.WordDecoder{}).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil || subject != testEmailRequest.Subject {
+		t.Errorf("Subject = %q, %v", subject, err)
+	}
+
+	date, err := message.Header.Date()
+	if err != nil || !date.Equal(now) {
+		t.Errorf("Date = %s, %v", date, err)
+	}
+
+	messageId := message.Header.Get("Message-ID")
+	if !strings.HasPrefix(messageId, "<") || !strings.HasSuffix(messageId, "@example.com>") {
+		t.Errorf("Message-ID = %s", messageId)
+	}
+
+	if version := message.Header.Get("MIME-Version"); version != "1.0" {
+		t.Errorf("MIME-Version = %s", version)
+	}
+}
+
+func TestBuildEmailMessageMultipart(t *testing.T) {
+	message := readTestEmail(t, testEmailRequest, time.Now())
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type = %s, %v", mediaType, err)
+	}
+
+	parts := multipart.NewReader(message.Body, params["boundary"])
+
+	// the text goes first, as clients show the last part they understand
+	want := []struct {
+		mediaType string
+		content   string
+	}{
+		{"text/plain", testEmailRequest.Content},
+		{"text/html", testEmailRequest.HtmlContent},
+	}
+
+	for _, expected := range want {
+		// NextRawPart leaves the quoted-printable for us to check
+		part, err := parts.NextRawPart()
+		if err != nil {
+			t.Fatalf("error reading %s part: %s", expected.mediaType, err)
+		}
+
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil || mediaType != expected.mediaType || params["charset"] != "utf-8" {
+			t.Errorf("part Content-Type = %s, %v, %v, want %s in utf-8", mediaType, params, err, expected.mediaType)
+		}
+
+		if encoding := part.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+			t.Errorf("%s Content-Transfer-Encoding = %s", expected.mediaType, encoding)
+		}
+
+		content := decodeQuotedPrintable(t, part)
+		if content != expected.content {
+			t.Errorf("%s content = %q, want %q", expected.mediaType, content, expected.content)
+		}
+	}
+
+	_, err = parts.NextPart()
+	if err != io.EOF {
+		t.Errorf("more parts after the html, err = %v", err)
+	}
+}
+
+func TestBuildEmailMessagePlainText(t *testing.T) {
+	request := testEmailRequest
+	request.HtmlContent = ""
+
+	message := readTestEmail(t, request, time.Now())
+
+	mediaType, params, err := mime.ParseMediaType(message.Header.Get("Content-Type"))
+	if err != nil || mediaType != "text/plain" || params["charset"] != "utf-8" {
+		t.Errorf("Content-Type = %s, %v, %v, want text/plain in utf-8", mediaType, params, err)
+	}
+
+	if encoding := message.Header.Get("Content-Transfer-Encoding"); encoding != "quoted-printable" {
+		t.Errorf("Content-Transfer-Encoding = %s", encoding)
+	}
+
+	content := decodeQuotedPrintable(t, message.Body)
+	if content != request.Content {
+		t.Errorf("content = %q, want %q", content, request.Content)
+	}
+}
+
+func TestBuildEmailMessageRejectsInvalidAddresses(t *testing.T) {
+	_, err := buildEmailMessage("not an address", testEmailRequest, time.Now())
+	if err == nil {
+		t.Error("built with an invalid from address")
+	}
+
+	request := testEmailRequest
+	request.Email = "ana@"
+
+	_, err = buildEmailMessage("Links <links@example.com>", request, time.Now())
+	if err == nil {
+		t.Error("built with an invalid recipient")
+	}
+}
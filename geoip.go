@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+func newGeoResolver(path string) GeoResolver {
+	if path == "" {
+		log.Println("GEOIP_DATABASE_PATH not set, clicks won't be geolocated")
+		return &NoopGeoResolver{}
+	}
+
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		log.Panicf("error opening GeoIP database %s: %s", path, err)
+	}
+
+	built := time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()
+	log.Printf("loaded %s GeoIP database %s built at %s", reader.Metadata.DatabaseType, path, built.Format(time.DateOnly))
+
+	return &MmdbGeoResolver{reader: reader}
+}
+
+type GeoLocation struct {
+	CountryCode string
+	Region      string
+	City        string
+}
+
+// MmdbGeoResolver looks IPs up in a local MaxMind-format database (GeoLite2/GeoIP2
+// City or Country), so resolving a click never leaves the process.
+type MmdbGeoResolver struct {
+	reader *maxminddb.Reader
+}
+
+type mmdbCityRecord struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+}
+
+func (m *MmdbGeoResolver) Resolve(ip string) (GeoLocation, error) {
+	location := GeoLocation{}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return location, fmt.Errorf("invalid ip address %s", ip)
+	}
+
+	record := mmdbCityRecord{}
+	err := m.reader.Lookup(parsed, &record)
+	if err != nil {
+		return location, fmt.Errorf("error looking up ip address %s: %s", ip, err)
+	}
+
+	location.CountryCode = record.Country.IsoCode
+	location.City = record.City.Names["en"]
+	if len(record.Subdivisions) > 0 {
+		location.Region = record.Subdivisions[0].Names["en"]
+	}
+
+	return location, nil
+}
+
+func (m *MmdbGeoResolver) Close() error {
+	return m.reader.Close()
+}
+
+type NoopGeoResolver struct{}
+
+func (n *NoopGeoResolver) Resolve(ip string) (GeoLocation, error) {
+	return GeoLocation{}, nil
+}
+
+func (n *NoopGeoResolver) Close() error {
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// The test database is written by hand rather than shipped as a binary, so what's in
+// it can be read here. It's a MaxMind DB with an IPv4 search tree of 24 bit records,
+// laid out as https://maxmind.github.io/MaxMind-DB/ describes.
+var geoipTestNetworks = []struct {
+	network string
+	record  map[string]any
+}{
+	{"81.0.0.0/8", map[string]any{
+		"country": map[string]any{"iso_code": "ES"},
+		"subdivisions": []any{
+			map[string]any{"names": map[string]any{"en": "Andalusia", "es": "Andalucía"}},
+			map[string]any{"names": map[string]any{"en": "Seville Province", "es": "Sevilla"}},
+		},
+		"city": map[string]any{"names": map[string]any{"en": "Seville", "es": "Sevilla"}},
+	}},
+	{"8.8.0.0/16", map[string]any{
+		"country": map[string]any{"iso_code": "US"},
+		"subdivisions": []any{
+			map[string]any{"names": map[string]any{"en": "California"}},
+		},
+		"city": map[string]any{"names": map[string]any{"en": "Mountain View"}},
+	}},
+	// a Country database has no subdivisions or city
+	{"1.0.0.0/8", map[string]any{
+		"country": map[string]any{"iso_code": "AU"},
+	}},
+	// nor does a city without an English name
+	{"2.0.0.0/8", map[string]any{
+		"country": map[string]any{"iso_code": "FR"},
+		"city":    map[string]any{"names": map[string]any{"fr": "Quelque Part"}},
+	}},
+}
+
+type mmdbTestNode struct {
+	children [2]*mmdbTestNode
+	records  [2]int
+}
+
+// writeTestMmdb builds the database from geoipTestNetworks, returning its path.
+func writeTestMmdb(t *testing.T) string {
+	data := &bytes.Buffer{}
+	root := &mmdbTestNode{records: [2]int{-1, -1}}
+
+	for _, network := range geoipTestNetworks {
+		_, ipNet, err := net.ParseCIDR(network.network)
+		if err != nil {
+			t.Fatalf("error parsing %s: %s", network.network, err)
+		}
+
+		offset := data.Len()
+		writeMmdbValue(data, network.record)
+
+		ip := ipNet.IP.To4()
+		length, _ := ipNet.Mask.Size()
+
+		node := root
+		for i := 0; i < length; i++ {
+			bit := int(ip[i/8]>>(7-i%8)) & 1
+
+			if i == length-1 {
+				node.records[bit] = offset
+				break
+			}
+
+			if node.children[bit] == nil {
+				node.children[bit] = &mmdbTestNode{records: [2]int{-1, -1}}
+			}
+
+			node = node.children[bit]
+		}
+	}
+
+	// number the nodes breadth first, so the root is 0
+	nodes := []*mmdbTestNode{root}
+	numbers := map[*mmdbTestNode]int{root: 0}
+	for i := 0; i < len(nodes); i++ {
+		for _, child := range nodes[i].children {
+			if child != nil {
+				numbers[child] = len(nodes)
+				nodes = append(nodes, child)
+			}
+		}
+	}
+
+	nodeCount := len(nodes)
+
+	file := &bytes.Buffer{}
+	for _, node := range nodes {
+		for bit := 0; bit < 2; bit++ {
+			record := nodeCount // no data
+			if node.children[bit] != nil {
+				record = numbers[node.children[bit]]
+			} else if node.records[bit] >= 0 {
+				record = nodeCount + 16 + node.records[bit]
+			}
+
+			file.Write([]byte{byte(record >> 16), byte(record >> 8), byte(record)})
+		}
+	}
+
+	file.Write(make([]byte, 16))
+	file.Write(data.Bytes())
+	file.WriteString("\xAB\xCD\xEFMaxMind.com")
+	writeMmdbValue(file, map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1700000000),
+		"database_type":               "Test-City",
+		"description":                 map[string]any{"en": "Test database"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(24),
+	})
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	err := os.WriteFile(path, file.Bytes(), 0o600)
+	if err != nil {
+		t.Fatalf("error writing test database: %s", err)
+	}
+
+	return path
+}
+
+// writeMmdbValue encodes the few types the test database needs, all small enough for
+// their size to fit in the control byte.
+func writeMmdbValue(buffer *bytes.Buffer, value any) {
+	control := func(kind int, size int) {
+		if kind <= 7 {
+			buffer.WriteByte(byte(kind<<5 | size))
+		} else {
+			buffer.Write([]byte{byte(size), byte(kind - 7)})
+		}
+	}
+
+	unsigned := func(kind int, n uint64) {
+		encoded := binary.BigEndian.AppendUint64(nil, n)
+		encoded = bytes.TrimLeft(encoded, "\x00")
+		control(kind, len(encoded))
+		buffer.Write(encoded)
+	}
+
+	switch value := value.(type) {
+	case string:
+		control(2, len(value))
+		buffer.WriteString(value)
+	case uint16:
+		unsigned(5, uint64(value))
+	case uint32:
+		unsigned(6, uint64(value))
+	case uint64:
+		unsigned(9, value)
+	case map[string]any:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		control(7, len(keys))
+		for _, key := range keys {
+			writeMmdbValue(buffer, key)
+			writeMmdbValue(buffer, value[key])
+		}
+	case []any:
+		control(11, len(value))
+		for _, item := range value {
+			writeMmdbValue(buffer, item)
+		}
+	default:
+		panic("unsupported mmdb value")
+	}
+}
+
+func TestMmdbGeoResolverResolve(t *testing.T) {
+	resolver, ok := newGeoResolver(writeTestMmdb(t)).(*MmdbGeoResolver)
+	if !ok {
+		t.Fatal("newGeoResolver didn't open the database")
+	}
+	defer resolver.Close()
+
+	err := resolver.reader.Verify()
+	if err != nil {
+		t.Fatalf("test database is invalid: %s", err)
+	}
+
+	tests := []struct {
+		ip       string
+		location GeoLocation
+	}{
+		{"81.45.1.2", GeoLocation{CountryCode: "ES", Region: "Andalusia", City: "Seville"}},
+		{"8.8.8.8", GeoLocation{CountryCode: "US", Region: "California", City: "Mountain View"}},
+		{"1.1.1.1", GeoLocation{CountryCode: "AU"}},
+		{"2.3.4.5", GeoLocation{CountryCode: "FR"}},
+		{"8.9.0.1", GeoLocation{}},
+		{"10.0.0.1", GeoLocation{}},
+	}
+
+	for _, test := range tests {
+		location, err := resolver.Resolve(test.ip)
+		if err != nil {
+			t.Errorf("error resolving %s: %s", test.ip, err)
+			continue
+		}
+
+		if location != test.location {
+			t.Errorf("%s resolved to %+v, want %+v", test.ip, location, test.location)
+		}
+	}
+}
+
+func TestMmdbGeoResolverRejectsInvalidIps(t *testing.T) {
+	resolver := newGeoResolver(writeTestMmdb(t))
+	defer resolver.Close()
+
+	for _, ip := range []string{"", "not an ip", "81.0.0.256", "2001:db8::1"} {
+		_, err := resolver.Resolve(ip)
+		if err == nil {
+			t.Errorf("resolved %q", ip)
+		}
+	}
+}
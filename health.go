@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const READINESS_CHECK_TIMEOUT = 2 * time.Second
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Healthz only tells that the process is up and serving requests.
+func (r *Controller) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz tells whether this instance should receive traffic: the database is
+// reachable and migrated, email can be sent and we're not shutting down.
+func (r *Controller) Readyz(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c, READINESS_CHECK_TIMEOUT)
+	defer cancel()
+
+	checks := map[string]error{
+		"database":   r.Database.Ping(ctx),
+		"migrations": r.checkMigrations(ctx),
+		"email":      r.checkEmailer(),
+		"shutdown":   r.checkNotShuttingDown(),
+	}
+
+	response := ReadinessResponse{Status: "ok", Checks: map[string]string{}}
+	status := http.StatusOK
+
+	for name, err := range checks {
+		if err != nil {
+			log.Printf("readiness check %s failed: %s", name, err)
+			response.Checks[name] = err.Error()
+			response.Status = "unavailable"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+
+		response.Checks[name] = "ok"
+	}
+
+	c.JSON(status, response)
+}
+
+func (r *Controller) checkMigrations(ctx context.Context) error {
+	version, dirty, err := r.Database.GetMigrationVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dirty {
+		return fmt.Errorf("migration version %d is dirty", version)
+	}
+
+	if version < r.MigrationVersion {
+		return fmt.Errorf("database at migration version %d, expected %d", version, r.MigrationVersion)
+	}
+
+	return nil
+}
+
+func (r *Controller) checkEmailer() error {
+	if !r.Emailer.IsConfigured() {
+		return fmt.Errorf("email backend not configured")
+	}
+
+	return nil
+}
+
+func (r *Controller) checkNotShuttingDown() error {
+	if r.ShuttingDown.Load() {
+		return fmt.Errorf("shutting down")
+	}
+
+	return nil
+}
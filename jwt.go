@@ -2,58 +2,207 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// MFA_PENDING_PURPOSE marks the token handed out after the password step of a
+// login with 2FA on. It can only be exchanged for real tokens, never used as one.
+const MFA_PENDING_PURPOSE = "mfa_pending"
+
 type Claims struct {
-	User User `json:"user"`
+	SessionId string `json:"sid,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
-type User struct {
-	Id string `json:"string"`
-}
+// newJwtClient signs with the PEM key in JWT_SIGNING_KEY_FILE when there is one,
+// otherwise with the JWT_SECRET using HS256. Tokens signed by any of the keys in
+// JWT_VERIFICATION_KEY_FILES are still accepted, which is how keys get rotated:
+// move the old key's public half there, then start signing with the new one.
+func newJwtClient(config *Config) *JwtClient {
+	client := &JwtClient{
+		VerificationKeys: map[string]JwtKey{},
+		Issuer:           config.JwtIssuer,
+		Audience:         config.JwtAudience,
+		Ttl:              config.AccessTokenTtl,
+		MfaTtl:           config.MfaTokenTtl,
+	}
+
+	if config.JwtSecret != "" {
+		client.addVerificationKey(JwtKey{Id: HS256_KEY_ID, Method: jwt.SigningMethodHS256, Key: []byte(config.JwtSecret)})
+	}
+
+	if config.JwtSigningKeyFile != "" {
+		signingKey, err := loadPrivateJwtKey(config.JwtSigningKeyFile)
+		if err != nil {
+			log.Panicf("error loading JWT signing key: %s", err)
+		}
+
+		client.SigningKey = signingKey
+		client.addVerificationKey(signingKey.Public())
+	} else {
+		client.SigningKey = client.VerificationKeys[HS256_KEY_ID]
+	}
+
+	for _, path := range config.JwtVerificationKeyFiles {
+		verificationKey, err := loadPublicJwtKey(path)
+		if err != nil {
+			log.Panicf("error loading JWT verification key: %s", err)
+		}
+
+		client.addVerificationKey(verificationKey)
+	}
 
-func newJwtClient() *JwtClient {
-	return &JwtClient{Secret: getEnv("JWT_SECRET")}
+	log.Printf("signing JWTs with %s key id %s", client.SigningKey.Method.Alg(), client.SigningKey.Id)
+
+	return client
 }
 
 type JwtClient struct {
-	Secret string
+	SigningKey       JwtKey
+	VerificationKeys map[string]JwtKey
+	Issuer           string
+	Audience         string
+	Ttl              time.Duration
+	MfaTtl           time.Duration
+}
+
+func (j *JwtClient) addVerificationKey(key JwtKey) {
+	j.VerificationKeys[key.Id] = key
 }
 
-func (j *JwtClient) GenerateToken(userId string) (string, error) {
+func (j *JwtClient) GenerateToken(userId string, sessionId string) (string, error) {
+	claims := j.newClaims(userId, j.Ttl)
+	claims.SessionId = sessionId
+	return j.sign(claims)
+}
+
+func (j *JwtClient) GenerateMfaToken(userId string) (string, error) {
+	claims := j.newClaims(userId, j.MfaTtl)
+	claims.Purpose = MFA_PENDING_PURPOSE
+	return j.sign(claims)
+}
+
+func (j *JwtClient) newClaims(userId string, ttl time.Duration) Claims {
 	claims := Claims{}
-	claims.User.Id = userId
-	claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(24 * time.Hour))
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return t.SignedString([]byte(j.Secret))
+	claims.Subject = userId
+	claims.Issuer = j.Issuer
+	claims.Audience = jwt.ClaimStrings{j.Audience}
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	return claims
 }
 
-func (j *JwtClient) GetUserId(token string) (string, error) {
-	parsed, err := jwt.ParseWithClaims(token, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(j.Secret), nil
-	})
+func (j *JwtClient) sign(claims Claims) (string, error) {
+	t := jwt.NewWithClaims(j.SigningKey.Method, claims)
+	t.Header["kid"] = j.SigningKey.Id
+	return t.SignedString(j.SigningKey.Key)
+}
 
+func (j *JwtClient) ParseToken(token string) (TokenClaims, error) {
+	claims, err := j.parseClaims(token)
 	if err != nil {
-		return "", fmt.Errorf("error parsing token %s: %s", token, err)
+		return TokenClaims{}, err
+	}
+
+	if claims.Purpose != "" {
+		return TokenClaims{}, fmt.Errorf("token %s is a %s token, not an access token", token, claims.Purpose)
+	}
+
+	if lengthOfString(claims.SessionId) == 0 {
+		return TokenClaims{}, fmt.Errorf("no session id claim for token %s", token)
+	}
+
+	result := TokenClaims{UserId: claims.Subject, SessionId: claims.SessionId}
+	if claims.IssuedAt != nil {
+		result.IssuedAt = &claims.IssuedAt.Time
+	}
+
+	return result, nil
+}
+
+// ParseMfaToken returns the id of the user who got past the password step.
+func (j *JwtClient) ParseMfaToken(token string) (string, error) {
+	claims, err := j.parseClaims(token)
+	if err != nil {
+		return "", err
+	}
+
+	if claims.Purpose != MFA_PENDING_PURPOSE {
+		return "", fmt.Errorf("token %s is not an mfa pending token", token)
+	}
+
+	return claims.Subject, nil
+}
+
+func (j *JwtClient) parseClaims(token string) (*Claims, error) {
+	parsed, err := jwt.ParseWithClaims(token, &Claims{}, j.getVerificationKey,
+		jwt.WithIssuer(j.Issuer),
+		jwt.WithAudience(j.Audience),
+		jwt.WithValidMethods(j.validMethods()),
+	)
+
+	if err != nil {
+		return nil, fmt.Errorf("error parsing token %s: %s", token, err)
 	}
 
 	if !parsed.Valid {
-		return "", fmt.Errorf("invalid token %s", token)
+		return nil, fmt.Errorf("invalid token %s", token)
 	}
 
 	claims, ok := parsed.Claims.(*Claims)
 	if !ok {
-		return "", fmt.Errorf("invalid claims for token %s", token)
+		return nil, fmt.Errorf("invalid claims for token %s", token)
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("no exp claim for token %s", token)
 	}
 
-	userId := claims.User.Id
-	if lengthOfString(userId) == 0 {
-		return "", fmt.Errorf("no User.Id claim for token %s", token)
+	if lengthOfString(claims.Subject) == 0 {
+		return nil, fmt.Errorf("no sub claim for token %s", token)
 	}
 
-	return userId, err
+	return claims, nil
+}
+
+// getVerificationKey picks the key by the token's kid, and makes sure the token
+// uses that key's algorithm so e.g. a public key can't be passed off as an HMAC secret.
+func (j *JwtClient) getVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, found := j.VerificationKeys[kid]
+	if !found {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("key id %s is for %s, token uses %s", kid, key.Method.Alg(), token.Method.Alg())
+	}
+
+	return key.Key, nil
+}
+
+func (j *JwtClient) validMethods() []string {
+	methods := []string{}
+	for _, key := range j.VerificationKeys {
+		methods = append(methods, key.Method.Alg())
+	}
+	return methods
+}
+
+// Jwks is the public half of every asymmetric verification key, for other services
+// to verify our tokens with.
+func (j *JwtClient) Jwks() JwkSet {
+	set := JwkSet{Keys: []Jwk{}}
+	for _, key := range j.VerificationKeys {
+		if jwk, ok := key.Jwk(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
 }
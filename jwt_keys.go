@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// HS256 secrets can't be published in the JWKS, so they get a fixed key id.
+const HS256_KEY_ID = "hs256"
+
+// JwtKey is a signing or verification key along with its kid and algorithm. Key
+// is a []byte secret for HS256, or an RSA / Ed25519 private or public key.
+type JwtKey struct {
+	Id     string
+	Method jwt.SigningMethod
+	Key    interface{}
+}
+
+type JwkSet struct {
+	Keys []Jwk `json:"keys"`
+}
+
+type Jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+func loadPrivateJwtKey(path string) (JwtKey, error) {
+	block, err := readPemFile(path)
+	if err != nil {
+		return JwtKey{}, err
+	}
+
+	var parsed interface{}
+	if block.Type == "RSA PRIVATE KEY" {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+
+	if err != nil {
+		return JwtKey{}, fmt.Errorf("error parsing private key %s: %s", path, err)
+	}
+
+	return newJwtKey(parsed, path)
+}
+
+func loadPublicJwtKey(path string) (JwtKey, error) {
+	block, err := readPemFile(path)
+	if err != nil {
+		return JwtKey{}, err
+	}
+
+	var parsed interface{}
+	if block.Type == "RSA PUBLIC KEY" {
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	} else {
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return JwtKey{}, fmt.Errorf("error parsing public key %s: %s", path, err)
+	}
+
+	return newJwtKey(parsed, path)
+}
+
+func readPemFile(path string) (*pem.Block, error) {
+	file, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading key file %s: %s", path, err)
+	}
+
+	block, _ := pem.Decode(file)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in key file %s", path)
+	}
+
+	return block, nil
+}
+
+func newJwtKey(parsed interface{}, path string) (JwtKey, error) {
+	key := JwtKey{Key: parsed}
+
+	switch parsed.(type) {
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	default:
+		return JwtKey{}, fmt.Errorf("unsupported key type %T in %s, only RSA and Ed25519 keys are supported", parsed, path)
+	}
+
+	jwk, _ := key.Public().Jwk()
+	key.Id = jwkThumbprint(jwk)
+
+	return key, nil
+}
+
+// Public is the key without its private half, or the key itself for HS256.
+func (k JwtKey) Public() JwtKey {
+	public := k
+
+	if signer, ok := k.Key.(crypto.Signer); ok {
+		public.Key = signer.Public()
+	}
+
+	return public
+}
+
+func (k JwtKey) Jwk() (Jwk, bool) {
+	jwk := Jwk{Kid: k.Id, Use: "sig", Alg: k.Method.Alg()}
+
+	switch key := k.Public().Key.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(key.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(key)
+	default:
+		return Jwk{}, false
+	}
+
+	return jwk, true
+}
+
+// jwkThumbprint is the RFC 7638 thumbprint of the key, which is used as its kid so
+// that the same key always gets the same id without having to configure one.
+func jwkThumbprint(jwk Jwk) string {
+	var members interface{}
+
+	if jwk.Kty == "RSA" {
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	encoded, _ := json.Marshal(members)
+	hash := sha256.Sum256(encoded)
+
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
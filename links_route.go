@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const DEFAULT_LINKS_PAGE_SIZE = 50
+const MAX_LINKS_PAGE_SIZE = 100
+
+type GetLinksQuery struct {
+	Tag           *string   `form:"tag"`
+	CreatedAfter  time.Time `form:"created_after" time_format:"2006-01-02T15:04:05Z07:00"`
+	CreatedBefore time.Time `form:"created_before" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit         int       `form:"limit"`
+	Offset        int       `form:"offset"`
+}
+
+type UpdateLinkApiRequest struct {
+	Url *string `json:"url"`
+	Tag *string `json:"tag"`
+}
+
+type LinkResponse struct {
+	Id         string    `json:"id"`
+	Url        string    `json:"url"`
+	TrackedUrl string    `json:"tracked_url"`
+	Tag        string    `json:"tag"`
+	CreatedBy  string    `json:"created_by"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type GetLinksResponse struct {
+	Links  []LinkResponse `json:"links"`
+	Total  int            `json:"total"`
+	Limit  int            `json:"limit"`
+	Offset int            `json:"offset"`
+}
+
+func (r *Controller) GetLinks(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	query := GetLinksQuery{}
+	err = c.ShouldBindQuery(&query)
+	if err != nil {
+		log.Println("error parsing get links query: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if query.Limit <= 0 {
+		query.Limit = DEFAULT_LINKS_PAGE_SIZE
+	}
+
+	if query.Limit > MAX_LINKS_PAGE_SIZE || query.Offset < 0 {
+		log.Printf("invalid pagination limit %d offset %d", query.Limit, query.Offset)
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("limit must be at most %d and offset can't be negative", MAX_LINKS_PAGE_SIZE))
+		return
+	}
+
+	request := GetLinksRequest{
+		WorkspaceId:   workspaceId,
+		Tag:           query.Tag,
+		CreatedAfter:  nilIfZeroTime(query.CreatedAfter),
+		CreatedBefore: nilIfZeroTime(query.CreatedBefore),
+		Limit:         query.Limit,
+		Offset:        query.Offset,
+	}
+
+	result, err := r.Database.GetLinks(c, request)
+	if err != nil {
+		log.Printf("error getting links for workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := GetLinksResponse{Links: []LinkResponse{}, Total: result.Total, Limit: query.Limit, Offset: query.Offset}
+	for _, link := range result.Links {
+		response.Links = append(response.Links, r.toLinkResponse(link))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) GetLink(c *gin.Context) {
+	workspaceId, linkId, ok := getWorkspaceIdAndLinkId(c)
+	if !ok {
+		return
+	}
+
+	result, err := r.Database.GetLink(c, workspaceId, linkId)
+	if err != nil {
+		log.Printf("error getting link id %s for workspace id %s: %s", linkId, workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	r.respondWithLink(c, result)
+}
+
+func (r *Controller) UpdateLink(c *gin.Context) {
+	workspaceId, linkId, ok := getWorkspaceIdAndLinkId(c)
+	if !ok {
+		return
+	}
+
+	apiRequest := UpdateLinkApiRequest{}
+	err := c.ShouldBindJSON(&apiRequest)
+	if err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if apiRequest.Url == nil && apiRequest.Tag == nil {
+		log.Printf("nothing to update for link id %s", linkId)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Nothing to update")
+		return
+	}
+
+	request := UpdateLinkRequest{WorkspaceId: workspaceId, LinkId: linkId, Tag: apiRequest.Tag}
+
+	if apiRequest.Url != nil {
+		if lengthOfString(*apiRequest.Url) == 0 {
+			log.Printf("empty url given for link id %s", linkId)
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid url")
+			return
+		}
+
+		url := addHttpsToUrlIfNotIncludedAlready(*apiRequest.Url)
+		request.Url = &url
+	}
+
+	result, err := r.Database.UpdateLink(c, request)
+	if err != nil {
+		log.Printf("error updating link id %s for workspace id %s: %s", linkId, workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if result.Found {
+		r.RedirectCache.Remove(result.Link.Path)
+	}
+
+	r.respondWithLink(c, result)
+}
+
+func (r *Controller) DeleteLink(c *gin.Context) {
+	workspaceId, linkId, ok := getWorkspaceIdAndLinkId(c)
+	if !ok {
+		return
+	}
+
+	result, err := r.Database.DeleteLink(c, workspaceId, linkId)
+	if err != nil {
+		log.Printf("error deleting link id %s for workspace id %s: %s", linkId, workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Found {
+		log.Printf("link id %s not found for workspace id %s", linkId, workspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	r.RedirectCache.Remove(result.Link.Path)
+
+	c.Status(http.StatusNoContent)
+}
+
+func getWorkspaceIdAndLinkId(c *gin.Context) (string, string, bool) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	linkId := c.Param("id")
+	if _, err := uuid.Parse(linkId); err != nil {
+		log.Printf("invalid link id %s: %s", linkId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return "", "", false
+	}
+
+	return workspaceId, linkId, true
+}
+
+func (r *Controller) respondWithLink(c *gin.Context, result ResultForGetLinkRequest) {
+	if !result.Found {
+		log.Printf("link id %s not found", c.Param("id"))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.JSON(http.StatusOK, r.toLinkResponse(result.Link))
+}
+
+func (r *Controller) toLinkResponse(link LinkRecord) LinkResponse {
+	return LinkResponse{
+		Id:         link.Id,
+		Url:        link.Url,
+		TrackedUrl: fmt.Sprintf("%s/%s", r.RedirectUri, link.Path),
+		Tag:        link.Tag,
+		CreatedBy:  link.CreatedBy,
+		CreatedAt:  link.CreatedAt,
+	}
+}
+
+func nilIfZeroTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+const DEFAULT_STATS_RANGE = 30 * 24 * time.Hour
+const MAX_STATS_BUCKETS = 2000
+
+var statsIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+}
+
+type GetLinkStatsQuery struct {
+	Interval string    `form:"interval"`
+	From     time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To       time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+type LinkStatsResponse struct {
+	LinkId        string                `json:"link_id"`
+	TotalClicks   int                   `json:"total_clicks"`
+	FirstClickAt  *time.Time            `json:"first_click_at"`
+	LastClickAt   *time.Time            `json:"last_click_at"`
+	Interval      string                `json:"interval"`
+	From          time.Time             `json:"from"`
+	To            time.Time             `json:"to"`
+	ClicksInRange int                   `json:"clicks_in_range"`
+	Buckets       []ClickBucketResponse `json:"buckets"`
+	Countries     []ClickBreakdownItem  `json:"countries"`
+	DeviceTypes   []ClickBreakdownItem  `json:"device_types"`
+	Browsers      []ClickBreakdownItem  `json:"browsers"`
+	OSes          []ClickBreakdownItem  `json:"operating_systems"`
+}
+
+type ClickBreakdownItem struct {
+	Value  string `json:"value"`
+	Clicks int    `json:"clicks"`
+}
+
+type ClickBucketResponse struct {
+	Start  time.Time `json:"start"`
+	Clicks int       `json:"clicks"`
+}
+
+func (r *Controller) GetLinkStats(c *gin.Context) {
+	workspaceId, linkId, ok := getWorkspaceIdAndLinkId(c)
+	if !ok {
+		return
+	}
+
+	query := GetLinkStatsQuery{}
+	err := c.ShouldBindQuery(&query)
+	if err != nil {
+		log.Println("error parsing link stats query: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if query.Interval == "" {
+		query.Interval = "day"
+	}
+
+	step, valid := statsIntervals[query.Interval]
+	if !valid {
+		log.Printf("invalid stats interval %s", query.Interval)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "interval must be one of hour, day or week")
+		return
+	}
+
+	to := query.To.UTC()
+	if query.To.IsZero() {
+		to = time.Now().UTC()
+	}
+
+	from := query.From.UTC()
+	if query.From.IsZero() {
+		from = to.Add(-DEFAULT_STATS_RANGE)
+	}
+
+	if !from.Before(to) {
+		log.Printf("invalid stats range from %s to %s", from, to)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	if to.Sub(from)/step > MAX_STATS_BUCKETS {
+		log.Printf("too many stats buckets for range from %s to %s by %s", from, to, query.Interval)
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("range can't span more than %d %ss", MAX_STATS_BUCKETS, query.Interval))
+		return
+	}
+
+	request := LinkStatsRequest{WorkspaceId: workspaceId, LinkId: linkId, Interval: query.Interval, From: from, To: to}
+
+	result, err := r.Database.GetLinkStats(c, request)
+	if err != nil {
+		log.Printf("error getting stats for link id %s: %s", linkId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Found {
+		log.Printf("link id %s not found for workspace id %s", linkId, workspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	response := LinkStatsResponse{
+		LinkId:       linkId,
+		TotalClicks:  result.Stats.TotalClicks,
+		FirstClickAt: result.Stats.FirstClickAt,
+		LastClickAt:  result.Stats.LastClickAt,
+		Interval:     query.Interval,
+		From:         from,
+		To:           to,
+		Buckets:      []ClickBucketResponse{},
+		Countries:    toClickBreakdownItems(result.Stats.Countries),
+		DeviceTypes:  toClickBreakdownItems(result.Stats.DeviceTypes),
+		Browsers:     toClickBreakdownItems(result.Stats.Browsers),
+		OSes:         toClickBreakdownItems(result.Stats.OSes),
+	}
+
+	for _, bucket := range result.Stats.Buckets {
+		response.ClicksInRange += bucket.Clicks
+		response.Buckets = append(response.Buckets, ClickBucketResponse{Start: bucket.Start, Clicks: bucket.Clicks})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func toClickBreakdownItems(breakdown []ClickBreakdown) []ClickBreakdownItem {
+	items := []ClickBreakdownItem{}
+	for _, item := range breakdown {
+		items = append(items, ClickBreakdownItem{Value: item.Value, Clicks: item.Clicks})
+	}
+	return items
+}
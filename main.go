@@ -2,9 +2,15 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -12,12 +18,30 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to an optional YAML config file")
+	printConfig := flag.Bool("print-config", false, "print the configuration with secrets redacted and exit")
+	flag.Parse()
+
 	if isRunningLocally() {
 		loadEnvironmentVariablesFromDotEnvFile()
 	}
 
-	runMigrations()
-	runApplication()
+	config, err := loadConfig(*configPath)
+
+	if *printConfig {
+		fmt.Print(config.Redacted())
+		if err != nil {
+			log.Fatalf("configuration problems:\n%s", err)
+		}
+		return
+	}
+
+	if err != nil {
+		log.Fatalf("configuration problems:\n%s", err)
+	}
+
+	migrationVersion := runMigrations(config.DatabaseUrl)
+	runApplication(config, migrationVersion)
 }
 
 func isRunningLocally() bool {
@@ -31,28 +55,31 @@ func loadEnvironmentVariablesFromDotEnvFile() {
 	}
 }
 
-func runApplication() {
+func runApplication(config *Config, migrationVersion uint) {
 	log.Println("Starting application...")
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	e := gin.Default()
 
+	trustProxies(e, config.TrustedProxies)
 	allowAllOriginsForCORS(e)
 
-	db := getPostgresDb()
-	defer db.Close()
+	startupCtx, cancelStartup := context.WithTimeout(ctx, config.DbConnectTimeout)
+	db := getPostgresDb(startupCtx, config)
+	cancelStartup()
 
-	c := Controller{
-		Database:               db,
-		TokenClient:            newJwtClient(),
-		Emailer:                newSendGridClient(),
-		RedirectPathLength:     getInt(getEnv("REDIRECT_PATH_LENGTH")),
-		MaxNumberOfEmailAlerts: getInt(getEnv("MAX_NUMBER_OF_EMAIL_ALERTS")),
-		EmailVerifiedUrl:       getEnv("EMAIL_VERIFIED_URL"),
-		ErrorRedirectUrl:       getEnv("ERROR_REDIRECT_URL"),
-		BotChecker:             newBotChecker(),
-	}
+	geoResolver := newGeoResolver(config.GeoipDatabasePath)
+
+	c := newController(config, db, geoResolver)
+	c.MigrationVersion = migrationVersion
 
-	baseUrl := getEnv("BASE_URL")
+	baseUrl := config.BaseUrl
+
+	e.GET("/healthz", c.Healthz)
+	e.GET("/readyz", c.Readyz)
+	e.GET("/.well-known/jwks.json", c.GetJwks)
 
 	redirect := e.Group("/r")
 	{
@@ -63,6 +90,8 @@ func runApplication() {
 	{
 		auth := v1.Group("/auth")
 		{
+			auth.Use(rateLimit(c.AuthRateLimiter, "auth"))
+
 			verify := auth.Group("/verifyemail")
 			{
 				verify.GET("/:code", c.VerifyEmail)
@@ -70,8 +99,30 @@ func runApplication() {
 
 			c.ConfirmationUri = baseUrl + verify.BasePath()
 			auth.POST("/register", c.RegisterUser)
+			auth.POST("/resendverification", c.ResendVerification)
 
 			auth.POST("/login", c.LoginUser)
+			auth.POST("/login/mfa", c.LoginWithMfa)
+			auth.POST("/forgotpassword", c.ForgotPassword)
+			auth.POST("/resetpassword", c.ResetPassword)
+			auth.POST("/refresh", c.RefreshToken)
+			auth.POST("/logout", c.SetAuthenticatedUser, c.Logout)
+
+			confirmEmailChange := auth.Group("/confirmemailchange")
+			{
+				confirmEmailChange.GET("/:token", c.ConfirmEmailChange)
+			}
+
+			c.EmailChangeUri = baseUrl + confirmEmailChange.BasePath()
+
+			oidc := auth.Group("/oidc")
+			{
+				oidc.GET("", c.GetOidcProviders)
+				oidc.GET("/:provider/login", c.OidcLogin)
+				oidc.GET("/:provider/callback", c.OidcCallback)
+			}
+
+			c.OidcProviders = newOidcProviders(config.OidcProviders, baseUrl+oidc.BasePath())
 		}
 
 		c.RedirectUri = baseUrl + redirect.BasePath()
@@ -79,59 +130,381 @@ func runApplication() {
 		user := v1.Group("/user")
 		{
 			user.Use(c.SetAuthenticatedUser)
-			user.POST("/tracklink", c.TrackLink)
+			user.POST("/tracklink", requireScope(SCOPE_LINK_CREATE), c.requireWorkspaceRole(WORKSPACE_ROLE_MEMBER), c.TrackLink)
+
+			links := user.Group("/links")
+			{
+				links.GET("", requireScope(SCOPE_READ_ONLY), c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetLinks)
+				links.GET("/:id", requireScope(SCOPE_READ_ONLY), c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetLink)
+				links.PATCH("/:id", requireScope(), c.requireWorkspaceRole(WORKSPACE_ROLE_MEMBER), c.UpdateLink)
+				links.DELETE("/:id", requireScope(), c.requireWorkspaceRole(WORKSPACE_ROLE_MEMBER), c.DeleteLink)
+				links.GET("/:id/stats", requireScope(SCOPE_READ_ONLY), c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetLinkStats)
+			}
+
+			sessions := user.Group("/sessions")
+			{
+				sessions.Use(requireSession)
+				sessions.GET("", c.GetSessions)
+				sessions.DELETE("/:id", c.RevokeSession)
+				sessions.POST("/revokeall", c.RevokeOtherSessions)
+			}
+
+			apiKeys := user.Group("/apikeys")
+			{
+				apiKeys.Use(requireSession)
+				apiKeys.POST("", c.CreateApiKey)
+				apiKeys.GET("", c.GetApiKeys)
+				apiKeys.DELETE("/:id", c.RevokeApiKey)
+			}
+
+			account := user.Group("/account")
+			{
+				account.Use(requireSession)
+				account.POST("/password", c.ChangePassword)
+				account.POST("/email", c.ChangeEmail)
+				account.PUT("/locale", c.SetLocale)
+				account.GET("/export", c.ExportAccount)
+				account.DELETE("", c.DeleteAccount)
+			}
+
+			mfa := user.Group("/mfa")
+			{
+				mfa.Use(requireSession)
+				mfa.POST("/totp/enroll", c.EnrollTotp)
+				mfa.POST("/totp/confirm", c.ConfirmTotp)
+				mfa.POST("/totp/disable", c.DisableTotp)
+				mfa.POST("/recoverycodes", c.RegenerateRecoveryCodes)
+			}
+		}
+
+		workspaces := v1.Group("/workspaces")
+		{
+			workspaces.Use(c.SetAuthenticatedUser, requireScope())
+			workspaces.GET("", c.GetWorkspaces)
+			workspaces.POST("", c.CreateWorkspace)
+			workspaces.POST("/invitations/accept", requireSession, c.AcceptWorkspaceInvitation)
+
+			workspace := workspaces.Group("/:workspaceId")
+			{
+				workspace.GET("", c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetWorkspace)
+				workspace.PATCH("", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.UpdateWorkspace)
+				workspace.DELETE("", c.requireWorkspaceRole(WORKSPACE_ROLE_OWNER), c.DeleteWorkspace)
+
+				workspace.GET("/members", c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetWorkspaceMembers)
+				workspace.PATCH("/members/:userId", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.UpdateWorkspaceMember)
+				workspace.DELETE("/members/:userId", c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.RemoveWorkspaceMember)
+
+				workspace.GET("/invitations", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.GetWorkspaceInvitations)
+				workspace.POST("/invitations", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.CreateWorkspaceInvitation)
+				workspace.DELETE("/invitations/:id", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.RevokeWorkspaceInvitation)
+
+				workspace.GET("/notifications", c.requireWorkspaceRole(WORKSPACE_ROLE_VIEWER), c.GetWorkspaceNotifications)
+				workspace.PUT("/notifications", c.requireWorkspaceRole(WORKSPACE_ROLE_ADMIN), c.SetWorkspaceNotifications)
+
+				webhooks := workspace.Group("/webhooks")
+				{
+					webhooks.Use(c.requireWorkspaceRole(WORKSPACE_ROLE_MEMBER))
+					webhooks.GET("", c.GetWebhooks)
+					webhooks.POST("", c.CreateWebhook)
+					webhooks.DELETE("/:id", c.DeleteWebhook)
+					webhooks.GET("/:id/deliveries", c.GetWebhookDeliveries)
+					webhooks.POST("/:id/ping", c.PingWebhook)
+				}
+			}
+		}
+
+		admin := v1.Group("/admin")
+		{
+			admin.Use(c.SetAuthenticatedUser, requireSession, c.requireAdmin)
+			admin.GET("/outbox", c.GetOutboxMessages)
+			admin.GET("/outbox/stats", c.GetOutboxStats)
+			admin.POST("/outbox/:id/replay", c.ReplayOutboxMessage)
+			admin.GET("/metrics/clicks", c.GetClickQueueStats)
 		}
 	}
 
-	e.Run()
+	server := &http.Server{Addr: ":" + config.Port, Handler: e}
+
+	go func() {
+		log.Printf("Listening on %s", server.Addr)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("error running server: ", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+
+	log.Printf("Shutting down, draining for up to %s...", config.ShutdownTimeout)
+
+	shutdown(c, server, db, geoResolver, config.ShutdownTimeout)
+
+	log.Println("Shutdown complete.")
+}
+
+// shutdown stops taking requests, lets in-flight redirects finish and then drains
+// their clicks and the messages being delivered before closing the database, all within the one timeout.
+func shutdown(c *Controller, server *http.Server, db *Postgres, geoResolver GeoResolver, timeout time.Duration) {
+	c.ShuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := server.Shutdown(ctx)
+	if err != nil {
+		log.Println("error shutting down server: ", err)
+	}
+
+	err = c.ClickQueue.Shutdown(ctx)
+	if err != nil {
+		log.Println("error draining click queue: ", err)
+	}
+
+	err = c.OutboxDispatcher.Shutdown(ctx)
+	if err != nil {
+		log.Println("error stopping outbox dispatcher: ", err)
+	}
+
+	err = geoResolver.Close()
+	if err != nil {
+		log.Println("error closing GeoIP database: ", err)
+	}
+
+	err = db.Close(ctx)
+	if err != nil {
+		log.Println("error closing database: ", err)
+	}
 }
 
 func allowAllOriginsForCORS(e *gin.Engine) {
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Content-Length", "Accept", "Authorization"}
 	e.Use(cors.New(config))
 }
 
+func newController(config *Config, db Database, geoResolver GeoResolver) *Controller {
+	jwtClient := newJwtClient(config)
+
+	c := &Controller{
+		Database:               db,
+		TokenClient:            jwtClient,
+		Emailer:                newEmailer(config),
+		EmailTemplates:         newEmailTemplates(config.EmailTemplatesDir, config.SupportEmail),
+		RedirectPathLength:     config.RedirectPathLength,
+		EmailVerifiedUrl:       config.EmailVerifiedUrl,
+		ErrorRedirectUrl:       config.ErrorRedirectUrl,
+		PasswordResetUrl:       config.PasswordResetUrl,
+		OidcRedirectUrl:        config.OidcRedirectUrl,
+		PasswordResetTokenTtl:  config.PasswordResetTokenTtl,
+		EmailChangeTokenTtl:    config.EmailChangeTokenTtl,
+		WorkspaceInvitationUrl: config.WorkspaceInvitationUrl,
+		WorkspaceInvitationTtl: config.WorkspaceInvitationTtl,
+		VerificationCodeTtl:    config.VerificationCodeTtl,
+		VerificationCooldown:   config.VerificationResendCooldown,
+		AccessTokenTtl:         config.AccessTokenTtl,
+		RefreshTokenTtl:        config.RefreshTokenTtl,
+		MfaTokenTtl:            config.MfaTokenTtl,
+		ReauthenticationMaxAge: config.ReauthenticationMaxAge,
+		TotpIssuer:             config.TotpIssuer,
+		AuthRateLimiter:        newMemoryRateLimiter(config.AuthRateLimitPerMinute, config.AuthRateLimitBurst),
+		LoginRateLimiter:       newMemoryRateLimiter(config.LoginRateLimitPerMinute, config.LoginRateLimitBurst),
+		LoginLockoutThreshold:  config.LoginLockoutThreshold,
+		LoginLockoutBase:       config.LoginLockoutBase,
+		LoginLockoutMax:        config.LoginLockoutMax,
+		BotChecker:             newBotChecker(),
+		GeoResolver:            geoResolver,
+		UserAgentParser:        newUserAgentParser(),
+		RedirectCache:          newRedirectCache(config.RedirectCacheSize, config.RedirectCacheTtl),
+		Jwks:                   jwtClient.Jwks(),
+	}
+
+	c.WebhookNotifier = newWebhookNotifier(db, config)
+	c.Notifiers = []Notifier{newEmailNotifier(db, c.EmailTemplates, config.MaxNumberOfEmailAlerts), c.WebhookNotifier}
+	c.OutboxDispatcher = newOutboxDispatcher(db, config, c.outboxHandlers())
+	c.ClickQueue = newClickQueue(config.ClickQueueSize, config.ClickWorkers, c.processClick)
+
+	return c
+}
+
+// Clicks store the client IP, which Gin only reads from X-Forwarded-For / X-Real-IP
+// when the request comes through one of the trusted proxies (CapRover's nginx by default).
+func trustProxies(e *gin.Engine, proxies []string) {
+	err := e.SetTrustedProxies(proxies)
+	if err != nil {
+		log.Fatal("invalid trusted proxies: ", err)
+	}
+}
+
 type Controller struct {
 	TokenClient            TokenClient
 	Database               Database
 	Emailer                Emailer
+	EmailTemplates         *EmailTemplates
 	BotChecker             BotChecker
+	GeoResolver            GeoResolver
+	UserAgentParser        UserAgentParser
+	ClickQueue             *ClickQueue
+	Notifiers              []Notifier
+	WebhookNotifier        *WebhookNotifier
+	OutboxDispatcher       *OutboxDispatcher
+	RedirectCache          *RedirectCache
+	AuthRateLimiter        RateLimiter
+	LoginRateLimiter       RateLimiter
+	OidcProviders          map[string]*OidcProvider
+	MigrationVersion       uint
+	Jwks                   JwkSet
+	ShuttingDown           atomic.Bool
 	ErrorRedirectUrl       string
+	PasswordResetUrl       string
+	OidcRedirectUrl        string
+	PasswordResetTokenTtl  time.Duration
+	EmailChangeTokenTtl    time.Duration
+	WorkspaceInvitationUrl string
+	WorkspaceInvitationTtl time.Duration
+	VerificationCodeTtl    time.Duration
+	VerificationCooldown   time.Duration
+	AccessTokenTtl         time.Duration
+	RefreshTokenTtl        time.Duration
+	MfaTokenTtl            time.Duration
+	ReauthenticationMaxAge time.Duration
+	TotpIssuer             string
+	LoginLockoutThreshold  int
+	LoginLockoutBase       time.Duration
+	LoginLockoutMax        time.Duration
 	ConfirmationUri        string
+	EmailChangeUri         string
 	EmailVerifiedUrl       string
 	RedirectUri            string
 	RedirectPathLength     int
-	MaxNumberOfEmailAlerts int
 }
 
 type Database interface {
-	UserIdExists(ctx context.Context, userId string) (bool, error)
+	GetUserById(ctx context.Context, userId string) (ResultForGetUserRequest, error)
 	EmailExists(ctx context.Context, userId string) (bool, error)
 	CreateUser(ctx context.Context, user CreateUserRequest) error
 	GetUser(ctx context.Context, email string) (ResultForGetUserRequest, error)
 	AddRedirect(ctx context.Context, request AddRedirectRequest) error
 	GetRedirectRecord(ctx context.Context, path string) (RedirectRecord, error)
-	GetRedirectUrl(ctx context.Context, path string) (string, error)
-	AddLinkClick(ctx context.Context, linkId string) error
-	ConfirmEmailVerified(ctx context.Context, code string) error
+	AddLinkClick(ctx context.Context, request AddLinkClickRequest) (int, error)
+	Ping(ctx context.Context) error
+	GetMigrationVersion(ctx context.Context) (uint, bool, error)
+	CreatePasswordResetToken(ctx context.Context, request CreatePasswordResetTokenRequest) error
+	ResetPassword(ctx context.Context, request ResetPasswordRequest) (bool, error)
+	CreateSession(ctx context.Context, request CreateSessionRequest) (string, error)
+	RotateSession(ctx context.Context, request RotateSessionRequest) (ResultForGetSessionRequest, error)
+	GetSessionUser(ctx context.Context, sessionId string) (ResultForGetUserRequest, error)
+	GetSessions(ctx context.Context, userId string) ([]SessionRecord, error)
+	RevokeSession(ctx context.Context, userId string, sessionId string) (bool, error)
+	RevokeOtherSessions(ctx context.Context, userId string, currentSessionId string) (int, error)
+	IsRecentSession(ctx context.Context, sessionId string, maxAge time.Duration) (bool, error)
+	CreateApiKey(ctx context.Context, request CreateApiKeyRequest) (ApiKeyRecord, error)
+	GetApiKeys(ctx context.Context, userId string) ([]ApiKeyRecord, error)
+	RevokeApiKey(ctx context.Context, userId string, apiKeyId string) (bool, error)
+	UseApiKey(ctx context.Context, keyHash string) (ResultForGetApiKeyRequest, error)
+	ConfirmEmailVerified(ctx context.Context, code string) (string, error)
+	RefreshVerificationCode(ctx context.Context, request RefreshVerificationCodeRequest) (bool, error)
+	GetLinks(ctx context.Context, request GetLinksRequest) (ResultForGetLinksRequest, error)
+	GetLink(ctx context.Context, workspaceId string, linkId string) (ResultForGetLinkRequest, error)
+	UpdateLink(ctx context.Context, request UpdateLinkRequest) (ResultForGetLinkRequest, error)
+	DeleteLink(ctx context.Context, workspaceId string, linkId string) (ResultForGetLinkRequest, error)
+	GetLinkStats(ctx context.Context, request LinkStatsRequest) (ResultForGetLinkStatsRequest, error)
+	StartTotpEnrollment(ctx context.Context, userId string, secret string) (bool, error)
+	EnableTotp(ctx context.Context, request EnableTotpRequest) (bool, error)
+	DisableTotp(ctx context.Context, userId string) error
+	UseTotpStep(ctx context.Context, userId string, step int64) (bool, error)
+	UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error
+	RecordFailedLogin(ctx context.Context, request RecordFailedLoginRequest) (time.Duration, error)
+	ResetFailedLogins(ctx context.Context, userId string) error
+	GetOrCreateOidcUser(ctx context.Context, request OidcLoginRequest) (ResultForGetUserRequest, error)
+	ChangePassword(ctx context.Context, request ChangePasswordRequest) error
+	CreateEmailChangeRequest(ctx context.Context, request CreateEmailChangeRequest) error
+	ConfirmEmailChange(ctx context.Context, tokenHash string) (ResultForConfirmEmailChangeRequest, error)
+	DeleteUser(ctx context.Context, userId string) ([]string, error)
+	GetAccountExport(ctx context.Context, userId string) (AccountExport, error)
+	GetWorkspaces(ctx context.Context, userId string) ([]WorkspaceRecord, error)
+	GetWorkspace(ctx context.Context, workspaceId string, userId string) (ResultForGetWorkspaceRequest, error)
+	GetPersonalWorkspace(ctx context.Context, userId string) (ResultForGetWorkspaceRequest, error)
+	CreateWorkspace(ctx context.Context, userId string, name string) (WorkspaceRecord, error)
+	UpdateWorkspace(ctx context.Context, request UpdateWorkspaceRequest) error
+	DeleteWorkspace(ctx context.Context, workspaceId string) ([]string, error)
+	GetWorkspaceMembers(ctx context.Context, workspaceId string) ([]WorkspaceMemberRecord, error)
+	UpdateWorkspaceMemberRole(ctx context.Context, workspaceId string, userId string, role string) (bool, error)
+	RemoveWorkspaceMember(ctx context.Context, workspaceId string, userId string) (bool, error)
+	CreateWorkspaceInvitation(ctx context.Context, request CreateWorkspaceInvitationRequest) (WorkspaceInvitationRecord, error)
+	GetWorkspaceInvitations(ctx context.Context, workspaceId string) ([]WorkspaceInvitationRecord, error)
+	RevokeWorkspaceInvitation(ctx context.Context, workspaceId string, invitationId string) (bool, error)
+	AcceptWorkspaceInvitation(ctx context.Context, request AcceptWorkspaceInvitationRequest) (ResultForAcceptWorkspaceInvitationRequest, error)
+	GetNotificationRecipients(ctx context.Context, workspaceId string) ([]string, error)
+	SetWorkspaceNotifications(ctx context.Context, request SetWorkspaceNotificationsRequest) (ResultForSetWorkspaceNotificationsRequest, error)
+	CreateWebhook(ctx context.Context, request CreateWebhookRequest) (WebhookRecord, error)
+	GetWebhooks(ctx context.Context, workspaceId string) ([]WebhookRecord, error)
+	GetWebhook(ctx context.Context, workspaceId string, webhookId string) (ResultForGetWebhookRequest, error)
+	DeleteWebhook(ctx context.Context, workspaceId string, webhookId string) (bool, error)
+	AddWebhookDelivery(ctx context.Context, delivery WebhookDeliveryRecord) (WebhookDeliveryRecord, error)
+	GetWebhookDeliveries(ctx context.Context, webhookId string, limit int) ([]WebhookDeliveryRecord, error)
+	AddOutboxMessages(ctx context.Context, messages []OutboxMessage) error
+	ClaimOutboxMessages(ctx context.Context, limit int, lockFor time.Duration) ([]OutboxMessage, error)
+	CompleteOutboxMessage(ctx context.Context, messageId string, followUps []OutboxMessage) error
+	FailOutboxMessage(ctx context.Context, request FailOutboxMessageRequest) error
+	GetOutboxMessages(ctx context.Context, request GetOutboxMessagesRequest) ([]OutboxMessage, error)
+	GetOutboxStats(ctx context.Context) (OutboxStats, error)
+	ReplayOutboxMessage(ctx context.Context, messageId string) (bool, error)
+	DeleteOldOutboxMessages(ctx context.Context, olderThan time.Duration) (ResultForDeleteOldOutboxMessagesRequest, error)
+	SetUserLocale(ctx context.Context, userId string, locale string) error
+	GetUserLocales(ctx context.Context, emails []string) (map[string]string, error)
 }
 
 type TokenClient interface {
-	GenerateToken(userId string) (string, error)
-	GetUserId(token string) (string, error)
+	GenerateToken(userId string, sessionId string) (string, error)
+	ParseToken(token string) (TokenClaims, error)
+	GenerateMfaToken(userId string) (string, error)
+	ParseMfaToken(token string) (string, error)
 }
 
+type TokenClaims struct {
+	UserId    string
+	SessionId string
+	IssuedAt  *time.Time
+}
+
+// CreateUserRequest queues VerificationEmail in the outbox along with the new user.
 type CreateUserRequest struct {
-	Email            string
-	Password         string
-	VerificationCode string
+	Email               string
+	Password            string
+	VerificationCode    string
+	VerificationCodeTtl time.Duration
+	VerificationEmail   SendEmailRequest
+	Locale              string
 }
 
+// RefreshVerificationCodeRequest queues VerificationEmail in the outbox along with the
+// new code, when there is one.
+type RefreshVerificationCodeRequest struct {
+	Email             string
+	VerificationCode  string
+	Ttl               time.Duration
+	Cooldown          time.Duration
+	VerificationEmail SendEmailRequest
+}
+
+const VERIFICATION_CONFIRMED = "confirmed"
+const VERIFICATION_CODE_EXPIRED = "expired"
+const VERIFICATION_CODE_UNKNOWN = "unknown"
+
 type Emailer interface {
 	SendEmail(request SendEmailRequest) error
+	IsConfigured() bool
+}
+
+// Notifier is a channel clicks are notified through. Rather than sending anything
+// itself it returns the messages to send, which the outbox then delivers.
+type Notifier interface {
+	Name() string
+	ClickMessages(ctx context.Context, notification ClickNotification) ([]OutboxMessage, error)
 }
 
 type ResultForGetUserRequest struct {
@@ -140,16 +513,313 @@ type ResultForGetUserRequest struct {
 }
 
 type UserRecordInDatabase struct {
+	HashedPassword   string
+	IsVerified       bool
+	Id               string
+	Email            string
+	TokensValidAfter *time.Time
+	TotpSecret       string
+	TotpEnabled      bool
+	LockedFor        time.Duration
+	IsAdmin          bool
+	Locale           string
+}
+
+type ChangePasswordRequest struct {
+	UserId           string
+	HashedPassword   string
+	CurrentSessionId string
+}
+
+// CreateEmailChangeRequest queues ConfirmationEmail in the outbox along with the
+// request.
+type CreateEmailChangeRequest struct {
+	UserId            string
+	NewEmail          string
+	TokenHash         string
+	Ttl               time.Duration
+	ConfirmationEmail SendEmailRequest
+}
+
+const EMAIL_CHANGE_CONFIRMED = "confirmed"
+const EMAIL_CHANGE_UNKNOWN = "unknown"
+const EMAIL_CHANGE_EMAIL_TAKEN = "email_taken"
+
+type ResultForConfirmEmailChangeRequest struct {
+	Status   string
+	OldEmail string
+	NewEmail string
+	Locale   string
+}
+
+type WorkspaceRecord struct {
+	Id          string
+	Name        string
+	IsPersonal  bool
+	NotifyMode  string
+	Role        string
+	MemberCount int
+	OwnerCount  int
+	CreatedAt   time.Time
+}
+
+type ResultForGetWorkspaceRequest struct {
+	Found     bool
+	Workspace WorkspaceRecord
+}
+
+type UpdateWorkspaceRequest struct {
+	WorkspaceId string
+	Name        *string
+}
+
+// SetWorkspaceNotificationsRequest's Recipients must all be members of the workspace.
+type SetWorkspaceNotificationsRequest struct {
+	WorkspaceId string
+	NotifyMode  string
+	Recipients  []string
+}
+
+// ResultForSetWorkspaceNotificationsRequest lists the recipients who aren't members,
+// in which case nothing was changed. Otherwise it has the redirect paths of the
+// workspace's links, so they can be dropped from the cache.
+type ResultForSetWorkspaceNotificationsRequest struct {
+	NotMembers []string
+	Paths      []string
+}
+
+type WorkspaceMemberRecord struct {
+	UserId    string
+	Email     string
+	Role      string
+	CreatedAt time.Time
+}
+
+// CreateWorkspaceInvitationRequest queues InvitationEmail in the outbox along with the
+// invitation.
+type CreateWorkspaceInvitationRequest struct {
+	WorkspaceId     string
+	Email           string
+	Role            string
+	TokenHash       string
+	InvitedBy       string
+	Ttl             time.Duration
+	InvitationEmail SendEmailRequest
+}
+
+type WorkspaceInvitationRecord struct {
+	Id        string
+	Email     string
+	Role      string
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+type AcceptWorkspaceInvitationRequest struct {
+	TokenHash string
+	UserId    string
+	Email     string
+}
+
+type ResultForAcceptWorkspaceInvitationRequest struct {
+	Found       bool
+	WorkspaceId string
+	Role        string
+}
+
+type CreateWebhookRequest struct {
+	WorkspaceId   string
+	Url           string
+	Secret        string
+	Description   string
+	Format        string
+	Tag           string
+	LinkCreatorId string
+	CreatedBy     string
+}
+
+// WebhookRecord is an endpoint clicks are sent to. Tag and LinkCreatorId, when set,
+// narrow it down to the clicks on links with that tag or created by that user.
+type WebhookRecord struct {
+	Id            string
+	WorkspaceId   string
+	Url           string
+	Secret        string
+	Description   string
+	Format        string
+	Tag           string
+	LinkCreatorId string
+	CreatedAt     time.Time
+}
+
+type ResultForGetWebhookRequest struct {
+	Found   bool
+	Webhook WebhookRecord
+}
+
+type WebhookDeliveryRecord struct {
+	Id         string
+	WebhookId  string
+	EventId    string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Duration   time.Duration
+	CreatedAt  time.Time
+}
+
+type OutboxMessage struct {
+	Id            string
+	Kind          string
+	Payload       []byte
+	Attempts      int
+	LastError     string
+	NextAttemptAt time.Time
+	CreatedAt     time.Time
+	DeliveredAt   *time.Time
+	DeadAt        *time.Time
+}
+
+// FailOutboxMessageRequest either has the message tried again after RetryIn, or
+// dead-letters it.
+type FailOutboxMessageRequest struct {
+	MessageId  string
+	Error      string
+	RetryIn    time.Duration
+	DeadLetter bool
+}
+
+const OUTBOX_STATUS_PENDING = "pending"
+const OUTBOX_STATUS_DEAD = "dead"
+const OUTBOX_STATUS_DELIVERED = "delivered"
+
+type GetOutboxMessagesRequest struct {
+	Status string
+	Kind   *string
+	Limit  int
+	Offset int
+}
+
+// ResultForDeleteOldOutboxMessagesRequest counts the delivered messages and webhook
+// deliveries deleted.
+type ResultForDeleteOldOutboxMessagesRequest struct {
+	Messages   int
+	Deliveries int
+}
+
+type OutboxStats struct {
+	Pending         int
+	Dead            int
+	OldestPendingAt *time.Time
+}
+
+// OidcLoginRequest's Locale is only used when it creates the user.
+type OidcLoginRequest struct {
+	Provider string
+	Subject  string
+	Email    string
+	Locale   string
+}
+
+type RecordFailedLoginRequest struct {
+	UserId      string
+	Threshold   int
+	BaseLockout time.Duration
+	MaxLockout  time.Duration
+}
+
+type EnableTotpRequest struct {
+	UserId             string
+	Step               int64
+	RecoveryCodeHashes []string
+}
+
+// CreatePasswordResetTokenRequest queues ResetEmail in the outbox along with the token.
+type CreatePasswordResetTokenRequest struct {
+	UserId     string
+	TokenHash  string
+	Ttl        time.Duration
+	ResetEmail SendEmailRequest
+}
+
+type CreateSessionRequest struct {
+	UserId           string
+	RefreshTokenHash string
+	UserAgent        string
+	IpAddress        string
+	Ttl              time.Duration
+}
+
+type RotateSessionRequest struct {
+	RefreshTokenHash    string
+	NewRefreshTokenHash string
+	Ttl                 time.Duration
+}
+
+type ResultForGetSessionRequest struct {
+	Found   bool
+	Session SessionRecord
+}
+
+type SessionRecord struct {
+	Id         string
+	UserId     string
+	UserAgent  string
+	IpAddress  string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+	ExpiresAt  time.Time
+}
+
+type CreateApiKeyRequest struct {
+	UserId  string
+	Name    string
+	Prefix  string
+	KeyHash string
+	Scope   string
+}
+
+type ApiKeyRecord struct {
+	Id         string
+	UserId     string
+	Name       string
+	Prefix     string
+	Scope      string
+	CreatedAt  time.Time
+	LastUsedAt *time.Time
+}
+
+type ResultForGetApiKeyRequest struct {
+	Found  bool
+	ApiKey ApiKeyRecord
+}
+
+type ResetPasswordRequest struct {
+	TokenHash      string
 	HashedPassword string
-	IsVerified     bool
-	Id             string
 }
 
 type AddRedirectRequest struct {
-	UserId string
-	Url    string
-	Path   string
-	Tag    string
+	UserId      string
+	WorkspaceId string
+	Url         string
+	Path        string
+	Tag         string
+}
+
+// AddLinkClickRequest queues Notification in the outbox along with the click, when
+// there is one, with its ClickCount filled in.
+type AddLinkClickRequest struct {
+	LinkId         string
+	Referrer       string
+	UserAgent      string
+	IpAddress      string
+	AcceptLanguage string
+	IsBot          bool
+	Location       GeoLocation
+	Device         DeviceInfo
+	ClickedOn      time.Time
+	Notification   *ClickNotification
 }
 
 type LinkClickNotificationRequest struct {
@@ -159,13 +829,105 @@ type LinkClickNotificationRequest struct {
 
 type RedirectRecord struct {
 	RedirectUrl          string
-	UserEmail            string
+	NotifyEmails         []string
 	Tag                  string
 	NumberOfTimesClicked int
 	LinkId               string
+	WorkspaceId          string
+	CreatedBy            string
 	Path                 string
 }
 
+type LinkRecord struct {
+	Id        string
+	CreatedBy string
+	Url       string
+	Path      string
+	Tag       string
+	CreatedAt time.Time
+}
+
+type GetLinksRequest struct {
+	WorkspaceId   string
+	Tag           *string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	Limit         int
+	Offset        int
+}
+
+type ResultForGetLinksRequest struct {
+	Links []LinkRecord
+	Total int
+}
+
+type ResultForGetLinkRequest struct {
+	Found bool
+	Link  LinkRecord
+}
+
+type UpdateLinkRequest struct {
+	WorkspaceId string
+	LinkId      string
+	Url         *string
+	Tag         *string
+}
+
+type LinkStatsRequest struct {
+	WorkspaceId string
+	LinkId      string
+	Interval    string
+	From        time.Time
+	To          time.Time
+}
+
+type ResultForGetLinkStatsRequest struct {
+	Found bool
+	Stats LinkStats
+}
+
+type LinkStats struct {
+	TotalClicks  int
+	FirstClickAt *time.Time
+	LastClickAt  *time.Time
+	Buckets      []ClickBucket
+	Countries    []ClickBreakdown
+	DeviceTypes  []ClickBreakdown
+	Browsers     []ClickBreakdown
+	OSes         []ClickBreakdown
+}
+
+type ClickBreakdown struct {
+	Value  string
+	Clicks int
+}
+
+type ClickBucket struct {
+	Start  time.Time
+	Clicks int
+}
+
 type BotChecker interface {
 	IsBotRequest(req *http.Request) (bool, error)
 }
+
+type GeoResolver interface {
+	Resolve(ip string) (GeoLocation, error)
+	Close() error
+}
+
+// RateLimiter decides whether the request identified by key can go ahead. The in
+// memory implementation suits a single instance, a shared store can implement the
+// same interface when there's more than one.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (RateLimitResult, error)
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	RetryAfter time.Duration
+}
+
+type UserAgentParser interface {
+	Parse(userAgent string) DeviceInfo
+}
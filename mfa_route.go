@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skip2/go-qrcode"
+)
+
+const TOTP_QR_CODE_SIZE = 256
+
+type MfaCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MfaLoginRequest struct {
+	MfaToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type MfaRequiredResponse struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type TotpEnrollmentResponse struct {
+	Secret     string `json:"secret"`
+	OtpauthUri string `json:"otpauth_uri"`
+	QrCodePng  string `json:"qr_code_png"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// LoginWithMfa is the second step of logging in with 2FA on, exchanging the token
+// from LoginUser and either a TOTP code or a recovery code for real tokens.
+func (r *Controller) LoginWithMfa(c *gin.Context) {
+	loginRequest := MfaLoginRequest{}
+
+	if err := c.ShouldBindJSON(&loginRequest); err != nil {
+		log.Printf("invalid mfa login request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	userId, err := r.TokenClient.ParseMfaToken(loginRequest.MfaToken)
+	if err != nil {
+		log.Printf("error parsing mfa token: %s", err)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	if !checkRateLimit(c, r.LoginRateLimiter, "mfa:"+userId) {
+		return
+	}
+
+	result, err := r.Database.GetUserById(c, userId)
+	if err != nil {
+		log.Printf("error fetching user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Found || !result.User.TotpEnabled {
+		log.Printf("user id %s not found or doesn't have 2fa enabled", userId)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	if result.User.LockedFor > 0 {
+		log.Printf("user id %s is locked out for %s", userId, result.User.LockedFor)
+		abortTooManyRequests(c, result.User.LockedFor)
+		return
+	}
+
+	valid, err := r.checkSecondFactor(c, result.User, loginRequest.Code)
+	if err != nil {
+		log.Printf("error checking 2fa code for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !valid {
+		log.Printf("invalid 2fa code for user id %s", userId)
+		r.recordFailedLogin(c, userId)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	err = r.Database.ResetFailedLogins(c, userId)
+	if err != nil {
+		log.Printf("error resetting failed logins for user id %s: %s", userId, err)
+	}
+
+	tokens, err := r.issueTokens(c, userId)
+	if err != nil {
+		log.Printf("error issuing tokens for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// checkSecondFactor accepts a current TOTP code or an unused recovery code, using
+// either up so it can't be replayed.
+func (r *Controller) checkSecondFactor(c *gin.Context, user UserRecordInDatabase, code string) (bool, error) {
+	if isTotpCodeFormat(code) {
+		step, valid := validateTotpCode(user.TotpSecret, code, time.Now())
+		if !valid {
+			return false, nil
+		}
+
+		return r.Database.UseTotpStep(c, user.Id, step)
+	}
+
+	return r.Database.UseRecoveryCode(c, user.Id, hashToken(normalizeRecoveryCode(code)))
+}
+
+// EnrollTotp starts setting up 2FA. It isn't on until ConfirmTotp gets a code from
+// the authenticator app, so a half finished enrollment can't lock the user out.
+func (r *Controller) EnrollTotp(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	if user.TotpEnabled {
+		log.Printf("user id %s already has 2fa enabled", user.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		log.Printf("error generating totp secret for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	started, err := r.Database.StartTotpEnrollment(c, user.Id, secret)
+	if err != nil {
+		log.Printf("error starting totp enrollment for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !started {
+		log.Printf("user id %s enabled 2fa while enrolling", user.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	uri := totpUri(r.TotpIssuer, user.Email, secret)
+
+	png, err := qrcode.Encode(uri, qrcode.Medium, TOTP_QR_CODE_SIZE)
+	if err != nil {
+		log.Printf("error generating qr code for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := TotpEnrollmentResponse{
+		Secret:     secret,
+		OtpauthUri: uri,
+		QrCodePng:  base64.StdEncoding.EncodeToString(png),
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ConfirmTotp turns 2FA on once the user proves their app generates the right codes,
+// and hands out the recovery codes. They're only ever shown this once.
+func (r *Controller) ConfirmTotp(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	codeRequest := MfaCodeRequest{}
+	if err := c.ShouldBindJSON(&codeRequest); err != nil {
+		log.Printf("invalid confirm totp request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if user.TotpEnabled {
+		log.Printf("user id %s already has 2fa enabled", user.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication is already enabled")
+		return
+	}
+
+	if user.TotpSecret == "" {
+		log.Printf("user id %s hasn't started 2fa enrollment", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Two-factor authentication enrollment hasn't been started")
+		return
+	}
+
+	step, valid := validateTotpCode(user.TotpSecret, codeRequest.Code, time.Now())
+	if !valid {
+		log.Printf("invalid totp code confirming enrollment for user id %s", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid code")
+		return
+	}
+
+	codes, hashes := generateRecoveryCodes()
+
+	enabled, err := r.Database.EnableTotp(c, EnableTotpRequest{UserId: user.Id, Step: step, RecoveryCodeHashes: hashes})
+	if err != nil {
+		log.Printf("error enabling totp for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !enabled {
+		log.Printf("2fa enrollment for user id %s changed while confirming", user.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "Two-factor authentication enrollment changed, please start again")
+		return
+	}
+
+	log.Printf("enabled 2fa for user id %s", user.Id)
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (r *Controller) DisableTotp(c *gin.Context) {
+	user, found := r.getVerifiedMfaUser(c)
+	if !found {
+		return
+	}
+
+	err := r.Database.DisableTotp(c, user.Id)
+	if err != nil {
+		log.Printf("error disabling totp for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("disabled 2fa for user id %s", user.Id)
+
+	c.Status(http.StatusNoContent)
+}
+
+// RegenerateRecoveryCodes replaces all of the user's recovery codes, used or not.
+func (r *Controller) RegenerateRecoveryCodes(c *gin.Context) {
+	user, found := r.getVerifiedMfaUser(c)
+	if !found {
+		return
+	}
+
+	codes, hashes := generateRecoveryCodes()
+
+	err := r.Database.ReplaceRecoveryCodes(c, user.Id, hashes)
+	if err != nil {
+		log.Printf("error replacing recovery codes for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// getVerifiedMfaUser is for changes to a user's 2FA, which need a valid code on top
+// of the access token so a stolen token alone can't turn it off.
+func (r *Controller) getVerifiedMfaUser(c *gin.Context) (UserRecordInDatabase, bool) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return user, false
+	}
+
+	codeRequest := MfaCodeRequest{}
+	if err := c.ShouldBindJSON(&codeRequest); err != nil {
+		log.Printf("invalid mfa code request: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return user, false
+	}
+
+	if !user.TotpEnabled {
+		log.Printf("user id %s doesn't have 2fa enabled", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Two-factor authentication isn't enabled")
+		return user, false
+	}
+
+	valid, err := r.checkSecondFactor(c, user, codeRequest.Code)
+	if err != nil {
+		log.Printf("error checking 2fa code for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return user, false
+	}
+
+	if !valid {
+		log.Printf("invalid 2fa code for user id %s", user.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid code")
+		return user, false
+	}
+
+	return user, true
+}
+
+func (r *Controller) getAuthenticatedUserRecord(c *gin.Context) (UserRecordInDatabase, bool) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return UserRecordInDatabase{}, false
+	}
+
+	result, err := r.Database.GetUserById(c, userId)
+	if err != nil {
+		log.Printf("error fetching user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return UserRecordInDatabase{}, false
+	}
+
+	if !result.Found {
+		log.Printf("user id %s not found", userId)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return UserRecordInDatabase{}, false
+	}
+
+	return result.User, true
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 
 	"github.com/golang-migrate/migrate/v4"
@@ -12,12 +11,11 @@ import (
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
-func runMigrations() {
+// runMigrations brings the schema up to date and returns the version it's now at.
+func runMigrations(databaseUrl string) uint {
 	log.Println("Running migrations (if applicable)...")
 
-	connStr := fmt.Sprintf("user=%s password=%s dbname=%s host=%s port=%s sslmode=disable", getEnv("DB_USER"), getEnv("DB_PASSWORD"), getEnv("DB_NAME"), getEnv("DB_HOST"), getEnv("DB_PORT"))
-
-	db, err := sql.Open("pgx", connStr)
+	db, err := sql.Open("pgx", databaseUrl)
 	if err != nil {
 		log.Panic("error opening database for migration: ", err)
 	}
@@ -43,5 +41,13 @@ func runMigrations() {
 			log.Panic("error running migration: ", err)
 		}
 	}
-	log.Println("Completed migrations run.")
+
+	version, _, err := m.Version()
+	if err != nil {
+		log.Panic("error getting migration version: ", err)
+	}
+
+	log.Printf("Completed migrations run, schema at version %d.", version)
+
+	return version
 }
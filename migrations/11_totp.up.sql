@@ -0,0 +1,15 @@
+ALTER TABLE users
+ADD COLUMN totp_secret TEXT,
+ADD COLUMN totp_enabled_at TIMESTAMP,
+ADD COLUMN totp_last_used_step BIGINT;
+
+CREATE TABLE recovery_codes (
+    recovery_code_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX index_recovery_codes_user_id
+ON recovery_codes (user_id);
\ No newline at end of file
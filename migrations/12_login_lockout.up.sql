@@ -0,0 +1,3 @@
+ALTER TABLE users
+ADD COLUMN failed_login_attempts INT NOT NULL DEFAULT 0,
+ADD COLUMN locked_until TIMESTAMP;
\ No newline at end of file
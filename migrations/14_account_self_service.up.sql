@@ -0,0 +1,20 @@
+ALTER TABLE links
+DROP CONSTRAINT IF EXISTS links_user_id_fkey,
+ADD CONSTRAINT links_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE;
+
+ALTER TABLE clicks
+DROP CONSTRAINT IF EXISTS clicks_link_id_fkey,
+ADD CONSTRAINT clicks_link_id_fkey FOREIGN KEY (link_id) REFERENCES links(link_id) ON DELETE CASCADE;
+
+CREATE TABLE email_change_requests (
+    email_change_request_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    new_email TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX index_email_change_requests_user_id
+ON email_change_requests (user_id);
\ No newline at end of file
@@ -0,0 +1,63 @@
+CREATE TABLE workspaces (
+    workspace_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    is_personal BOOLEAN NOT NULL DEFAULT false,
+    notify_mode TEXT NOT NULL DEFAULT 'creator',
+    created_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE workspace_members (
+    workspace_id UUID NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    role TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX index_workspace_members_user_id
+ON workspace_members (user_id);
+
+CREATE TABLE workspace_invitations (
+    invitation_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    workspace_id UUID NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    role TEXT NOT NULL,
+    token_hash TEXT UNIQUE NOT NULL,
+    invited_by UUID REFERENCES users(user_id) ON DELETE SET NULL,
+    expires_at TIMESTAMP NOT NULL,
+    accepted_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX index_workspace_invitations_workspace_id
+ON workspace_invitations (workspace_id);
+
+CREATE TABLE workspace_notification_recipients (
+    workspace_id UUID NOT NULL REFERENCES workspaces(workspace_id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (workspace_id, email)
+);
+
+INSERT INTO workspaces (name, is_personal, created_by)
+SELECT 'Personal', true, user_id FROM users;
+
+INSERT INTO workspace_members (workspace_id, user_id, role)
+SELECT workspace_id, created_by, 'owner' FROM workspaces WHERE is_personal;
+
+ALTER TABLE links
+ADD COLUMN workspace_id UUID REFERENCES workspaces(workspace_id) ON DELETE CASCADE;
+
+UPDATE links l
+SET workspace_id = w.workspace_id
+FROM workspaces w
+WHERE w.is_personal AND w.created_by = l.user_id;
+
+CREATE INDEX index_links_workspace_id
+ON links (workspace_id);
+
+ALTER TABLE links
+DROP CONSTRAINT links_user_id_fkey,
+ADD CONSTRAINT links_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE SET NULL;
\ No newline at end of file
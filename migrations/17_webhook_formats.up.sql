@@ -0,0 +1,4 @@
+ALTER TABLE webhooks
+ADD COLUMN format TEXT NOT NULL DEFAULT 'json',
+ADD COLUMN tag TEXT,
+ADD COLUMN link_creator_id UUID REFERENCES users(user_id) ON DELETE CASCADE;
\ No newline at end of file
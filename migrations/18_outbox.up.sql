@@ -0,0 +1,23 @@
+CREATE TABLE outbox (
+    message_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kind TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    locked_until TIMESTAMP,
+    last_error TEXT,
+    delivered_at TIMESTAMP,
+    dead_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX index_outbox_pending
+ON outbox (next_attempt_at)
+WHERE delivered_at IS NULL AND dead_at IS NULL;
+
+CREATE INDEX index_outbox_dead
+ON outbox (dead_at)
+WHERE dead_at IS NOT NULL;
+
+ALTER TABLE users
+ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT false;
\ No newline at end of file
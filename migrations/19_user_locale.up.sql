@@ -0,0 +1,2 @@
+ALTER TABLE users
+ADD COLUMN locale TEXT NOT NULL DEFAULT 'en';
\ No newline at end of file
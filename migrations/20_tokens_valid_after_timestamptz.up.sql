@@ -0,0 +1,2 @@
+ALTER TABLE users
+ALTER COLUMN tokens_valid_after TYPE TIMESTAMPTZ;
\ No newline at end of file
@@ -0,0 +1,6 @@
+CREATE INDEX index_outbox_delivered
+ON outbox (delivered_at)
+WHERE delivered_at IS NOT NULL;
+
+CREATE INDEX index_webhook_deliveries_created_at
+ON webhook_deliveries (created_at);
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE links
+ADD COLUMN deleted_at TIMESTAMP;
+
+CREATE INDEX index_links_user_id_created_at
+ON links (user_id, created_at)
+WHERE deleted_at IS NULL;
\ No newline at end of file
@@ -0,0 +1,6 @@
+ALTER TABLE clicks
+ADD COLUMN referrer TEXT,
+ADD COLUMN user_agent TEXT,
+ADD COLUMN ip_address TEXT,
+ADD COLUMN accept_language TEXT,
+ADD COLUMN is_bot BOOLEAN NOT NULL DEFAULT false;
\ No newline at end of file
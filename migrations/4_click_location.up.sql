@@ -0,0 +1,4 @@
+ALTER TABLE clicks
+ADD COLUMN country_code TEXT,
+ADD COLUMN region TEXT,
+ADD COLUMN city TEXT;
\ No newline at end of file
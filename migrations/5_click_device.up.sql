@@ -0,0 +1,4 @@
+ALTER TABLE clicks
+ADD COLUMN device_type TEXT,
+ADD COLUMN browser TEXT,
+ADD COLUMN os TEXT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+ALTER TABLE links
+ADD COLUMN click_count INTEGER NOT NULL DEFAULT 0;
+
+UPDATE links l
+SET click_count = (
+    SELECT COUNT(*)
+    FROM clicks c
+    WHERE c.link_id = l.link_id AND NOT c.is_bot
+);
\ No newline at end of file
@@ -0,0 +1,14 @@
+CREATE TABLE password_reset_tokens (
+    token_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    token_hash TEXT UNIQUE NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX index_password_reset_tokens_user_id
+ON password_reset_tokens (user_id);
+
+ALTER TABLE users
+ADD COLUMN tokens_valid_after TIMESTAMP;
\ No newline at end of file
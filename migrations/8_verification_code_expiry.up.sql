@@ -0,0 +1,11 @@
+ALTER TABLE users
+ADD COLUMN verification_code_expires_at TIMESTAMP,
+ADD COLUMN verification_sent_at TIMESTAMP;
+
+UPDATE users
+SET verification_code = NULL
+WHERE is_verified;
+
+UPDATE users
+SET verification_code_expires_at = created_at + interval '24 hours', verification_sent_at = created_at
+WHERE NOT is_verified;
\ No newline at end of file
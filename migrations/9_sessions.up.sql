@@ -0,0 +1,18 @@
+CREATE TABLE sessions (
+    session_id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    refresh_token_hash TEXT UNIQUE NOT NULL,
+    previous_refresh_token_hash TEXT,
+    user_agent TEXT,
+    ip_address TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    revoked_at TIMESTAMP
+);
+
+CREATE INDEX index_sessions_user_id
+ON sessions (user_id);
+
+CREATE INDEX index_sessions_previous_refresh_token_hash
+ON sessions (previous_refresh_token_hash);
\ No newline at end of file
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ClickNotification is what every notification channel is told about a click.
+type ClickNotification struct {
+	EventId      string
+	LinkId       string
+	WorkspaceId  string
+	CreatedBy    string
+	Path         string
+	TrackedUrl   string
+	RedirectUrl  string
+	Tag          string
+	ClickCount   int
+	ClickedOn    time.Time
+	Referrer     string
+	Location     GeoLocation
+	Device       DeviceInfo
+	NotifyEmails []string
+}
+
+// newClickNotification leaves ClickCount to be filled in when the click is stored.
+func (r *Controller) newClickNotification(record RedirectRecord, click AddLinkClickRequest) ClickNotification {
+	return ClickNotification{
+		EventId:      uuid.NewString(),
+		LinkId:       record.LinkId,
+		WorkspaceId:  record.WorkspaceId,
+		CreatedBy:    record.CreatedBy,
+		Path:         record.Path,
+		TrackedUrl:   fmt.Sprintf("%s/%s", r.RedirectUri, record.Path),
+		RedirectUrl:  record.RedirectUrl,
+		Tag:          record.Tag,
+		ClickedOn:    click.ClickedOn,
+		Referrer:     click.Referrer,
+		Location:     click.Location,
+		Device:       click.Device,
+		NotifyEmails: record.NotifyEmails,
+	}
+}
+
+// EmailNotifier emails the workspace's recipients about the first clicks on a link,
+// up to the alert limit, each in their own locale.
+type EmailNotifier struct {
+	database  Database
+	templates *EmailTemplates
+	maxAlerts int
+}
+
+func newEmailNotifier(database Database, templates *EmailTemplates, maxAlerts int) *EmailNotifier {
+	return &EmailNotifier{database: database, templates: templates, maxAlerts: maxAlerts}
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) ClickMessages(ctx context.Context, notification ClickNotification) ([]OutboxMessage, error) {
+	// the alert cap counts the clicks before this one
+	previousClicks := notification.ClickCount - 1
+
+	if previousClicks > n.maxAlerts {
+		log.Printf("not sending email notification for link path %s as number of clicks exceeded", notification.Path)
+		return nil, nil
+	}
+
+	if len(notification.NotifyEmails) == 0 {
+		return nil, nil
+	}
+
+	locales, err := n.database.GetUserLocales(ctx, notification.NotifyEmails)
+	if err != nil {
+		return nil, fmt.Errorf("error getting recipients' locales: %s", err)
+	}
+
+	data := ClickAlertEmailData{
+		Path:        notification.Path,
+		Tag:         notification.Tag,
+		TrackedUrl:  notification.TrackedUrl,
+		RedirectUrl: notification.RedirectUrl,
+		ClickCount:  notification.ClickCount,
+		Location:    describeLocation(notification.Location),
+		Device:      describeDevice(notification.Device),
+		LastAlert:   previousClicks == n.maxAlerts-1,
+	}
+
+	messages := []OutboxMessage{}
+	for _, email := range notification.NotifyEmails {
+		locale, found := locales[strings.ToLower(email)]
+		if !found {
+			locale = DEFAULT_LOCALE
+		}
+
+		ser, err := n.templates.Render(EMAIL_TEMPLATE_CLICK_ALERT, locale, email, data)
+		if err != nil {
+			return nil, err
+		}
+
+		message, err := newOutboxMessage(OUTBOX_KIND_EMAIL, ser)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
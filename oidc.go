@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const OIDC_HTTP_TIMEOUT = 10 * time.Second
+
+// OIDC_METADATA_TTL is how long the discovery document and signing keys are cached.
+// Unknown key ids refetch the keys sooner, at most once per OIDC_JWKS_MIN_REFRESH.
+const OIDC_METADATA_TTL = time.Hour
+const OIDC_JWKS_MIN_REFRESH = time.Minute
+
+const OIDC_MAX_RESPONSE_SIZE = 1 << 20
+
+// OidcProvider logs users in with the authorization code flow and PKCE, verifying
+// the ID token against the provider's published keys. Everything about the provider
+// other than its issuer and client comes from its discovery document.
+type OidcProvider struct {
+	Config      OidcProviderConfig
+	CallbackUrl string
+	client      *http.Client
+
+	mu            sync.Mutex
+	discovery     oidcDiscovery
+	discoveredAt  time.Time
+	keys          map[string]interface{}
+	keysFetchedAt time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IdToken string `json:"id_token"`
+}
+
+// OidcIdentity is who the provider says logged in.
+type OidcIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type oidcClaims struct {
+	Nonce         string      `json:"nonce"`
+	Email         string      `json:"email"`
+	EmailVerified interface{} `json:"email_verified"`
+	TenantId      string      `json:"tid"`
+	jwt.RegisteredClaims
+}
+
+func newOidcProviders(configs []OidcProviderConfig, callbackBaseUrl string) map[string]*OidcProvider {
+	providers := map[string]*OidcProvider{}
+
+	for _, config := range configs {
+		providers[config.Name] = &OidcProvider{
+			Config:      config,
+			CallbackUrl: callbackBaseUrl + "/" + config.Name + "/callback",
+			client:      &http.Client{Timeout: OIDC_HTTP_TIMEOUT},
+		}
+		log.Printf("OIDC login enabled for %s with issuer %s", config.Name, config.IssuerUrl)
+	}
+
+	return providers
+}
+
+// AuthorizationUrl is where to send the user to log in with the provider.
+func (p *OidcProvider) AuthorizationUrl(ctx context.Context, state string, nonce string, codeVerifier string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint %s: %s", discovery.AuthorizationEndpoint, err)
+	}
+
+	challenge := sha256.Sum256([]byte(codeVerifier))
+
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.Config.ClientId)
+	query.Set("redirect_uri", p.CallbackUrl)
+	query.Set("scope", "openid email profile")
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange swaps the code from the callback for an ID token and returns the identity
+// in it once the token is verified.
+func (p *OidcProvider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (OidcIdentity, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return OidcIdentity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.CallbackUrl)
+	form.Set("client_id", p.Config.ClientId)
+	form.Set("code_verifier", codeVerifier)
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return OidcIdentity{}, fmt.Errorf("error creating token request: %s", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	tokens := oidcTokenResponse{}
+	err = p.doJson(req, &tokens)
+	if err != nil {
+		return OidcIdentity{}, fmt.Errorf("error exchanging code: %s", err)
+	}
+
+	if tokens.IdToken == "" {
+		return OidcIdentity{}, fmt.Errorf("no id_token in token response")
+	}
+
+	return p.verifyIdToken(ctx, discovery, tokens.IdToken, nonce)
+}
+
+func (p *OidcProvider) verifyIdToken(ctx context.Context, discovery oidcDiscovery, idToken string, nonce string) (OidcIdentity, error) {
+	keyFunc := func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(ctx, discovery.JwksUri, kid)
+	}
+
+	parsed, err := jwt.ParseWithClaims(idToken, &oidcClaims{}, keyFunc,
+		jwt.WithAudience(p.Config.ClientId),
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+	)
+	if err != nil {
+		return OidcIdentity{}, fmt.Errorf("error verifying id token: %s", err)
+	}
+
+	claims, ok := parsed.Claims.(*oidcClaims)
+	if !ok || !parsed.Valid {
+		return OidcIdentity{}, fmt.Errorf("invalid id token")
+	}
+
+	// Multi-tenant Microsoft apps discover an issuer with a {tenantid} placeholder,
+	// filled in from the tenant the user belongs to.
+	issuer := strings.ReplaceAll(discovery.Issuer, "{tenantid}", claims.TenantId)
+	if claims.Issuer != issuer {
+		return OidcIdentity{}, fmt.Errorf("id token issuer %s doesn't match %s", claims.Issuer, issuer)
+	}
+
+	if claims.ExpiresAt == nil {
+		return OidcIdentity{}, fmt.Errorf("no exp claim in id token")
+	}
+
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return OidcIdentity{}, fmt.Errorf("id token nonce doesn't match")
+	}
+
+	if claims.Subject == "" {
+		return OidcIdentity{}, fmt.Errorf("no sub claim in id token")
+	}
+
+	identity := OidcIdentity{Subject: claims.Subject, Email: claims.Email}
+
+	switch verified := claims.EmailVerified.(type) {
+	case bool:
+		identity.EmailVerified = verified
+	case string:
+		identity.EmailVerified = verified == "true"
+	case nil:
+		identity.EmailVerified = p.Config.TrustEmail
+	}
+
+	return identity, nil
+}
+
+func (p *OidcProvider) getDiscovery(ctx context.Context) (oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if time.Since(p.discoveredAt) < OIDC_METADATA_TTL {
+		return p.discovery, nil
+	}
+
+	discoveryUrl := strings.TrimSuffix(p.Config.IssuerUrl, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryUrl, nil)
+	if err != nil {
+		return oidcDiscovery{}, fmt.Errorf("error creating discovery request: %s", err)
+	}
+
+	discovery := oidcDiscovery{}
+	err = p.doJson(req, &discovery)
+	if err != nil {
+		return oidcDiscovery{}, fmt.Errorf("error fetching discovery document %s: %s", discoveryUrl, err)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksUri == "" {
+		return oidcDiscovery{}, fmt.Errorf("discovery document %s is missing endpoints", discoveryUrl)
+	}
+
+	p.discovery = discovery
+	p.discoveredAt = time.Now()
+
+	return discovery, nil
+}
+
+func (p *OidcProvider) getKey(ctx context.Context, jwksUri string, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key, found := p.keys[kid]
+	stale := time.Since(p.keysFetchedAt) > OIDC_METADATA_TTL
+
+	if (!found || stale) && time.Since(p.keysFetchedAt) > OIDC_JWKS_MIN_REFRESH {
+		err := p.fetchKeys(ctx, jwksUri)
+		if err != nil {
+			return nil, err
+		}
+		key, found = p.keys[kid]
+	}
+
+	if !found {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	return key, nil
+}
+
+func (p *OidcProvider) fetchKeys(ctx context.Context, jwksUri string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksUri, nil)
+	if err != nil {
+		return fmt.Errorf("error creating jwks request: %s", err)
+	}
+
+	set := JwkSet{}
+	err = p.doJson(req, &set)
+	if err != nil {
+		return fmt.Errorf("error fetching jwks %s: %s", jwksUri, err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Printf("skipping key id %s from %s: %s", jwk.Kid, jwksUri, err)
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetchedAt = time.Now()
+
+	return nil
+}
+
+func (p *OidcProvider) doJson(req *http.Request, out interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, OIDC_MAX_RESPONSE_SIZE))
+	if err != nil {
+		return fmt.Errorf("error reading response: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, truncateString(string(body), 500))
+	}
+
+	err = json.Unmarshal(body, out)
+	if err != nil {
+		return fmt.Errorf("error parsing response: %s", err)
+	}
+
+	return nil
+}
+
+// PublicKey turns an RSA or EC key from a JWKS into one jwt can verify with.
+func (j Jwk) PublicKey() (interface{}, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %s", err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %s", err)
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, found := curves[j.Crv]
+		if !found {
+			return nil, fmt.Errorf("unsupported curve %s", j.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %s", err)
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %s", err)
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", j.Kty)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+)
+
+const OIDC_STATE_COOKIE_TTL = 10 * time.Minute
+const OIDC_STATE_LENGTH = 32
+const OIDC_CODE_VERIFIER_LENGTH = 64
+
+// GetOidcProviders lists the providers users can log in with, for the frontend to
+// show a button for each.
+func (r *Controller) GetOidcProviders(c *gin.Context) {
+	names := []string{}
+	for name := range r.OidcProviders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	c.JSON(http.StatusOK, gin.H{"providers": names})
+}
+
+// OidcLogin sends the user to the provider. The state, nonce and PKCE verifier are
+// kept in a cookie scoped to the provider's routes, for the callback to check.
+func (r *Controller) OidcLogin(c *gin.Context) {
+	provider, found := r.OidcProviders[c.Param("provider")]
+	if !found {
+		log.Printf("unknown oidc provider %s", c.Param("provider"))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	state := uniuri.NewLen(OIDC_STATE_LENGTH)
+	nonce := uniuri.NewLen(OIDC_STATE_LENGTH)
+	codeVerifier := uniuri.NewLen(OIDC_CODE_VERIFIER_LENGTH)
+
+	authorizationUrl, err := provider.AuthorizationUrl(c, state, nonce, codeVerifier)
+	if err != nil {
+		log.Printf("error building authorization url for oidc provider %s: %s", provider.Config.Name, err)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_unavailable"))
+		return
+	}
+
+	r.setOidcCookie(c, provider, strings.Join([]string{state, nonce, codeVerifier}, "."), int(OIDC_STATE_COOKIE_TTL.Seconds()))
+
+	c.Redirect(http.StatusFound, authorizationUrl)
+}
+
+// OidcCallback finishes logging in with the provider and sends the user back to the
+// frontend with our tokens in the URL fragment, which isn't sent to any server.
+func (r *Controller) OidcCallback(c *gin.Context) {
+	provider, found := r.OidcProviders[c.Param("provider")]
+	if !found {
+		log.Printf("unknown oidc provider %s", c.Param("provider"))
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	name := provider.Config.Name
+
+	if providerError := c.Query("error"); providerError != "" {
+		log.Printf("oidc provider %s returned error %s: %s", name, providerError, c.Query("error_description"))
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_denied"))
+		return
+	}
+
+	cookie, err := c.Cookie(oidcCookieName(provider))
+	r.setOidcCookie(c, provider, "", -1)
+
+	parts := strings.Split(cookie, ".")
+	if err != nil || len(parts) != 3 {
+		log.Printf("missing or invalid oidc state cookie for provider %s", name)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+		return
+	}
+
+	state, nonce, codeVerifier := parts[0], parts[1], parts[2]
+
+	if subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		log.Printf("oidc state mismatch for provider %s", name)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+		return
+	}
+
+	identity, err := provider.Exchange(c, c.Query("code"), codeVerifier, nonce)
+	if err != nil {
+		log.Printf("error completing oidc login with provider %s: %s", name, err)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+		return
+	}
+
+	if identity.Email == "" || !identity.EmailVerified {
+		log.Printf("oidc provider %s subject %s has no verified email", name, identity.Subject)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_email_not_verified"))
+		return
+	}
+
+	olr := OidcLoginRequest{Provider: name, Subject: identity.Subject, Email: identity.Email, Locale: matchLocale(c.GetHeader("Accept-Language"))}
+
+	result, err := r.Database.GetOrCreateOidcUser(c, olr)
+	if err != nil {
+		log.Printf("error getting user for oidc provider %s subject %s: %s", name, identity.Subject, err)
+		c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+		return
+	}
+
+	fragment := url.Values{}
+
+	if result.User.TotpEnabled {
+		mfaToken, err := r.TokenClient.GenerateMfaToken(result.User.Id)
+		if err != nil {
+			log.Printf("error generating mfa token for user id %s: %s", result.User.Id, err)
+			c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+			return
+		}
+
+		fragment.Set("mfa_required", "true")
+		fragment.Set("mfa_token", mfaToken)
+		fragment.Set("expires_in", strconv.Itoa(int(r.MfaTokenTtl.Seconds())))
+	} else {
+		tokens, err := r.issueTokens(c, result.User.Id)
+		if err != nil {
+			log.Printf("error issuing tokens for user id %s: %s", result.User.Id, err)
+			c.Redirect(http.StatusFound, r.errorRedirectUrlWithReason("oidc_failed"))
+			return
+		}
+
+		fragment.Set("access_token", tokens.AccessToken)
+		fragment.Set("refresh_token", tokens.RefreshToken)
+		fragment.Set("token_type", tokens.TokenType)
+		fragment.Set("expires_in", strconv.Itoa(tokens.ExpiresIn))
+	}
+
+	log.Printf("user id %s logged in with oidc provider %s", result.User.Id, name)
+
+	c.Redirect(http.StatusFound, r.OidcRedirectUrl+"#"+fragment.Encode())
+}
+
+func oidcCookieName(provider *OidcProvider) string {
+	return "oidc_" + provider.Config.Name
+}
+
+func (r *Controller) setOidcCookie(c *gin.Context, provider *OidcProvider, value string, maxAge int) {
+	callbackPath := "/"
+	if u, err := url.Parse(provider.CallbackUrl); err == nil {
+		callbackPath = u.Path
+	}
+
+	secure := strings.HasPrefix(provider.CallbackUrl, "https://")
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcCookieName(provider), value, maxAge, strings.TrimSuffix(callbackPath, "/callback"), "", secure, true)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const TEST_OIDC_CLIENT_ID = "test-client"
+const TEST_OIDC_NONCE = "test-nonce"
+const TEST_OIDC_CODE_VERIFIER = "test-code-verifier"
+
+// mockOidcProvider serves discovery, JWKS and token endpoints, answering every code
+// with an ID token for the claims set on it, signed with its current key.
+type mockOidcProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu          sync.Mutex
+	issuer      string
+	keys        []JwtKey
+	signWith    JwtKey
+	claims      jwt.MapClaims
+	jwksFetches int
+}
+
+func newMockOidcProvider(t *testing.T) *mockOidcProvider {
+	m := &mockOidcProvider{t: t}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", m.serveDiscovery)
+	mux.HandleFunc("/jwks", m.serveJwks)
+	mux.HandleFunc("/token", m.serveToken)
+
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	m.issuer = m.server.URL
+	m.rotateKey()
+
+	return m
+}
+
+func newTestRsaKey(t *testing.T) JwtKey {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+
+	key, err := newJwtKey(private, "test")
+	if err != nil {
+		t.Fatalf("error creating key: %s", err)
+	}
+
+	return key
+}
+
+// rotateKey signs with a new key from now on, publishing only that one.
+func (m *mockOidcProvider) rotateKey() JwtKey {
+	key := newTestRsaKey(m.t)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.keys = []JwtKey{key}
+	m.signWith = key
+
+	return key
+}
+
+func (m *mockOidcProvider) setClaims(claims jwt.MapClaims) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.claims = claims
+}
+
+func (m *mockOidcProvider) validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            m.server.URL,
+		"aud":            TEST_OIDC_CLIENT_ID,
+		"sub":            "user-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"nonce":          TEST_OIDC_NONCE,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Minute).Unix(),
+	}
+}
+
+func (m *mockOidcProvider) serveDiscovery(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                m.issuer,
+		AuthorizationEndpoint: m.server.URL + "/authorize",
+		TokenEndpoint:         m.server.URL + "/token",
+		JwksUri:               m.server.URL + "/jwks",
+	})
+}
+
+func (m *mockOidcProvider) serveJwks(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.jwksFetches++
+
+	set := JwkSet{Keys: []Jwk{}}
+	for _, key := range m.keys {
+		jwk, _ := key.Jwk()
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	json.NewEncoder(w).Encode(set)
+}
+
+func (m *mockOidcProvider) serveToken(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if r.Method != http.MethodPost || r.FormValue("grant_type") != "authorization_code" || r.FormValue("code") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	if r.FormValue("client_id") != TEST_OIDC_CLIENT_ID || r.FormValue("code_verifier") != TEST_OIDC_CODE_VERIFIER {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+
+	token := jwt.NewWithClaims(m.signWith.Method, m.claims)
+	token.Header["kid"] = m.signWith.Id
+
+	idToken, err := token.SignedString(m.signWith.Key)
+	if err != nil {
+		m.t.Errorf("error signing id token: %s", err)
+		http.Error(w, "server_error", http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(oidcTokenResponse{IdToken: idToken})
+}
+
+func (m *mockOidcProvider) fetches() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.jwksFetches
+}
+
+func (m *mockOidcProvider) newProvider(trustEmail bool) *OidcProvider {
+	config := OidcProviderConfig{Name: "mock", IssuerUrl: m.server.URL, ClientId: TEST_OIDC_CLIENT_ID, TrustEmail: trustEmail}
+	return newOidcProviders([]OidcProviderConfig{config}, "http://localhost/v1/auth/oidc")["mock"]
+}
+
+func TestOidcAuthorizationUrlUsesPkce(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := mock.newProvider(false)
+
+	authorizationUrl, err := provider.AuthorizationUrl(context.Background(), "test-state", TEST_OIDC_NONCE, TEST_OIDC_CODE_VERIFIER)
+	if err != nil {
+		t.Fatalf("error getting authorization url: %s", err)
+	}
+
+	u, err := url.Parse(authorizationUrl)
+	if err != nil {
+		t.Fatalf("invalid authorization url %s: %s", authorizationUrl, err)
+	}
+
+	challenge := sha256.Sum256([]byte(TEST_OIDC_CODE_VERIFIER))
+	expected := map[string]string{
+		"client_id":             TEST_OIDC_CLIENT_ID,
+		"redirect_uri":          "http://localhost/v1/auth/oidc/mock/callback",
+		"state":                 "test-state",
+		"nonce":                 TEST_OIDC_NONCE,
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range expected {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestOidcExchange(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := mock.newProvider(false)
+	mock.setClaims(mock.validClaims())
+
+	identity, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+	if err != nil {
+		t.Fatalf("error exchanging code: %s", err)
+	}
+
+	expected := OidcIdentity{Subject: "user-1", Email: "user@example.com", EmailVerified: true}
+	if identity != expected {
+		t.Errorf("identity = %+v, want %+v", identity, expected)
+	}
+}
+
+func TestOidcExchangeRejectsInvalidIdTokens(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(claims jwt.MapClaims)
+		nonce  string
+	}{
+		{"wrong nonce", func(claims jwt.MapClaims) {}, "other-nonce"},
+		{"missing nonce", func(claims jwt.MapClaims) { delete(claims, "nonce") }, TEST_OIDC_NONCE},
+		{"wrong issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://attacker.example.com" }, TEST_OIDC_NONCE},
+		{"wrong audience", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }, TEST_OIDC_NONCE},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Minute).Unix() }, TEST_OIDC_NONCE},
+		{"missing expiry", func(claims jwt.MapClaims) { delete(claims, "exp") }, TEST_OIDC_NONCE},
+		{"missing subject", func(claims jwt.MapClaims) { delete(claims, "sub") }, TEST_OIDC_NONCE},
+	}
+
+	mock := newMockOidcProvider(t)
+	provider := mock.newProvider(false)
+
+	for _, test := range tests {
+		claims := mock.validClaims()
+		test.change(claims)
+		mock.setClaims(claims)
+
+		_, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, test.nonce)
+		if err == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestOidcExchangeRejectsTokensSignedWithUnpublishedKeys(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := mock.newProvider(false)
+	mock.setClaims(mock.validClaims())
+
+	published := mock.keys
+	mock.rotateKey()
+
+	mock.mu.Lock()
+	mock.keys = published
+	mock.mu.Unlock()
+
+	_, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+	if err == nil {
+		t.Errorf("accepted an id token signed with a key that isn't in the jwks")
+	}
+}
+
+func TestOidcUnknownKeyIdRefetchesKeys(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	provider := mock.newProvider(false)
+	mock.setClaims(mock.validClaims())
+
+	_, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+	if err != nil {
+		t.Fatalf("error exchanging code: %s", err)
+	}
+
+	if fetches := mock.fetches(); fetches != 1 {
+		t.Fatalf("fetched jwks %d times, want 1", fetches)
+	}
+
+	mock.rotateKey()
+
+	// keys were fetched too recently to fetch them again straight away
+	_, err = provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+	if err == nil || !strings.Contains(err.Error(), "unknown key id") {
+		t.Errorf("error = %v, want unknown key id", err)
+	}
+
+	if fetches := mock.fetches(); fetches != 1 {
+		t.Errorf("fetched jwks %d times within %s, want 1", fetches, OIDC_JWKS_MIN_REFRESH)
+	}
+
+	provider.mu.Lock()
+	provider.keysFetchedAt = time.Now().Add(-OIDC_JWKS_MIN_REFRESH - time.Second)
+	provider.mu.Unlock()
+
+	_, err = provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+	if err != nil {
+		t.Fatalf("error exchanging code after key rotation: %s", err)
+	}
+
+	if fetches := mock.fetches(); fetches != 2 {
+		t.Errorf("fetched jwks %d times, want 2", fetches)
+	}
+}
+
+func TestOidcMicrosoftTenantIssuer(t *testing.T) {
+	mock := newMockOidcProvider(t)
+	mock.issuer = mock.server.URL + "/{tenantid}/v2.0"
+	provider := mock.newProvider(true)
+
+	tests := []struct {
+		name   string
+		issuer string
+		tid    string
+		valid  bool
+	}{
+		{"issuer of the user's tenant", mock.server.URL + "/tenant-1/v2.0", "tenant-1", true},
+		{"issuer of another tenant", mock.server.URL + "/tenant-2/v2.0", "tenant-1", false},
+		{"placeholder left in", mock.server.URL + "/{tenantid}/v2.0", "", false},
+	}
+
+	for _, test := range tests {
+		claims := mock.validClaims()
+		claims["iss"] = test.issuer
+		claims["tid"] = test.tid
+		mock.setClaims(claims)
+
+		_, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: error = %v, want valid %t", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestOidcEmailVerified(t *testing.T) {
+	tests := []struct {
+		name       string
+		claim      interface{}
+		trustEmail bool
+		verified   bool
+	}{
+		{"true", true, false, true},
+		{"false", false, true, false},
+		{"string true", "true", false, true},
+		{"string false", "false", false, false},
+		{"missing", nil, false, false},
+		{"missing but trusted", nil, true, true},
+	}
+
+	mock := newMockOidcProvider(t)
+
+	for _, test := range tests {
+		provider := mock.newProvider(test.trustEmail)
+
+		claims := mock.validClaims()
+		delete(claims, "email_verified")
+		if test.claim != nil {
+			claims["email_verified"] = test.claim
+		}
+		mock.setClaims(claims)
+
+		identity, err := provider.Exchange(context.Background(), "test-code", TEST_OIDC_CODE_VERIFIER, TEST_OIDC_NONCE)
+		if err != nil {
+			t.Errorf("%s: error exchanging code: %s", test.name, err)
+			continue
+		}
+
+		if identity.EmailVerified != test.verified {
+			t.Errorf("%s: email verified = %t, want %t", test.name, identity.EmailVerified, test.verified)
+		}
+	}
+}
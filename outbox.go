@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Outbox message kinds. A click fans out into email and webhook messages, one for
+// each recipient and endpoint, so each is retried on its own.
+const OUTBOX_KIND_CLICK = "click"
+const OUTBOX_KIND_EMAIL = "email"
+const OUTBOX_KIND_WEBHOOK = "webhook"
+
+const OUTBOX_MAX_RETRY_DELAY = 6 * time.Hour
+const OUTBOX_MAX_ERROR_LENGTH = 500
+
+// Delivered messages are swept up at most this often, rather than on every poll.
+const OUTBOX_SWEEP_INTERVAL = time.Hour
+const OUTBOX_SWEEP_TIMEOUT = time.Minute
+
+func newOutboxMessage(kind string, payload any) (OutboxMessage, error) {
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return OutboxMessage{}, fmt.Errorf("error encoding %s message: %s", kind, err)
+	}
+
+	return OutboxMessage{Kind: kind, Payload: encoded}, nil
+}
+
+// OutboxHandler delivers a message, returning the messages it leads to. These are
+// queued when the message is marked delivered.
+type OutboxHandler func(ctx context.Context, message OutboxMessage) ([]OutboxMessage, error)
+
+// OutboxDispatcher delivers the messages queued in the outbox table. It polls for
+// messages that are due, and can be woken to pick up new ones straight away. Failed
+// messages are retried with exponential backoff until they're dead-lettered after
+// maxAttempts, when only replaying them from the admin API sends them again.
+// Delivered messages and webhook deliveries are deleted once they're older than
+// retention.
+type OutboxDispatcher struct {
+	database     Database
+	handlers     map[string]OutboxHandler
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	retryBase    time.Duration
+	lockTtl      time.Duration
+	retention    time.Duration
+	sweptAt      time.Time
+
+	messages chan OutboxMessage
+	wake     chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newOutboxDispatcher(database Database, config *Config, handlers map[string]OutboxHandler) *OutboxDispatcher {
+	d := &OutboxDispatcher{
+		database:     database,
+		handlers:     handlers,
+		pollInterval: config.OutboxPollInterval,
+		batchSize:    config.OutboxBatchSize,
+		maxAttempts:  config.OutboxMaxAttempts,
+		retryBase:    config.OutboxRetryBase,
+		lockTtl:      config.OutboxLockTtl,
+		retention:    config.OutboxRetention,
+		messages:     make(chan OutboxMessage),
+		wake:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+
+	d.wg.Add(1)
+	go d.poll()
+
+	for i := 0; i < config.OutboxWorkers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+
+	return d
+}
+
+// Wake has the dispatcher check for messages now rather than at the next poll.
+func (d *OutboxDispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *OutboxDispatcher) poll() {
+	defer d.wg.Done()
+	defer close(d.messages)
+
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.sweep()
+
+		claimed := d.claim()
+
+		// a full batch means there are probably more waiting
+		if claimed < d.batchSize {
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			case <-d.wake:
+			}
+		}
+
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+	}
+}
+
+// claim hands the messages that are due to the workers, returning how many there were.
+// Any still claimed when the dispatcher stops are picked up again once their lock
+// runs out.
+func (d *OutboxDispatcher) claim() int {
+	ctx, cancel := context.WithTimeout(context.Background(), d.pollInterval+10*time.Second)
+	messages, err := d.database.ClaimOutboxMessages(ctx, d.batchSize, d.lockTtl)
+	cancel()
+
+	if err != nil {
+		log.Println("error claiming outbox messages: ", err)
+		return 0
+	}
+
+	for _, message := range messages {
+		select {
+		case d.messages <- message:
+		case <-d.stop:
+			return len(messages)
+		}
+	}
+
+	return len(messages)
+}
+
+// sweep deletes what's older than retention, if it's been OUTBOX_SWEEP_INTERVAL since
+// the last time. Each instance's dispatcher sweeps, and the later ones find nothing
+// left to delete.
+func (d *OutboxDispatcher) sweep() {
+	if time.Since(d.sweptAt) < OUTBOX_SWEEP_INTERVAL {
+		return
+	}
+
+	d.sweptAt = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), OUTBOX_SWEEP_TIMEOUT)
+	result, err := d.database.DeleteOldOutboxMessages(ctx, d.retention)
+	cancel()
+
+	if err != nil {
+		log.Println("error deleting old outbox messages: ", err)
+		return
+	}
+
+	if result.Messages > 0 || result.Deliveries > 0 {
+		log.Printf("deleted %d delivered outbox messages and %d webhook deliveries older than %s", result.Messages, result.Deliveries, d.retention)
+	}
+}
+
+func (d *OutboxDispatcher) work() {
+	defer d.wg.Done()
+
+	for message := range d.messages {
+		d.dispatch(message)
+	}
+}
+
+// dispatch gives the handler until the message's lock runs out, so it isn't claimed
+// again while it's still being delivered.
+func (d *OutboxDispatcher) dispatch(message OutboxMessage) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.lockTtl)
+	defer cancel()
+
+	handler, found := d.handlers[message.Kind]
+	if !found {
+		d.fail(ctx, message, fmt.Errorf("no handler for %s messages", message.Kind), true)
+		return
+	}
+
+	followUps, err := handler(ctx, message)
+	if err != nil {
+		d.fail(ctx, message, err, message.Attempts >= d.maxAttempts)
+		return
+	}
+
+	err = d.database.CompleteOutboxMessage(ctx, message.Id, followUps)
+	if err != nil {
+		log.Printf("error completing %s message %s: %s", message.Kind, message.Id, err)
+		return
+	}
+
+	if len(followUps) > 0 {
+		d.Wake()
+	}
+}
+
+func (d *OutboxDispatcher) fail(ctx context.Context, message OutboxMessage, cause error, deadLetter bool) {
+	request := FailOutboxMessageRequest{
+		MessageId:  message.Id,
+		Error:      truncateString(cause.Error(), OUTBOX_MAX_ERROR_LENGTH),
+		RetryIn:    d.retryDelay(message.Attempts),
+		DeadLetter: deadLetter,
+	}
+
+	if deadLetter {
+		log.Printf("dead-lettering %s message %s after %d attempts: %s", message.Kind, message.Id, message.Attempts, cause)
+	} else {
+		log.Printf("error delivering %s message %s, retrying in %s: %s", message.Kind, message.Id, request.RetryIn, cause)
+	}
+
+	err := d.database.FailOutboxMessage(ctx, request)
+	if err != nil {
+		log.Printf("error failing %s message %s: %s", message.Kind, message.Id, err)
+	}
+}
+
+// retryDelay waits retryBase after the first attempt, then twice that, and so on up
+// to OUTBOX_MAX_RETRY_DELAY.
+func (d *OutboxDispatcher) retryDelay(attempts int) time.Duration {
+	delay := d.retryBase
+	for i := 1; i < attempts && delay < OUTBOX_MAX_RETRY_DELAY; i++ {
+		delay *= 2
+	}
+
+	return min(delay, OUTBOX_MAX_RETRY_DELAY)
+}
+
+// Shutdown stops claiming messages and waits for the ones being delivered, giving up
+// when ctx is done.
+func (d *OutboxDispatcher) Shutdown(ctx context.Context) error {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("outbox dispatcher not stopped: %s", ctx.Err())
+	}
+}
+
+func (r *Controller) outboxHandlers() map[string]OutboxHandler {
+	return map[string]OutboxHandler{
+		OUTBOX_KIND_CLICK:   r.handleClickMessage,
+		OUTBOX_KIND_EMAIL:   r.handleEmailMessage,
+		OUTBOX_KIND_WEBHOOK: r.WebhookNotifier.HandleMessage,
+	}
+}
+
+// handleClickMessage asks every channel for the messages to send about the click.
+// If any channel fails none of them are queued, and the click is tried again.
+func (r *Controller) handleClickMessage(ctx context.Context, message OutboxMessage) ([]OutboxMessage, error) {
+	notification := ClickNotification{}
+	err := json.Unmarshal(message.Payload, &notification)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding click notification: %s", err)
+	}
+
+	messages := []OutboxMessage{}
+	for _, notifier := range r.Notifiers {
+		notifierMessages, err := notifier.ClickMessages(ctx, notification)
+		if err != nil {
+			return nil, fmt.Errorf("error getting %s messages: %s", notifier.Name(), err)
+		}
+
+		messages = append(messages, notifierMessages...)
+	}
+
+	return messages, nil
+}
+
+// queueEmail writes an email that doesn't go with any other change to the outbox, so
+// it's retried like the rest.
+func (r *Controller) queueEmail(ctx context.Context, ser SendEmailRequest) error {
+	message, err := newOutboxMessage(OUTBOX_KIND_EMAIL, ser)
+	if err != nil {
+		return err
+	}
+
+	err = r.Database.AddOutboxMessages(ctx, []OutboxMessage{message})
+	if err != nil {
+		return err
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	return nil
+}
+
+func (r *Controller) handleEmailMessage(ctx context.Context, message OutboxMessage) ([]OutboxMessage, error) {
+	ser := SendEmailRequest{}
+	err := json.Unmarshal(message.Payload, &ser)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding email: %s", err)
+	}
+
+	err = r.Emailer.SendEmail(ser)
+	if err != nil {
+		return nil, fmt.Errorf("error sending email to %s: %s", ser.Email, err)
+	}
+
+	return nil, nil
+}
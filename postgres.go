@@ -2,49 +2,107 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strconv"
+	"time"
 
 	pgx "github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-func getPostgresDb() *Postgres {
-	var err error
+func getPostgresDb(ctx context.Context, config *Config) *Postgres {
+	poolConfig, err := pgxpool.ParseConfig(config.DatabaseUrl)
+	if err != nil {
+		log.Fatal("couldn't parse database url: ", err)
+	}
+
+	poolConfig.MaxConns = int32(config.DbMaxConns)
+	poolConfig.HealthCheckPeriod = config.DbHealthCheckPeriod
+
+	// enforced server side, so a query that's stuck also frees up its pool connection
+	poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(config.DbStatementTimeout.Milliseconds(), 10)
 
-	db, err := pgx.Connect(context.Background(), getEnv("DATABASE_URL"))
+	pool, err := pgxpool.NewWithConfig(ctx, poolConfig)
 	if err != nil {
-		log.Fatal("couldn't open database connection: ", err)
+		log.Fatal("couldn't open database connection pool: ", err)
 	}
 
-	err = db.Ping(context.Background())
+	err = pool.Ping(ctx)
 	if err != nil {
 		log.Fatal("error connecting to database: ", err)
 	}
 
-	return &Postgres{client: db}
+	return &Postgres{client: pool}
 }
 
 type Postgres struct {
-	client *pgx.Conn
+	client *pgxpool.Pool
 }
 
-func (p *Postgres) Close() error {
-	return p.client.Close(context.Background())
+// Close waits for connections in use to be released, giving up when ctx is done.
+func (p *Postgres) Close(ctx context.Context) error {
+	closed := make(chan struct{})
+	go func() {
+		p.client.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("database pool not closed: %s", ctx.Err())
+	}
 }
 
-func (p *Postgres) UserIdExists(ctx context.Context, userId string) (bool, error) {
-	var count int
-	err := p.client.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE user_id = $1", userId).Scan(&count)
+func (p *Postgres) Ping(ctx context.Context) error {
+	return p.client.Ping(ctx)
+}
 
+func (p *Postgres) GetMigrationVersion(ctx context.Context) (uint, bool, error) {
+	var version int64
+	var dirty bool
+	err := p.client.QueryRow(ctx, "SELECT version, dirty FROM schema_migrations LIMIT 1").Scan(&version, &dirty)
 	if err != nil {
-		return false, fmt.Errorf("count query error: %s", err)
+		return 0, false, fmt.Errorf("error reading schema_migrations: %s", err)
 	}
 
-	if count > 0 {
-		return true, nil
+	return uint(version), dirty, nil
+}
+
+const userColumns = `u.user_id, u.email, COALESCE(u.password_hash, ''), u.is_verified, u.tokens_valid_after, COALESCE(u.totp_secret, ''), u.totp_enabled_at IS NOT NULL,
+	COALESCE(GREATEST(EXTRACT(EPOCH FROM u.locked_until - CURRENT_TIMESTAMP), 0), 0)::float8, u.is_admin, u.locale`
+
+func scanUser(row pgx.Row, user *UserRecordInDatabase) error {
+	var lockedForSeconds float64
+	err := row.Scan(&user.Id, &user.Email, &user.HashedPassword, &user.IsVerified, &user.TokensValidAfter, &user.TotpSecret, &user.TotpEnabled, &lockedForSeconds, &user.IsAdmin, &user.Locale)
+	user.LockedFor = secondsToDuration(lockedForSeconds)
+	return err
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func (p *Postgres) GetUserById(ctx context.Context, userId string) (ResultForGetUserRequest, error) {
+	result := ResultForGetUserRequest{}
+	sql := "SELECT " + userColumns + " FROM users u WHERE u.user_id = $1"
+	err := scanUser(p.client.QueryRow(ctx, sql, userId), &result.User)
+
+	if err == pgx.ErrNoRows {
+		result.Found = false
+		return result, nil
 	}
 
-	return false, nil
+	if err != nil {
+		return result, fmt.Errorf("error getting user from database: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
 }
 
 func (p *Postgres) EmailExists(ctx context.Context, email string) (bool, error) {
@@ -63,17 +121,65 @@ func (p *Postgres) EmailExists(ctx context.Context, email string) (bool, error)
 }
 
 func (p *Postgres) CreateUser(ctx context.Context, request CreateUserRequest) error {
-	_, err := p.client.Exec(ctx, "INSERT INTO users (email, password_hash, verification_code) VALUES ($1, $2, $3)", request.Email, request.Password, request.VerificationCode)
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId string
+	sql := `
+		INSERT INTO users (email, password_hash, verification_code, verification_code_expires_at, verification_sent_at, locale)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * interval '1 second', CURRENT_TIMESTAMP, $5)
+		RETURNING user_id
+	`
+	err = tx.QueryRow(ctx, sql, request.Email, request.Password, request.VerificationCode, request.VerificationCodeTtl.Seconds(), request.Locale).Scan(&userId)
 	if err != nil {
 		return fmt.Errorf("error inserting in users table: %s", err)
 	}
 
+	err = createPersonalWorkspace(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+
+	err = queueEmail(ctx, tx, request.VerificationEmail)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// createPersonalWorkspace gives a new user the workspace their links go in by default.
+func createPersonalWorkspace(ctx context.Context, tx pgx.Tx, userId string) error {
+	sql := `
+		WITH workspace AS (
+			INSERT INTO workspaces (name, is_personal, created_by)
+			VALUES ('Personal', true, $1)
+			RETURNING workspace_id
+		)
+		INSERT INTO workspace_members (workspace_id, user_id, role)
+		SELECT workspace_id, $1, $2 FROM workspace
+	`
+
+	_, err := tx.Exec(ctx, sql, userId, WORKSPACE_ROLE_OWNER)
+	if err != nil {
+		return fmt.Errorf("error creating personal workspace: %s", err)
+	}
+
 	return nil
 }
 
 func (p *Postgres) GetUser(ctx context.Context, email string) (ResultForGetUserRequest, error) {
 	result := ResultForGetUserRequest{}
-	err := p.client.QueryRow(ctx, "SELECT user_id, password_hash, is_verified FROM users WHERE email = $1", email).Scan(&result.User.Id, &result.User.HashedPassword, &result.User.IsVerified)
+	sql := "SELECT " + userColumns + " FROM users u WHERE u.email = $1"
+	err := scanUser(p.client.QueryRow(ctx, sql, email), &result.User)
 
 	if err == pgx.ErrNoRows {
 		result.Found = false
@@ -91,10 +197,10 @@ func (p *Postgres) GetUser(ctx context.Context, email string) (ResultForGetUserR
 
 func (p *Postgres) AddRedirect(ctx context.Context, request AddRedirectRequest) error {
 	sql := `
-		INSERT INTO links (user_id, original_url, redirect_path, tag)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO links (user_id, workspace_id, original_url, redirect_path, tag)
+		VALUES ($1, $2, $3, $4, $5)
 	`
-	tag, err := p.client.Exec(ctx, sql, request.UserId, request.Url, request.Path, request.Tag)
+	tag, err := p.client.Exec(ctx, sql, request.UserId, request.WorkspaceId, request.Url, request.Path, request.Tag)
 
 	if err != nil {
 		return err
@@ -107,33 +213,37 @@ func (p *Postgres) AddRedirect(ctx context.Context, request AddRedirectRequest)
 	return nil
 }
 
-func (p *Postgres) GetRedirectUrl(ctx context.Context, path string) (string, error) {
-	var url string
-	sql := `
-		SELECT original_url
-		FROM links l
-		WHERE redirect_path = $1
-	`
-	err := p.client.QueryRow(ctx, sql, path).Scan(&url)
-	return url, err
-}
+// memberRecipients selects the notification recipients who are still members of the
+// workspace, so someone who leaves, or changes their email, stops getting alerts.
+const memberRecipients = `
+	SELECT u.email
+		FROM workspace_notification_recipients r
+		JOIN users u ON lower(u.email) = lower(r.email)
+		JOIN workspace_members m ON m.user_id = u.user_id AND m.workspace_id = r.workspace_id`
 
+// GetRedirectRecord includes who to notify of clicks: the workspace's list of
+// recipients, or else whoever created the link.
 func (p *Postgres) GetRedirectRecord(ctx context.Context, path string) (RedirectRecord, error) {
 	record := RedirectRecord{}
 	sql := `
-		SELECT l.original_url, u.email, COUNT(c.click_id), l.tag, l.link_id
+		SELECT l.original_url,
+			CASE WHEN w.notify_mode = 'list'
+				THEN ARRAY(` + memberRecipients + ` WHERE r.workspace_id = w.workspace_id ORDER BY u.email)
+				ELSE ARRAY(SELECT u.email FROM users u WHERE u.user_id = l.user_id AND u.email IS NOT NULL)
+			END,
+			l.click_count, COALESCE(l.tag, ''), l.link_id, l.workspace_id, COALESCE(l.user_id::text, '')
 			FROM links l
-			JOIN users u on l.user_id = u.user_id
-			LEFT JOIN clicks c on l.link_id = c.link_id
-		WHERE redirect_path = $1
-		GROUP BY l.original_url, u.email, l.tag, l.link_id
+			JOIN workspaces w ON l.workspace_id = w.workspace_id
+		WHERE redirect_path = $1 AND l.deleted_at IS NULL
 	`
 	err := p.client.QueryRow(ctx, sql, path).Scan(
 		&record.RedirectUrl,
-		&record.UserEmail,
+		&record.NotifyEmails,
 		&record.NumberOfTimesClicked,
 		&record.Tag,
 		&record.LinkId,
+		&record.WorkspaceId,
+		&record.CreatedBy,
 	)
 
 	record.Path = path
@@ -141,32 +251,2097 @@ func (p *Postgres) GetRedirectRecord(ctx context.Context, path string) (Redirect
 	return record, err
 }
 
-func (p *Postgres) AddLinkClick(ctx context.Context, linkId string) error {
-	sql := `INSERT INTO clicks (link_id) VALUES ($1)`
+// AddLinkClick records the click and returns the link's click count including it.
+// Bot clicks are stored but don't count towards click_count.
+func (p *Postgres) AddLinkClick(ctx context.Context, request AddLinkClickRequest) (int, error) {
+	var notification any
+	if request.Notification != nil {
+		payload, err := json.Marshal(request.Notification)
+		if err != nil {
+			return 0, fmt.Errorf("error encoding click notification: %s", err)
+		}
+		notification = payload
+	}
+
+	sql := `
+		WITH inserted AS (
+			INSERT INTO clicks (
+				link_id, referrer, user_agent, ip_address, accept_language, is_bot,
+				country_code, region, city, device_type, browser, os, clicked_on
+			)
+			VALUES (
+				$1, $2, $3, $4, $5, $6,
+				NULLIF($7, ''), NULLIF($8, ''), NULLIF($9, ''), NULLIF($10, ''), NULLIF($11, ''), NULLIF($12, ''), $13
+			)
+			RETURNING link_id
+		),
+		updated AS (
+			UPDATE links
+			SET click_count = click_count + CASE WHEN $6 THEN 0 ELSE 1 END
+			WHERE link_id = (SELECT link_id FROM inserted)
+			RETURNING click_count
+		),
+		queued AS (
+			INSERT INTO outbox (kind, payload)
+			SELECT $15, jsonb_set($14::jsonb, '{ClickCount}', to_jsonb(click_count))
+				FROM updated
+			WHERE $14::jsonb IS NOT NULL
+		)
+		SELECT click_count FROM updated
+	`
+
+	var clickCount int
+	err := p.client.QueryRow(ctx, sql,
+		request.LinkId,
+		request.Referrer,
+		request.UserAgent,
+		request.IpAddress,
+		request.AcceptLanguage,
+		request.IsBot,
+		request.Location.CountryCode,
+		request.Location.Region,
+		request.Location.City,
+		request.Device.DeviceType,
+		request.Device.Browser,
+		request.Device.OS,
+		request.ClickedOn,
+		notification,
+		OUTBOX_KIND_CLICK,
+	).Scan(&clickCount)
+
+	if err != nil {
+		return 0, fmt.Errorf("error executing query: %s", err)
+	}
+
+	return clickCount, nil
+}
+
+// ConfirmEmailVerified verifies the user with the code and clears it so it can't be
+// used again. The code itself is kept when expired, to tell expired and unknown apart.
+func (p *Postgres) ConfirmEmailVerified(ctx context.Context, code string) (string, error) {
+	sql := `
+		UPDATE users
+		SET is_verified = true, verification_code = NULL, verification_code_expires_at = NULL
+		WHERE verification_code = $1 AND verification_code_expires_at > CURRENT_TIMESTAMP
+	`
 
-	tag, err := p.client.Exec(ctx, sql, linkId)
+	tag, err := p.client.Exec(ctx, sql, code)
 	if err != nil {
-		return fmt.Errorf("error executing query: %s", err)
+		return "", err
 	}
 
-	if affected := tag.RowsAffected(); affected != 1 {
-		return fmt.Errorf("expected 1 row to be affected, got %d", affected)
+	if tag.RowsAffected() == 1 {
+		return VERIFICATION_CONFIRMED, nil
 	}
 
-	return nil
+	var count int
+	err = p.client.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE verification_code = $1", code).Scan(&count)
+	if err != nil {
+		return "", fmt.Errorf("count query error: %s", err)
+	}
+
+	if count > 0 {
+		return VERIFICATION_CODE_EXPIRED, nil
+	}
+
+	return VERIFICATION_CODE_UNKNOWN, nil
 }
 
-func (p *Postgres) ConfirmEmailVerified(ctx context.Context, code string) error {
-	sql := `UPDATE users SET is_verified = true WHERE verification_code = $1`
+// RefreshVerificationCode gives an unverified user a new code, unless one was sent
+// within the cooldown. Returns whether a new code was set and its email queued.
+func (p *Postgres) RefreshVerificationCode(ctx context.Context, request RefreshVerificationCodeRequest) (bool, error) {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
 
-	tag, err := p.client.Exec(ctx, sql, code)
+	sql := `
+		UPDATE users
+		SET verification_code = $2,
+			verification_code_expires_at = CURRENT_TIMESTAMP + $3 * interval '1 second',
+			verification_sent_at = CURRENT_TIMESTAMP
+		WHERE email = $1
+			AND NOT is_verified
+			AND (verification_sent_at IS NULL OR verification_sent_at < CURRENT_TIMESTAMP - $4 * interval '1 second')
+	`
+
+	tag, err := tx.Exec(ctx, sql, request.Email, request.VerificationCode, request.Ttl.Seconds(), request.Cooldown.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("error refreshing verification code: %s", err)
+	}
+
+	if tag.RowsAffected() != 1 {
+		return false, nil
+	}
+
+	err = queueEmail(ctx, tx, request.VerificationEmail)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return true, nil
+}
+
+const linkColumns = `link_id, COALESCE(user_id::text, ''), original_url, redirect_path, COALESCE(tag, ''), created_at`
+
+func scanLink(row pgx.Row, link *LinkRecord) error {
+	return row.Scan(&link.Id, &link.CreatedBy, &link.Url, &link.Path, &link.Tag, &link.CreatedAt)
+}
+
+func (p *Postgres) GetLinks(ctx context.Context, request GetLinksRequest) (ResultForGetLinksRequest, error) {
+	result := ResultForGetLinksRequest{Links: []LinkRecord{}}
+
+	filter := `
+		WHERE workspace_id = $1
+			AND deleted_at IS NULL
+			AND ($2::text IS NULL OR tag = $2)
+			AND ($3::timestamp IS NULL OR created_at >= $3)
+			AND ($4::timestamp IS NULL OR created_at < $4)
+	`
+	args := []any{request.WorkspaceId, request.Tag, request.CreatedAfter, request.CreatedBefore}
+
+	err := p.client.QueryRow(ctx, "SELECT COUNT(*) FROM links"+filter, args...).Scan(&result.Total)
+	if err != nil {
+		return result, fmt.Errorf("count query error: %s", err)
+	}
+
+	sql := "SELECT " + linkColumns + " FROM links" + filter + "ORDER BY created_at DESC, link_id LIMIT $5 OFFSET $6"
+
+	rows, err := p.client.Query(ctx, sql, append(args, request.Limit, request.Offset)...)
+	if err != nil {
+		return result, fmt.Errorf("error querying links: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		link := LinkRecord{}
+		if err := scanLink(rows, &link); err != nil {
+			return result, fmt.Errorf("error scanning link: %s", err)
+		}
+		result.Links = append(result.Links, link)
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error reading links: %s", err)
+	}
+
+	return result, nil
+}
+
+func (p *Postgres) GetLink(ctx context.Context, workspaceId string, linkId string) (ResultForGetLinkRequest, error) {
+	sql := "SELECT " + linkColumns + " FROM links WHERE link_id = $1 AND workspace_id = $2 AND deleted_at IS NULL"
+	return getLinkResult(p.client.QueryRow(ctx, sql, linkId, workspaceId))
+}
+
+func (p *Postgres) UpdateLink(ctx context.Context, request UpdateLinkRequest) (ResultForGetLinkRequest, error) {
+	sql := `
+		UPDATE links
+		SET original_url = COALESCE($3, original_url), tag = COALESCE($4, tag)
+		WHERE link_id = $1 AND workspace_id = $2 AND deleted_at IS NULL
+		RETURNING ` + linkColumns
+
+	return getLinkResult(p.client.QueryRow(ctx, sql, request.LinkId, request.WorkspaceId, request.Url, request.Tag))
+}
+
+func (p *Postgres) DeleteLink(ctx context.Context, workspaceId string, linkId string) (ResultForGetLinkRequest, error) {
+	sql := `
+		UPDATE links
+		SET deleted_at = CURRENT_TIMESTAMP
+		WHERE link_id = $1 AND workspace_id = $2 AND deleted_at IS NULL
+		RETURNING ` + linkColumns
+
+	return getLinkResult(p.client.QueryRow(ctx, sql, linkId, workspaceId))
+}
+
+func getLinkResult(row pgx.Row) (ResultForGetLinkRequest, error) {
+	result := ResultForGetLinkRequest{}
+	err := scanLink(row, &result.Link)
+
+	if err == pgx.ErrNoRows {
+		result.Found = false
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error getting link from database: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+func (p *Postgres) GetLinkStats(ctx context.Context, request LinkStatsRequest) (ResultForGetLinkStatsRequest, error) {
+	result := ResultForGetLinkStatsRequest{}
+	stats := &result.Stats
+
+	sql := `
+		SELECT COUNT(c.click_id), MIN(c.clicked_on), MAX(c.clicked_on)
+			FROM links l
+			LEFT JOIN clicks c ON l.link_id = c.link_id AND NOT c.is_bot
+		WHERE l.link_id = $1 AND l.workspace_id = $2 AND l.deleted_at IS NULL
+		GROUP BY l.link_id
+	`
+	err := p.client.QueryRow(ctx, sql, request.LinkId, request.WorkspaceId).Scan(&stats.TotalClicks, &stats.FirstClickAt, &stats.LastClickAt)
+
+	if err == pgx.ErrNoRows {
+		result.Found = false
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error getting click totals: %s", err)
+	}
+
+	result.Found = true
+
+	sql = `
+		SELECT b.bucket, COUNT(c.click_id)
+			FROM generate_series(
+				date_trunc($2::text, $3::timestamp),
+				$4::timestamp - interval '1 microsecond',
+				('1 ' || $2::text)::interval
+			) AS b(bucket)
+			LEFT JOIN clicks c ON c.link_id = $1
+				AND NOT c.is_bot
+				AND c.clicked_on >= b.bucket
+				AND c.clicked_on < b.bucket + ('1 ' || $2::text)::interval
+				AND c.clicked_on >= $3
+				AND c.clicked_on < $4
+		GROUP BY b.bucket
+		ORDER BY b.bucket
+	`
+	rows, err := p.client.Query(ctx, sql, request.LinkId, request.Interval, request.From, request.To)
+	if err != nil {
+		return result, fmt.Errorf("error querying click buckets: %s", err)
+	}
+	defer rows.Close()
+
+	stats.Buckets = []ClickBucket{}
+	for rows.Next() {
+		bucket := ClickBucket{}
+		if err := rows.Scan(&bucket.Start, &bucket.Clicks); err != nil {
+			return result, fmt.Errorf("error scanning click bucket: %s", err)
+		}
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error reading click buckets: %s", err)
+	}
+
+	breakdowns := map[string]*[]ClickBreakdown{
+		"country_code": &stats.Countries,
+		"device_type":  &stats.DeviceTypes,
+		"browser":      &stats.Browsers,
+		"os":           &stats.OSes,
+	}
+
+	for column, breakdown := range breakdowns {
+		*breakdown, err = p.getClickBreakdown(ctx, column, request)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// getClickBreakdown counts the link's clicks in the requested range grouped by column,
+// which is interpolated into the query and so must only ever be a constant.
+func (p *Postgres) getClickBreakdown(ctx context.Context, column string, request LinkStatsRequest) ([]ClickBreakdown, error) {
+	sql := `
+		SELECT COALESCE(` + column + `, ''), COUNT(*)
+			FROM clicks
+		WHERE link_id = $1 AND NOT is_bot AND clicked_on >= $2 AND clicked_on < $3
+		GROUP BY 1
+		ORDER BY 2 DESC, 1
+	`
+	rows, err := p.client.Query(ctx, sql, request.LinkId, request.From, request.To)
+	if err != nil {
+		return nil, fmt.Errorf("error querying clicks by %s: %s", column, err)
+	}
+	defer rows.Close()
+
+	breakdown := []ClickBreakdown{}
+	for rows.Next() {
+		item := ClickBreakdown{}
+		if err := rows.Scan(&item.Value, &item.Clicks); err != nil {
+			return nil, fmt.Errorf("error scanning clicks by %s: %s", column, err)
+		}
+		breakdown = append(breakdown, item)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading clicks by %s: %s", column, err)
+	}
+
+	return breakdown, nil
+}
+
+func (p *Postgres) CreatePasswordResetToken(ctx context.Context, request CreatePasswordResetTokenRequest) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		VALUES ($1, $2, CURRENT_TIMESTAMP + $3 * interval '1 second')
+	`
+
+	_, err = tx.Exec(ctx, sql, request.UserId, request.TokenHash, request.Ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("error inserting in password_reset_tokens table: %s", err)
+	}
+
+	err = queueEmail(ctx, tx, request.ResetEmail)
 	if err != nil {
 		return err
 	}
 
-	if affected := tag.RowsAffected(); affected != 1 {
-		return fmt.Errorf("expected 1 row to be affected, got %d", affected)
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
 	}
 
 	return nil
 }
+
+// ResetPassword uses up the token and sets the new password, returning false when
+// the token is unknown, expired or already used. Any other outstanding reset tokens
+// are used up too, tokens issued before the reset stop being accepted and the user's
+// API keys are revoked.
+func (p *Postgres) ResetPassword(ctx context.Context, request ResetPasswordRequest) (bool, error) {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId string
+	sql := `
+		UPDATE password_reset_tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id
+	`
+	err = tx.QueryRow(ctx, sql, request.TokenHash).Scan(&userId)
+
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("error using password reset token: %s", err)
+	}
+
+	sql = `
+		UPDATE users
+		SET password_hash = $2, tokens_valid_after = CURRENT_TIMESTAMP, failed_login_attempts = 0, locked_until = NULL
+		WHERE user_id = $1
+	`
+	_, err = tx.Exec(ctx, sql, userId, request.HashedPassword)
+	if err != nil {
+		return false, fmt.Errorf("error updating password: %s", err)
+	}
+
+	sql = `UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`
+	_, err = tx.Exec(ctx, sql, userId)
+	if err != nil {
+		return false, fmt.Errorf("error invalidating other password reset tokens: %s", err)
+	}
+
+	sql = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err = tx.Exec(ctx, sql, userId)
+	if err != nil {
+		return false, fmt.Errorf("error revoking sessions: %s", err)
+	}
+
+	sql = `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err = tx.Exec(ctx, sql, userId)
+	if err != nil {
+		return false, fmt.Errorf("error revoking API keys: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return true, nil
+}
+
+func (p *Postgres) CreateSession(ctx context.Context, request CreateSessionRequest) (string, error) {
+	var sessionId string
+	sql := `
+		INSERT INTO sessions (user_id, refresh_token_hash, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, CURRENT_TIMESTAMP + $5 * interval '1 second')
+		RETURNING session_id
+	`
+	err := p.client.QueryRow(ctx, sql, request.UserId, request.RefreshTokenHash, request.UserAgent, request.IpAddress, request.Ttl.Seconds()).Scan(&sessionId)
+	if err != nil {
+		return "", fmt.Errorf("error inserting in sessions table: %s", err)
+	}
+
+	return sessionId, nil
+}
+
+// RotateSession swaps the session's refresh token for a new one and extends it. A
+// refresh token that was already rotated away being presented again means it
+// leaked, so the session it belonged to is revoked.
+func (p *Postgres) RotateSession(ctx context.Context, request RotateSessionRequest) (ResultForGetSessionRequest, error) {
+	result := ResultForGetSessionRequest{}
+	sql := `
+		UPDATE sessions
+		SET previous_refresh_token_hash = refresh_token_hash,
+			refresh_token_hash = $2,
+			last_used_at = CURRENT_TIMESTAMP,
+			expires_at = CURRENT_TIMESTAMP + $3 * interval '1 second'
+		WHERE refresh_token_hash = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING ` + sessionColumns
+
+	err := scanSession(p.client.QueryRow(ctx, sql, request.RefreshTokenHash, request.NewRefreshTokenHash, request.Ttl.Seconds()), &result.Session)
+
+	if err == nil {
+		result.Found = true
+		return result, nil
+	}
+
+	if err != pgx.ErrNoRows {
+		return result, fmt.Errorf("error rotating session: %s", err)
+	}
+
+	sql = `
+		UPDATE sessions
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE previous_refresh_token_hash = $1 AND revoked_at IS NULL
+	`
+	tag, err := p.client.Exec(ctx, sql, request.RefreshTokenHash)
+	if err != nil {
+		return result, fmt.Errorf("error revoking session with reused refresh token: %s", err)
+	}
+
+	if tag.RowsAffected() > 0 {
+		log.Println("revoked session as its previous refresh token was reused")
+	}
+
+	return result, nil
+}
+
+func (p *Postgres) GetSessionUser(ctx context.Context, sessionId string) (ResultForGetUserRequest, error) {
+	result := ResultForGetUserRequest{}
+	sql := `
+		SELECT ` + userColumns + `
+			FROM sessions s
+			JOIN users u ON s.user_id = u.user_id
+		WHERE s.session_id = $1 AND s.revoked_at IS NULL AND s.expires_at > CURRENT_TIMESTAMP
+	`
+	err := scanUser(p.client.QueryRow(ctx, sql, sessionId), &result.User)
+
+	if err == pgx.ErrNoRows {
+		result.Found = false
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error getting session user from database: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+const sessionColumns = `session_id, user_id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, expires_at`
+
+func scanSession(row pgx.Row, session *SessionRecord) error {
+	return row.Scan(&session.Id, &session.UserId, &session.UserAgent, &session.IpAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt)
+}
+
+func (p *Postgres) GetSessions(ctx context.Context, userId string) ([]SessionRecord, error) {
+	sql := `
+		SELECT ` + sessionColumns + `
+			FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_used_at DESC
+	`
+	rows, err := p.client.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying sessions: %s", err)
+	}
+	defer rows.Close()
+
+	sessions := []SessionRecord{}
+	for rows.Next() {
+		session := SessionRecord{}
+		if err := scanSession(rows, &session); err != nil {
+			return nil, fmt.Errorf("error scanning session: %s", err)
+		}
+		sessions = append(sessions, session)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading sessions: %s", err)
+	}
+
+	return sessions, nil
+}
+
+// IsRecentSession is whether the session was logged in within maxAge. Refreshing it
+// doesn't count, as that keeps its created_at.
+func (p *Postgres) IsRecentSession(ctx context.Context, sessionId string, maxAge time.Duration) (bool, error) {
+	var recent bool
+	sql := `
+		SELECT created_at > CURRENT_TIMESTAMP - $2 * interval '1 second'
+			FROM sessions
+		WHERE session_id = $1 AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	`
+	err := p.client.QueryRow(ctx, sql, sessionId, maxAge.Seconds()).Scan(&recent)
+
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("error checking session age: %s", err)
+	}
+
+	return recent, nil
+}
+
+func (p *Postgres) RevokeSession(ctx context.Context, userId string, sessionId string) (bool, error) {
+	sql := `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE session_id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	tag, err := p.client.Exec(ctx, sql, sessionId, userId)
+	if err != nil {
+		return false, fmt.Errorf("error revoking session: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *Postgres) RevokeOtherSessions(ctx context.Context, userId string, currentSessionId string) (int, error) {
+	sql := `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND session_id::text <> $2 AND revoked_at IS NULL`
+
+	tag, err := p.client.Exec(ctx, sql, userId, currentSessionId)
+	if err != nil {
+		return 0, fmt.Errorf("error revoking sessions: %s", err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+const apiKeyColumns = `api_key_id, user_id, name, prefix, scope, created_at, last_used_at`
+
+func scanApiKey(row pgx.Row, apiKey *ApiKeyRecord) error {
+	return row.Scan(&apiKey.Id, &apiKey.UserId, &apiKey.Name, &apiKey.Prefix, &apiKey.Scope, &apiKey.CreatedAt, &apiKey.LastUsedAt)
+}
+
+func (p *Postgres) CreateApiKey(ctx context.Context, request CreateApiKeyRequest) (ApiKeyRecord, error) {
+	apiKey := ApiKeyRecord{}
+	sql := `
+		INSERT INTO api_keys (user_id, name, prefix, key_hash, scope)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING ` + apiKeyColumns
+
+	err := scanApiKey(p.client.QueryRow(ctx, sql, request.UserId, request.Name, request.Prefix, request.KeyHash, request.Scope), &apiKey)
+	if err != nil {
+		return apiKey, fmt.Errorf("error inserting in api_keys table: %s", err)
+	}
+
+	return apiKey, nil
+}
+
+func (p *Postgres) GetApiKeys(ctx context.Context, userId string) ([]ApiKeyRecord, error) {
+	sql := `
+		SELECT ` + apiKeyColumns + `
+			FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`
+	rows, err := p.client.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying api keys: %s", err)
+	}
+	defer rows.Close()
+
+	apiKeys := []ApiKeyRecord{}
+	for rows.Next() {
+		apiKey := ApiKeyRecord{}
+		if err := scanApiKey(rows, &apiKey); err != nil {
+			return nil, fmt.Errorf("error scanning api key: %s", err)
+		}
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading api keys: %s", err)
+	}
+
+	return apiKeys, nil
+}
+
+func (p *Postgres) RevokeApiKey(ctx context.Context, userId string, apiKeyId string) (bool, error) {
+	sql := `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE api_key_id = $1 AND user_id = $2 AND revoked_at IS NULL`
+
+	tag, err := p.client.Exec(ctx, sql, apiKeyId, userId)
+	if err != nil {
+		return false, fmt.Errorf("error revoking api key: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// UseApiKey looks up an active API key by its hash, recording that it was used.
+func (p *Postgres) UseApiKey(ctx context.Context, keyHash string) (ResultForGetApiKeyRequest, error) {
+	result := ResultForGetApiKeyRequest{}
+	sql := `
+		UPDATE api_keys
+		SET last_used_at = CURRENT_TIMESTAMP
+		WHERE key_hash = $1 AND revoked_at IS NULL
+		RETURNING ` + apiKeyColumns
+
+	err := scanApiKey(p.client.QueryRow(ctx, sql, keyHash), &result.ApiKey)
+
+	if err == pgx.ErrNoRows {
+		result.Found = false
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error using api key: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+// StartTotpEnrollment stores a new secret for a user who doesn't have 2FA on yet,
+// replacing any enrollment they started but didn't confirm.
+func (p *Postgres) StartTotpEnrollment(ctx context.Context, userId string, secret string) (bool, error) {
+	sql := `
+		UPDATE users
+		SET totp_secret = $2, totp_last_used_step = NULL
+		WHERE user_id = $1 AND totp_enabled_at IS NULL
+	`
+
+	tag, err := p.client.Exec(ctx, sql, userId, secret)
+	if err != nil {
+		return false, fmt.Errorf("error starting totp enrollment: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// EnableTotp turns 2FA on with the step of the code that confirmed it, so that code
+// can't be used again, and replaces the recovery codes.
+func (p *Postgres) EnableTotp(ctx context.Context, request EnableTotpRequest) (bool, error) {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		UPDATE users
+		SET totp_enabled_at = CURRENT_TIMESTAMP, totp_last_used_step = $2
+		WHERE user_id = $1 AND totp_secret IS NOT NULL AND totp_enabled_at IS NULL
+	`
+	tag, err := tx.Exec(ctx, sql, request.UserId, request.Step)
+	if err != nil {
+		return false, fmt.Errorf("error enabling totp: %s", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return false, nil
+	}
+
+	err = replaceRecoveryCodes(ctx, tx, request.UserId, request.RecoveryCodeHashes)
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return true, nil
+}
+
+func (p *Postgres) DisableTotp(ctx context.Context, userId string) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_used_step = NULL
+		WHERE user_id = $1
+	`
+	_, err = tx.Exec(ctx, sql, userId)
+	if err != nil {
+		return fmt.Errorf("error disabling totp: %s", err)
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// UseTotpStep records the time step of a valid code, returning false when that step
+// or a later one was already used so each code only works once.
+func (p *Postgres) UseTotpStep(ctx context.Context, userId string, step int64) (bool, error) {
+	sql := `
+		UPDATE users
+		SET totp_last_used_step = $2
+		WHERE user_id = $1 AND (totp_last_used_step IS NULL OR totp_last_used_step < $2)
+	`
+
+	tag, err := p.client.Exec(ctx, sql, userId, step)
+	if err != nil {
+		return false, fmt.Errorf("error using totp step: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *Postgres) UseRecoveryCode(ctx context.Context, userId string, codeHash string) (bool, error) {
+	sql := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`
+
+	tag, err := p.client.Exec(ctx, sql, userId, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("error using recovery code: %s", err)
+	}
+
+	return tag.RowsAffected() > 0, nil
+}
+
+func (p *Postgres) ReplaceRecoveryCodes(ctx context.Context, userId string, codeHashes []string) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = replaceRecoveryCodes(ctx, tx, userId, codeHashes)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx pgx.Tx, userId string, codeHashes []string) error {
+	_, err := tx.Exec(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return fmt.Errorf("error deleting recovery codes: %s", err)
+	}
+
+	sql := `INSERT INTO recovery_codes (user_id, code_hash) SELECT $1, UNNEST($2::text[])`
+	_, err = tx.Exec(ctx, sql, userId, codeHashes)
+	if err != nil {
+		return fmt.Errorf("error inserting recovery codes: %s", err)
+	}
+
+	return nil
+}
+
+// RecordFailedLogin counts a wrong password and, once there have been Threshold of
+// them in a row, locks the account for BaseLockout, doubling with every further
+// failure up to MaxLockout. It returns how long the account is now locked for.
+func (p *Postgres) RecordFailedLogin(ctx context.Context, request RecordFailedLoginRequest) (time.Duration, error) {
+	var lockedForSeconds float64
+	sql := `
+		UPDATE users
+		SET failed_login_attempts = failed_login_attempts + 1,
+			locked_until = CASE
+				WHEN failed_login_attempts + 1 >= $2
+				THEN CURRENT_TIMESTAMP + LEAST($3 * power(2, LEAST(failed_login_attempts + 1 - $2, 20)), $4) * interval '1 second'
+				ELSE locked_until
+			END
+		WHERE user_id = $1
+		RETURNING COALESCE(GREATEST(EXTRACT(EPOCH FROM locked_until - CURRENT_TIMESTAMP), 0), 0)::float8
+	`
+	err := p.client.QueryRow(ctx, sql, request.UserId, request.Threshold, request.BaseLockout.Seconds(), request.MaxLockout.Seconds()).Scan(&lockedForSeconds)
+	if err != nil {
+		return 0, fmt.Errorf("error recording failed login: %s", err)
+	}
+
+	return secondsToDuration(lockedForSeconds), nil
+}
+
+func (p *Postgres) ResetFailedLogins(ctx context.Context, userId string) error {
+	sql := `
+		UPDATE users
+		SET failed_login_attempts = 0, locked_until = NULL
+		WHERE user_id = $1 AND (failed_login_attempts > 0 OR locked_until IS NOT NULL)
+	`
+
+	_, err := p.client.Exec(ctx, sql, userId)
+	if err != nil {
+		return fmt.Errorf("error resetting failed logins: %s", err)
+	}
+
+	return nil
+}
+
+// GetOrCreateOidcUser finds the user who has logged in with this provider identity
+// before, or else links it to the user with the same email, or else creates a user.
+// The email has been verified by the provider, so the user is marked as verified.
+// An unverified user's password is cleared on linking, as it was set by whoever
+// registered the email, who might not be the person who owns it.
+func (p *Postgres) GetOrCreateOidcUser(ctx context.Context, request OidcLoginRequest) (ResultForGetUserRequest, error) {
+	result := ResultForGetUserRequest{}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId string
+	sql := `
+		UPDATE user_identities
+		SET last_login_at = CURRENT_TIMESTAMP, email = $3
+		WHERE provider = $1 AND subject = $2
+		RETURNING user_id
+	`
+	err = tx.QueryRow(ctx, sql, request.Provider, request.Subject, request.Email).Scan(&userId)
+
+	if err == pgx.ErrNoRows {
+		userId, err = linkOidcIdentity(ctx, tx, request)
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error finding user for identity: %s", err)
+	}
+
+	sql = "SELECT " + userColumns + " FROM users u WHERE u.user_id = $1"
+	err = scanUser(tx.QueryRow(ctx, sql, userId), &result.User)
+	if err != nil {
+		return result, fmt.Errorf("error getting user from database: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+func linkOidcIdentity(ctx context.Context, tx pgx.Tx, request OidcLoginRequest) (string, error) {
+	var userId string
+	sql := `
+		UPDATE users
+		SET password_hash = CASE WHEN is_verified THEN password_hash ELSE NULL END,
+			is_verified = true, verification_code = NULL, verification_code_expires_at = NULL
+		WHERE user_id = (
+			SELECT user_id FROM users WHERE lower(email) = lower($1)
+			ORDER BY is_verified DESC NULLS LAST, created_at LIMIT 1
+		)
+		RETURNING user_id
+	`
+	err := tx.QueryRow(ctx, sql, request.Email).Scan(&userId)
+
+	if err == pgx.ErrNoRows {
+		sql = `INSERT INTO users (email, is_verified, locale) VALUES ($1, true, $2) RETURNING user_id`
+		err = tx.QueryRow(ctx, sql, request.Email, request.Locale).Scan(&userId)
+		if err != nil {
+			return "", err
+		}
+
+		err = createPersonalWorkspace(ctx, tx, userId)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	sql = `INSERT INTO user_identities (user_id, provider, subject, email) VALUES ($1, $2, $3, $4)`
+	_, err = tx.Exec(ctx, sql, userId, request.Provider, request.Subject, request.Email)
+	if err != nil {
+		return "", err
+	}
+
+	return userId, nil
+}
+
+// ChangePassword sets the new password and signs the user out of every other
+// session, leaving the one that made the change logged in. API keys are revoked too,
+// since one could have been made with a stolen session.
+func (p *Postgres) ChangePassword(ctx context.Context, request ChangePasswordRequest) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `UPDATE users SET password_hash = $2, failed_login_attempts = 0, locked_until = NULL WHERE user_id = $1`
+	_, err = tx.Exec(ctx, sql, request.UserId, request.HashedPassword)
+	if err != nil {
+		return fmt.Errorf("error updating password: %s", err)
+	}
+
+	sql = `UPDATE password_reset_tokens SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`
+	_, err = tx.Exec(ctx, sql, request.UserId)
+	if err != nil {
+		return fmt.Errorf("error invalidating password reset tokens: %s", err)
+	}
+
+	sql = `UPDATE sessions SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND session_id::text <> $2 AND revoked_at IS NULL`
+	_, err = tx.Exec(ctx, sql, request.UserId, request.CurrentSessionId)
+	if err != nil {
+		return fmt.Errorf("error revoking sessions: %s", err)
+	}
+
+	sql = `UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND revoked_at IS NULL`
+	_, err = tx.Exec(ctx, sql, request.UserId)
+	if err != nil {
+		return fmt.Errorf("error revoking API keys: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// CreateEmailChangeRequest replaces any earlier request the user hasn't confirmed,
+// so only the link in the latest email works.
+func (p *Postgres) CreateEmailChangeRequest(ctx context.Context, request CreateEmailChangeRequest) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `UPDATE email_change_requests SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`
+	_, err = tx.Exec(ctx, sql, request.UserId)
+	if err != nil {
+		return fmt.Errorf("error invalidating email change requests: %s", err)
+	}
+
+	sql = `
+		INSERT INTO email_change_requests (user_id, new_email, token_hash, expires_at)
+		VALUES ($1, $2, $3, CURRENT_TIMESTAMP + $4 * interval '1 second')
+	`
+	_, err = tx.Exec(ctx, sql, request.UserId, request.NewEmail, request.TokenHash, request.Ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("error inserting in email_change_requests table: %s", err)
+	}
+
+	err = queueEmail(ctx, tx, request.ConfirmationEmail)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+// ConfirmEmailChange uses up the token and switches the user to the new email, unless
+// someone else has registered it since the change was requested.
+func (p *Postgres) ConfirmEmailChange(ctx context.Context, tokenHash string) (ResultForConfirmEmailChangeRequest, error) {
+	result := ResultForConfirmEmailChangeRequest{}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var userId string
+	sql := `
+		UPDATE email_change_requests
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+		RETURNING user_id, new_email
+	`
+	err = tx.QueryRow(ctx, sql, tokenHash).Scan(&userId, &result.NewEmail)
+
+	if err == pgx.ErrNoRows {
+		result.Status = EMAIL_CHANGE_UNKNOWN
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error using email change token: %s", err)
+	}
+
+	var taken bool
+	sql = `SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1) AND user_id <> $2)`
+	err = tx.QueryRow(ctx, sql, result.NewEmail, userId).Scan(&taken)
+	if err != nil {
+		return result, fmt.Errorf("error checking email exists: %s", err)
+	}
+
+	if taken {
+		err = tx.Commit(ctx)
+		if err != nil {
+			return result, fmt.Errorf("error committing transaction: %s", err)
+		}
+
+		result.Status = EMAIL_CHANGE_EMAIL_TAKEN
+		return result, nil
+	}
+
+	sql = `
+		UPDATE users u
+		SET email = $2
+		FROM (SELECT email FROM users WHERE user_id = $1) old
+		WHERE u.user_id = $1
+		RETURNING old.email, u.locale
+	`
+	err = tx.QueryRow(ctx, sql, userId, result.NewEmail).Scan(&result.OldEmail, &result.Locale)
+	if err != nil {
+		return result, fmt.Errorf("error updating email: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	result.Status = EMAIL_CHANGE_CONFIRMED
+
+	return result, nil
+}
+
+// DeleteUser deletes the user along with everything that belongs to them, including
+// the workspaces nobody else is a member of, and so their links. Links in workspaces
+// shared with others stay there. Undelivered outbox messages for the deleted
+// workspaces, and emails to the user, are dropped too. It returns the redirect paths
+// of the deleted links so they can be dropped from the cache.
+func (p *Postgres) DeleteUser(ctx context.Context, userId string) ([]string, error) {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		WITH sole AS (
+			SELECT m.workspace_id
+				FROM workspace_members m
+			WHERE m.user_id = $1
+				AND NOT EXISTS (SELECT 1 FROM workspace_members o WHERE o.workspace_id = m.workspace_id AND o.user_id <> $1)
+		),
+		deleted AS (
+			DELETE FROM workspaces WHERE workspace_id IN (SELECT workspace_id FROM sole)
+			RETURNING workspace_id
+		),
+		deleted_messages AS (
+			DELETE FROM outbox
+			WHERE delivered_at IS NULL
+				AND ((kind = $2 AND payload->>'WorkspaceId' IN (SELECT workspace_id::text FROM deleted))
+					OR (kind = $3 AND payload->>'workspace_id' IN (SELECT workspace_id::text FROM deleted)))
+		)
+		SELECT l.redirect_path FROM links l WHERE l.workspace_id IN (SELECT workspace_id FROM deleted)
+	`
+	rows, err := tx.Query(ctx, sql, userId, OUTBOX_KIND_CLICK, OUTBOX_KIND_WEBHOOK)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting workspaces: %s", err)
+	}
+
+	paths, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("error reading links: %s", err)
+	}
+
+	sql = `
+		DELETE FROM workspace_notification_recipients
+		WHERE lower(email) = (SELECT lower(email) FROM users WHERE user_id = $1)
+	`
+	_, err = tx.Exec(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting notification recipients: %s", err)
+	}
+
+	sql = `
+		DELETE FROM outbox
+		WHERE kind = $2 AND delivered_at IS NULL
+			AND lower(payload->>'email') = (SELECT lower(email) FROM users WHERE user_id = $1)
+	`
+	_, err = tx.Exec(ctx, sql, userId, OUTBOX_KIND_EMAIL)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting outbox emails: %s", err)
+	}
+
+	// clicks in the workspaces they shared still to be fanned out would email them
+	sql = `
+		UPDATE outbox o
+		SET payload = jsonb_set(o.payload, '{NotifyEmails}', (
+			SELECT COALESCE(jsonb_agg(e), '[]'::jsonb)
+				FROM jsonb_array_elements(o.payload->'NotifyEmails') e
+			WHERE lower(e #>> '{}') <> u.email
+		))
+		FROM (SELECT lower(email) AS email FROM users WHERE user_id = $1) u
+		WHERE o.kind = $2 AND o.delivered_at IS NULL
+			AND jsonb_typeof(o.payload->'NotifyEmails') = 'array'
+			AND EXISTS (
+				SELECT 1 FROM jsonb_array_elements_text(o.payload->'NotifyEmails') e WHERE lower(e) = u.email
+			)
+	`
+	_, err = tx.Exec(ctx, sql, userId, OUTBOX_KIND_CLICK)
+	if err != nil {
+		return nil, fmt.Errorf("error removing user from outbox clicks: %s", err)
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM users WHERE user_id = $1", userId)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting user: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return paths, nil
+}
+
+// GetAccountExport reads everything held about the user, in one snapshot so the
+// parts are consistent with each other.
+func (p *Postgres) GetAccountExport(ctx context.Context, userId string) (AccountExport, error) {
+	export := AccountExport{}
+
+	tx, err := p.client.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return export, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		SELECT user_id, email, COALESCE(is_verified, false), totp_enabled_at IS NOT NULL, locale, created_at
+		FROM users WHERE user_id = $1
+	`
+	rows, err := tx.Query(ctx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error querying user: %s", err)
+	}
+
+	export.User, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[ExportedUser])
+	if err != nil {
+		return export, fmt.Errorf("error reading user: %s", err)
+	}
+
+	sql = `
+		SELECT link_id, original_url, redirect_path, tag, click_count, created_at, deleted_at
+		FROM links WHERE user_id = $1 ORDER BY created_at
+	`
+	export.Links, err = collectExportRows[ExportedLink](ctx, tx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error reading links: %s", err)
+	}
+
+	sql = `
+		SELECT c.click_id, c.link_id, c.clicked_on, c.referrer, c.user_agent, c.ip_address, c.accept_language, c.is_bot,
+			c.country_code, c.region, c.city, c.device_type, c.browser, c.os
+		FROM clicks c
+		JOIN links l ON c.link_id = l.link_id
+		WHERE l.user_id = $1
+		ORDER BY c.clicked_on
+	`
+	export.Clicks, err = collectExportRows[ExportedClick](ctx, tx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error reading clicks: %s", err)
+	}
+
+	sql = `
+		SELECT session_id, user_agent, ip_address, created_at, last_used_at, expires_at, revoked_at
+		FROM sessions WHERE user_id = $1 ORDER BY created_at
+	`
+	export.Sessions, err = collectExportRows[ExportedSession](ctx, tx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error reading sessions: %s", err)
+	}
+
+	sql = `
+		SELECT api_key_id, name, prefix, scope, created_at, last_used_at, revoked_at
+		FROM api_keys WHERE user_id = $1 ORDER BY created_at
+	`
+	export.ApiKeys, err = collectExportRows[ExportedApiKey](ctx, tx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error reading api keys: %s", err)
+	}
+
+	sql = `
+		SELECT provider, subject, email, created_at, last_login_at
+		FROM user_identities WHERE user_id = $1 ORDER BY created_at
+	`
+	export.Identities, err = collectExportRows[ExportedIdentity](ctx, tx, sql, userId)
+	if err != nil {
+		return export, fmt.Errorf("error reading identities: %s", err)
+	}
+
+	return export, nil
+}
+
+func collectExportRows[T any](ctx context.Context, tx pgx.Tx, sql string, userId string) ([]T, error) {
+	rows, err := tx.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, pgx.RowToStructByPos[T])
+}
+
+const workspaceColumns = `
+	w.workspace_id, w.name, w.is_personal, w.notify_mode, m.role,
+	(SELECT COUNT(*) FROM workspace_members a WHERE a.workspace_id = w.workspace_id),
+	(SELECT COUNT(*) FROM workspace_members a WHERE a.workspace_id = w.workspace_id AND a.role = 'owner'),
+	w.created_at`
+
+func scanWorkspace(row pgx.Row, workspace *WorkspaceRecord) error {
+	return row.Scan(&workspace.Id, &workspace.Name, &workspace.IsPersonal, &workspace.NotifyMode, &workspace.Role, &workspace.MemberCount, &workspace.OwnerCount, &workspace.CreatedAt)
+}
+
+// GetWorkspaces lists the workspaces the user is a member of, along with their role in each.
+func (p *Postgres) GetWorkspaces(ctx context.Context, userId string) ([]WorkspaceRecord, error) {
+	sql := `
+		SELECT ` + workspaceColumns + `
+			FROM workspaces w
+			JOIN workspace_members m ON m.workspace_id = w.workspace_id
+		WHERE m.user_id = $1
+		ORDER BY w.is_personal DESC, w.name, w.created_at
+	`
+	rows, err := p.client.Query(ctx, sql, userId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying workspaces: %s", err)
+	}
+	defer rows.Close()
+
+	workspaces := []WorkspaceRecord{}
+	for rows.Next() {
+		workspace := WorkspaceRecord{}
+		if err := scanWorkspace(rows, &workspace); err != nil {
+			return nil, fmt.Errorf("error scanning workspace: %s", err)
+		}
+		workspaces = append(workspaces, workspace)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading workspaces: %s", err)
+	}
+
+	return workspaces, nil
+}
+
+// GetWorkspace only finds the workspace if the user is a member of it.
+func (p *Postgres) GetWorkspace(ctx context.Context, workspaceId string, userId string) (ResultForGetWorkspaceRequest, error) {
+	sql := `
+		SELECT ` + workspaceColumns + `
+			FROM workspaces w
+			JOIN workspace_members m ON m.workspace_id = w.workspace_id
+		WHERE w.workspace_id = $1 AND m.user_id = $2
+	`
+	return getWorkspaceResult(p.client.QueryRow(ctx, sql, workspaceId, userId))
+}
+
+func (p *Postgres) GetPersonalWorkspace(ctx context.Context, userId string) (ResultForGetWorkspaceRequest, error) {
+	sql := `
+		SELECT ` + workspaceColumns + `
+			FROM workspaces w
+			JOIN workspace_members m ON m.workspace_id = w.workspace_id
+		WHERE w.is_personal AND w.created_by = $1 AND m.user_id = $1
+	`
+	return getWorkspaceResult(p.client.QueryRow(ctx, sql, userId))
+}
+
+func getWorkspaceResult(row pgx.Row) (ResultForGetWorkspaceRequest, error) {
+	result := ResultForGetWorkspaceRequest{}
+
+	err := scanWorkspace(row, &result.Workspace)
+	if err == pgx.ErrNoRows {
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error getting workspace from database: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+func (p *Postgres) CreateWorkspace(ctx context.Context, userId string, name string) (WorkspaceRecord, error) {
+	workspace := WorkspaceRecord{Name: name, NotifyMode: NOTIFY_MODE_CREATOR, Role: WORKSPACE_ROLE_OWNER, MemberCount: 1, OwnerCount: 1}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return workspace, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `INSERT INTO workspaces (name, notify_mode, created_by) VALUES ($1, $2, $3) RETURNING workspace_id, created_at`
+	err = tx.QueryRow(ctx, sql, name, NOTIFY_MODE_CREATOR, userId).Scan(&workspace.Id, &workspace.CreatedAt)
+	if err != nil {
+		return workspace, fmt.Errorf("error inserting in workspaces table: %s", err)
+	}
+
+	sql = `INSERT INTO workspace_members (workspace_id, user_id, role) VALUES ($1, $2, $3)`
+	_, err = tx.Exec(ctx, sql, workspace.Id, userId, WORKSPACE_ROLE_OWNER)
+	if err != nil {
+		return workspace, fmt.Errorf("error inserting in workspace_members table: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return workspace, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return workspace, nil
+}
+
+func (p *Postgres) UpdateWorkspace(ctx context.Context, request UpdateWorkspaceRequest) error {
+	sql := `
+		UPDATE workspaces
+		SET name = COALESCE($2, name)
+		WHERE workspace_id = $1
+	`
+	_, err := p.client.Exec(ctx, sql, request.WorkspaceId, request.Name)
+	if err != nil {
+		return fmt.Errorf("error updating workspace: %s", err)
+	}
+
+	return nil
+}
+
+// DeleteWorkspace deletes the workspace and its links, returning the links' redirect
+// paths so they can be dropped from the cache.
+func (p *Postgres) DeleteWorkspace(ctx context.Context, workspaceId string) ([]string, error) {
+	sql := `
+		WITH deleted AS (
+			DELETE FROM workspaces WHERE workspace_id = $1
+			RETURNING workspace_id
+		)
+		SELECT l.redirect_path FROM links l WHERE l.workspace_id IN (SELECT workspace_id FROM deleted)
+	`
+	rows, err := p.client.Query(ctx, sql, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error deleting workspace: %s", err)
+	}
+
+	paths, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("error reading links: %s", err)
+	}
+
+	return paths, nil
+}
+
+func (p *Postgres) GetWorkspaceMembers(ctx context.Context, workspaceId string) ([]WorkspaceMemberRecord, error) {
+	sql := `
+		SELECT m.user_id, u.email, m.role, m.created_at
+			FROM workspace_members m
+			JOIN users u ON u.user_id = m.user_id
+		WHERE m.workspace_id = $1
+		ORDER BY m.created_at
+	`
+	rows, err := p.client.Query(ctx, sql, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying workspace members: %s", err)
+	}
+
+	members, err := pgx.CollectRows(rows, pgx.RowToStructByPos[WorkspaceMemberRecord])
+	if err != nil {
+		return nil, fmt.Errorf("error reading workspace members: %s", err)
+	}
+
+	return members, nil
+}
+
+// lastOwnerGuard stops a change to member $2 of workspace $1 from leaving it without
+// an owner.
+const lastOwnerGuard = `
+	(m.role <> 'owner' OR EXISTS (
+		SELECT 1 FROM workspace_members o WHERE o.workspace_id = $1 AND o.user_id <> $2 AND o.role = 'owner'
+	))`
+
+// UpdateWorkspaceMemberRole returns false when the member doesn't exist or is the
+// workspace's last owner.
+func (p *Postgres) UpdateWorkspaceMemberRole(ctx context.Context, workspaceId string, userId string, role string) (bool, error) {
+	sql := `
+		UPDATE workspace_members m
+		SET role = $3
+		WHERE m.workspace_id = $1 AND m.user_id = $2 AND ($3 = 'owner' OR ` + lastOwnerGuard + `)
+	`
+	return p.changeWorkspaceMember(ctx, sql, workspaceId, userId, role)
+}
+
+// RemoveWorkspaceMember returns false when the member doesn't exist or is the
+// workspace's last owner.
+func (p *Postgres) RemoveWorkspaceMember(ctx context.Context, workspaceId string, userId string) (bool, error) {
+	sql := `DELETE FROM workspace_members m WHERE m.workspace_id = $1 AND m.user_id = $2 AND ` + lastOwnerGuard
+	return p.changeWorkspaceMember(ctx, sql, workspaceId, userId)
+}
+
+// changeWorkspaceMember locks the workspace first so two owners can't demote each
+// other at the same time.
+func (p *Postgres) changeWorkspaceMember(ctx context.Context, sql string, args ...any) (bool, error) {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT 1 FROM workspaces WHERE workspace_id = $1 FOR UPDATE", args[0])
+	if err != nil {
+		return false, fmt.Errorf("error locking workspace: %s", err)
+	}
+
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		return false, fmt.Errorf("error changing workspace member: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+const invitationColumns = `invitation_id, email, role, expires_at, created_at`
+
+const pendingInvitation = `accepted_at IS NULL AND revoked_at IS NULL AND expires_at > CURRENT_TIMESTAMP`
+
+func (p *Postgres) CreateWorkspaceInvitation(ctx context.Context, request CreateWorkspaceInvitationRequest) (WorkspaceInvitationRecord, error) {
+	invitation := WorkspaceInvitationRecord{}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return invitation, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `
+		INSERT INTO workspace_invitations (workspace_id, email, role, token_hash, invited_by, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CURRENT_TIMESTAMP + $6 * interval '1 second')
+		RETURNING ` + invitationColumns
+
+	row := tx.QueryRow(ctx, sql, request.WorkspaceId, request.Email, request.Role, request.TokenHash, request.InvitedBy, request.Ttl.Seconds())
+	err = row.Scan(&invitation.Id, &invitation.Email, &invitation.Role, &invitation.ExpiresAt, &invitation.CreatedAt)
+	if err != nil {
+		return invitation, fmt.Errorf("error inserting in workspace_invitations table: %s", err)
+	}
+
+	err = queueEmail(ctx, tx, request.InvitationEmail)
+	if err != nil {
+		return invitation, err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return invitation, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return invitation, nil
+}
+
+func (p *Postgres) GetWorkspaceInvitations(ctx context.Context, workspaceId string) ([]WorkspaceInvitationRecord, error) {
+	sql := `
+		SELECT ` + invitationColumns + `
+			FROM workspace_invitations
+		WHERE workspace_id = $1 AND ` + pendingInvitation + `
+		ORDER BY created_at DESC
+	`
+	rows, err := p.client.Query(ctx, sql, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying workspace invitations: %s", err)
+	}
+
+	invitations, err := pgx.CollectRows(rows, pgx.RowToStructByPos[WorkspaceInvitationRecord])
+	if err != nil {
+		return nil, fmt.Errorf("error reading workspace invitations: %s", err)
+	}
+
+	return invitations, nil
+}
+
+func (p *Postgres) RevokeWorkspaceInvitation(ctx context.Context, workspaceId string, invitationId string) (bool, error) {
+	sql := `
+		UPDATE workspace_invitations
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE invitation_id = $1 AND workspace_id = $2 AND ` + pendingInvitation
+
+	tag, err := p.client.Exec(ctx, sql, invitationId, workspaceId)
+	if err != nil {
+		return false, fmt.Errorf("error revoking workspace invitation: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// AcceptWorkspaceInvitation only accepts a pending invitation sent to the user's own
+// email. Someone who's already a member keeps the role they have.
+func (p *Postgres) AcceptWorkspaceInvitation(ctx context.Context, request AcceptWorkspaceInvitationRequest) (ResultForAcceptWorkspaceInvitationRequest, error) {
+	result := ResultForAcceptWorkspaceInvitationRequest{}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var role string
+	sql := `
+		UPDATE workspace_invitations
+		SET accepted_at = CURRENT_TIMESTAMP
+		WHERE token_hash = $1 AND lower(email) = lower($2) AND ` + pendingInvitation + `
+		RETURNING workspace_id, role
+	`
+	err = tx.QueryRow(ctx, sql, request.TokenHash, request.Email).Scan(&result.WorkspaceId, &role)
+	if err == pgx.ErrNoRows {
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error accepting workspace invitation: %s", err)
+	}
+
+	sql = `
+		INSERT INTO workspace_members (workspace_id, user_id, role)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (workspace_id, user_id) DO UPDATE SET role = workspace_members.role
+		RETURNING role
+	`
+	err = tx.QueryRow(ctx, sql, result.WorkspaceId, request.UserId, role).Scan(&result.Role)
+	if err != nil {
+		return result, fmt.Errorf("error inserting in workspace_members table: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+func (p *Postgres) GetNotificationRecipients(ctx context.Context, workspaceId string) ([]string, error) {
+	sql := memberRecipients + ` WHERE r.workspace_id = $1 ORDER BY u.email`
+
+	rows, err := p.client.Query(ctx, sql, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying notification recipients: %s", err)
+	}
+
+	emails, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, fmt.Errorf("error reading notification recipients: %s", err)
+	}
+
+	return emails, nil
+}
+
+// SetWorkspaceNotifications sets the workspace's notify mode and replaces its list of
+// recipients together, once it's checked they're all members. The workspace is
+// locked so nobody can leave in between.
+func (p *Postgres) SetWorkspaceNotifications(ctx context.Context, request SetWorkspaceNotificationsRequest) (ResultForSetWorkspaceNotificationsRequest, error) {
+	result := ResultForSetWorkspaceNotificationsRequest{}
+
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, "SELECT 1 FROM workspaces WHERE workspace_id = $1 FOR UPDATE", request.WorkspaceId)
+	if err != nil {
+		return result, fmt.Errorf("error locking workspace: %s", err)
+	}
+
+	sql := `
+		SELECT e.email
+			FROM unnest($2::text[]) AS e(email)
+		WHERE NOT EXISTS (
+			SELECT 1
+				FROM workspace_members m
+				JOIN users u ON u.user_id = m.user_id
+			WHERE m.workspace_id = $1 AND lower(u.email) = lower(e.email)
+		)
+	`
+	rows, err := tx.Query(ctx, sql, request.WorkspaceId, request.Recipients)
+	if err != nil {
+		return result, fmt.Errorf("error checking notification recipients: %s", err)
+	}
+
+	result.NotMembers, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return result, fmt.Errorf("error reading notification recipients: %s", err)
+	}
+
+	if len(result.NotMembers) > 0 {
+		return result, nil
+	}
+
+	_, err = tx.Exec(ctx, "UPDATE workspaces SET notify_mode = $2 WHERE workspace_id = $1", request.WorkspaceId, request.NotifyMode)
+	if err != nil {
+		return result, fmt.Errorf("error updating notify mode: %s", err)
+	}
+
+	_, err = tx.Exec(ctx, "DELETE FROM workspace_notification_recipients WHERE workspace_id = $1", request.WorkspaceId)
+	if err != nil {
+		return result, fmt.Errorf("error deleting notification recipients: %s", err)
+	}
+
+	sql = `
+		INSERT INTO workspace_notification_recipients (workspace_id, email)
+		SELECT $1, lower(email) FROM unnest($2::text[]) AS email
+		ON CONFLICT DO NOTHING
+	`
+	_, err = tx.Exec(ctx, sql, request.WorkspaceId, request.Recipients)
+	if err != nil {
+		return result, fmt.Errorf("error inserting in workspace_notification_recipients table: %s", err)
+	}
+
+	rows, err = tx.Query(ctx, "SELECT redirect_path FROM links WHERE workspace_id = $1 AND deleted_at IS NULL", request.WorkspaceId)
+	if err != nil {
+		return result, fmt.Errorf("error querying links: %s", err)
+	}
+
+	result.Paths, err = pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return result, fmt.Errorf("error reading links: %s", err)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return result, fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return result, nil
+}
+
+const webhookColumns = `
+	webhook_id, workspace_id, url, secret, COALESCE(description, ''),
+	format, COALESCE(tag, ''), COALESCE(link_creator_id::text, ''), created_at`
+
+func (p *Postgres) CreateWebhook(ctx context.Context, request CreateWebhookRequest) (WebhookRecord, error) {
+	sql := `
+		INSERT INTO webhooks (workspace_id, url, secret, description, format, tag, link_creator_id, created_by)
+		VALUES ($1, $2, $3, NULLIF($4, ''), $5, NULLIF($6, ''), NULLIF($7, '')::uuid, $8)
+		RETURNING ` + webhookColumns
+
+	rows, err := p.client.Query(ctx, sql,
+		request.WorkspaceId,
+		request.Url,
+		request.Secret,
+		request.Description,
+		request.Format,
+		request.Tag,
+		request.LinkCreatorId,
+		request.CreatedBy,
+	)
+	if err != nil {
+		return WebhookRecord{}, fmt.Errorf("error inserting in webhooks table: %s", err)
+	}
+
+	webhook, err := pgx.CollectOneRow(rows, pgx.RowToStructByPos[WebhookRecord])
+	if err != nil {
+		return webhook, fmt.Errorf("error reading webhook: %s", err)
+	}
+
+	return webhook, nil
+}
+
+func (p *Postgres) GetWebhooks(ctx context.Context, workspaceId string) ([]WebhookRecord, error) {
+	sql := "SELECT " + webhookColumns + " FROM webhooks WHERE workspace_id = $1 ORDER BY created_at"
+
+	rows, err := p.client.Query(ctx, sql, workspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhooks: %s", err)
+	}
+
+	webhooks, err := pgx.CollectRows(rows, pgx.RowToStructByPos[WebhookRecord])
+	if err != nil {
+		return nil, fmt.Errorf("error reading webhooks: %s", err)
+	}
+
+	return webhooks, nil
+}
+
+func (p *Postgres) GetWebhook(ctx context.Context, workspaceId string, webhookId string) (ResultForGetWebhookRequest, error) {
+	result := ResultForGetWebhookRequest{}
+	sql := "SELECT " + webhookColumns + " FROM webhooks WHERE webhook_id = $1 AND workspace_id = $2"
+
+	rows, err := p.client.Query(ctx, sql, webhookId, workspaceId)
+	if err != nil {
+		return result, fmt.Errorf("error querying webhook: %s", err)
+	}
+
+	result.Webhook, err = pgx.CollectOneRow(rows, pgx.RowToStructByPos[WebhookRecord])
+	if err == pgx.ErrNoRows {
+		return result, nil
+	}
+
+	if err != nil {
+		return result, fmt.Errorf("error reading webhook: %s", err)
+	}
+
+	result.Found = true
+
+	return result, nil
+}
+
+func (p *Postgres) DeleteWebhook(ctx context.Context, workspaceId string, webhookId string) (bool, error) {
+	tag, err := p.client.Exec(ctx, "DELETE FROM webhooks WHERE webhook_id = $1 AND workspace_id = $2", webhookId, workspaceId)
+	if err != nil {
+		return false, fmt.Errorf("error deleting webhook: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func (p *Postgres) AddWebhookDelivery(ctx context.Context, delivery WebhookDeliveryRecord) (WebhookDeliveryRecord, error) {
+	sql := `
+		INSERT INTO webhook_deliveries (webhook_id, event_id, attempt, status_code, error, duration_ms)
+		VALUES ($1, $2, $3, NULLIF($4, 0), NULLIF($5, ''), $6)
+		RETURNING delivery_id, created_at
+	`
+	row := p.client.QueryRow(ctx, sql, delivery.WebhookId, delivery.EventId, delivery.Attempt, delivery.StatusCode, delivery.Error, delivery.Duration.Milliseconds())
+	err := row.Scan(&delivery.Id, &delivery.CreatedAt)
+	if err != nil {
+		return delivery, fmt.Errorf("error inserting in webhook_deliveries table: %s", err)
+	}
+
+	return delivery, nil
+}
+
+// GetWebhookDeliveries returns the most recent delivery attempts first.
+func (p *Postgres) GetWebhookDeliveries(ctx context.Context, webhookId string, limit int) ([]WebhookDeliveryRecord, error) {
+	sql := `
+		SELECT delivery_id, webhook_id, event_id, attempt, COALESCE(status_code, 0), COALESCE(error, ''), duration_ms, created_at
+			FROM webhook_deliveries
+		WHERE webhook_id = $1
+		ORDER BY created_at DESC
+		LIMIT $2
+	`
+	rows, err := p.client.Query(ctx, sql, webhookId, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error querying webhook deliveries: %s", err)
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDeliveryRecord{}
+	for rows.Next() {
+		delivery := WebhookDeliveryRecord{}
+		var durationMs int64
+		err := rows.Scan(&delivery.Id, &delivery.WebhookId, &delivery.EventId, &delivery.Attempt, &delivery.StatusCode, &delivery.Error, &durationMs, &delivery.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning webhook delivery: %s", err)
+		}
+		delivery.Duration = time.Duration(durationMs) * time.Millisecond
+		deliveries = append(deliveries, delivery)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading webhook deliveries: %s", err)
+	}
+
+	return deliveries, nil
+}
+
+// addOutboxMessages queues the messages as part of the transaction, so they're only
+// sent if it commits.
+func addOutboxMessages(ctx context.Context, tx pgx.Tx, messages []OutboxMessage) error {
+	for _, message := range messages {
+		_, err := tx.Exec(ctx, "INSERT INTO outbox (kind, payload) VALUES ($1, $2)", message.Kind, message.Payload)
+		if err != nil {
+			return fmt.Errorf("error inserting in outbox table: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// queueEmail adds the email to the outbox as part of the transaction, so it's only
+// sent if the change it's about is committed.
+func queueEmail(ctx context.Context, tx pgx.Tx, email SendEmailRequest) error {
+	message, err := newOutboxMessage(OUTBOX_KIND_EMAIL, email)
+	if err != nil {
+		return err
+	}
+
+	return addOutboxMessages(ctx, tx, []OutboxMessage{message})
+}
+
+// AddOutboxMessages queues messages that don't go with any other change.
+func (p *Postgres) AddOutboxMessages(ctx context.Context, messages []OutboxMessage) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	err = addOutboxMessages(ctx, tx, messages)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+const outboxColumns = `message_id, kind, payload, attempts, COALESCE(last_error, ''), next_attempt_at, created_at, delivered_at, dead_at`
+
+// ClaimOutboxMessages picks the messages that are due and locks them for lockFor,
+// counting the attempt. Other dispatchers skip them until then, so if this one dies
+// mid-delivery they're tried again once the lock runs out.
+func (p *Postgres) ClaimOutboxMessages(ctx context.Context, limit int, lockFor time.Duration) ([]OutboxMessage, error) {
+	sql := `
+		UPDATE outbox
+		SET locked_until = CURRENT_TIMESTAMP + $2 * interval '1 second',
+			attempts = attempts + 1
+		WHERE message_id IN (
+			SELECT message_id
+				FROM outbox
+			WHERE delivered_at IS NULL
+				AND dead_at IS NULL
+				AND next_attempt_at <= CURRENT_TIMESTAMP
+				AND (locked_until IS NULL OR locked_until <= CURRENT_TIMESTAMP)
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + outboxColumns
+
+	rows, err := p.client.Query(ctx, sql, limit, lockFor.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error claiming outbox messages: %s", err)
+	}
+
+	messages, err := pgx.CollectRows(rows, pgx.RowToStructByPos[OutboxMessage])
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox messages: %s", err)
+	}
+
+	return messages, nil
+}
+
+// CompleteOutboxMessage marks the message delivered and queues the messages it led to
+// in the same transaction, so they're queued exactly once.
+func (p *Postgres) CompleteOutboxMessage(ctx context.Context, messageId string, followUps []OutboxMessage) error {
+	tx, err := p.client.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %s", err)
+	}
+	defer tx.Rollback(ctx)
+
+	sql := `UPDATE outbox SET delivered_at = CURRENT_TIMESTAMP, locked_until = NULL, last_error = NULL WHERE message_id = $1 AND delivered_at IS NULL`
+	tag, err := tx.Exec(ctx, sql, messageId)
+	if err != nil {
+		return fmt.Errorf("error completing outbox message: %s", err)
+	}
+
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+
+	err = addOutboxMessages(ctx, tx, followUps)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing transaction: %s", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) FailOutboxMessage(ctx context.Context, request FailOutboxMessageRequest) error {
+	sql := `
+		UPDATE outbox
+		SET last_error = $2,
+			locked_until = NULL,
+			next_attempt_at = CURRENT_TIMESTAMP + $3 * interval '1 second',
+			dead_at = CASE WHEN $4 THEN CURRENT_TIMESTAMP END
+		WHERE message_id = $1 AND delivered_at IS NULL
+	`
+	_, err := p.client.Exec(ctx, sql, request.MessageId, request.Error, request.RetryIn.Seconds(), request.DeadLetter)
+	if err != nil {
+		return fmt.Errorf("error failing outbox message: %s", err)
+	}
+
+	return nil
+}
+
+func (p *Postgres) GetOutboxMessages(ctx context.Context, request GetOutboxMessagesRequest) ([]OutboxMessage, error) {
+	var condition string
+	switch request.Status {
+	case OUTBOX_STATUS_DEAD:
+		condition = "dead_at IS NOT NULL"
+	case OUTBOX_STATUS_DELIVERED:
+		condition = "delivered_at IS NOT NULL"
+	default:
+		condition = "delivered_at IS NULL AND dead_at IS NULL"
+	}
+
+	sql := `
+		SELECT ` + outboxColumns + `
+			FROM outbox
+		WHERE ` + condition + `
+			AND ($1::text IS NULL OR kind = $1)
+		ORDER BY created_at DESC
+		LIMIT $2 OFFSET $3
+	`
+	rows, err := p.client.Query(ctx, sql, request.Kind, request.Limit, request.Offset)
+	if err != nil {
+		return nil, fmt.Errorf("error querying outbox messages: %s", err)
+	}
+
+	messages, err := pgx.CollectRows(rows, pgx.RowToStructByPos[OutboxMessage])
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox messages: %s", err)
+	}
+
+	return messages, nil
+}
+
+func (p *Postgres) GetOutboxStats(ctx context.Context) (OutboxStats, error) {
+	stats := OutboxStats{}
+	sql := `
+		SELECT
+			COUNT(*) FILTER (WHERE delivered_at IS NULL AND dead_at IS NULL),
+			COUNT(*) FILTER (WHERE dead_at IS NOT NULL),
+			MIN(created_at) FILTER (WHERE delivered_at IS NULL AND dead_at IS NULL)
+			FROM outbox
+		WHERE delivered_at IS NULL
+	`
+	err := p.client.QueryRow(ctx, sql).Scan(&stats.Pending, &stats.Dead, &stats.OldestPendingAt)
+	if err != nil {
+		return stats, fmt.Errorf("error getting outbox stats: %s", err)
+	}
+
+	return stats, nil
+}
+
+// ReplayOutboxMessage gives a dead-lettered message a fresh set of attempts.
+func (p *Postgres) ReplayOutboxMessage(ctx context.Context, messageId string) (bool, error) {
+	sql := `
+		UPDATE outbox
+		SET dead_at = NULL, attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, locked_until = NULL
+		WHERE message_id = $1 AND dead_at IS NOT NULL
+	`
+	tag, err := p.client.Exec(ctx, sql, messageId)
+	if err != nil {
+		return false, fmt.Errorf("error replaying outbox message: %s", err)
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+// DeleteOldOutboxMessages deletes messages delivered more than olderThan ago, and the
+// webhook deliveries logged before then. Dead-lettered messages are kept until they're
+// replayed.
+func (p *Postgres) DeleteOldOutboxMessages(ctx context.Context, olderThan time.Duration) (ResultForDeleteOldOutboxMessagesRequest, error) {
+	result := ResultForDeleteOldOutboxMessagesRequest{}
+
+	sql := "DELETE FROM outbox WHERE delivered_at < CURRENT_TIMESTAMP - $1 * interval '1 second'"
+	tag, err := p.client.Exec(ctx, sql, olderThan.Seconds())
+	if err != nil {
+		return result, fmt.Errorf("error deleting outbox messages: %s", err)
+	}
+
+	result.Messages = int(tag.RowsAffected())
+
+	sql = "DELETE FROM webhook_deliveries WHERE created_at < CURRENT_TIMESTAMP - $1 * interval '1 second'"
+	tag, err = p.client.Exec(ctx, sql, olderThan.Seconds())
+	if err != nil {
+		return result, fmt.Errorf("error deleting webhook deliveries: %s", err)
+	}
+
+	result.Deliveries = int(tag.RowsAffected())
+
+	return result, nil
+}
+
+func (p *Postgres) SetUserLocale(ctx context.Context, userId string, locale string) error {
+	_, err := p.client.Exec(ctx, "UPDATE users SET locale = $2 WHERE user_id = $1", userId, locale)
+	if err != nil {
+		return fmt.Errorf("error updating locale: %s", err)
+	}
+
+	return nil
+}
+
+// GetUserLocales maps each email that belongs to a user to their locale, keyed on the
+// lowercased email as addresses are matched regardless of case. Emails that don't
+// are left out.
+func (p *Postgres) GetUserLocales(ctx context.Context, emails []string) (map[string]string, error) {
+	locales := map[string]string{}
+
+	sql := `
+		SELECT lower(email), locale
+			FROM users
+		WHERE lower(email) IN (SELECT lower(e) FROM unnest($1::text[]) e)
+	`
+	rows, err := p.client.Query(ctx, sql, emails)
+	if err != nil {
+		return locales, fmt.Errorf("error querying locales: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email, locale string
+		if err := rows.Scan(&email, &locale); err != nil {
+			return locales, fmt.Errorf("error scanning locale: %s", err)
+		}
+		locales[email] = locale
+	}
+
+	if err := rows.Err(); err != nil {
+		return locales, fmt.Errorf("error reading locales: %s", err)
+	}
+
+	return locales, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const RATE_LIMITER_SWEEP_INTERVAL = time.Minute
+
+// MemoryRateLimiter is a token bucket per key, held in process. Each key gets burst
+// requests straight away, refilled at perMinute. Running more than one instance
+// multiplies the limits, which is what the RateLimiter interface is for.
+type MemoryRateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	rate      float64
+	burst     float64
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newMemoryRateLimiter(perMinute int, burst int) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		buckets:   map[string]*tokenBucket{},
+		rate:      float64(perMinute) / 60,
+		burst:     float64(burst),
+		lastSweep: time.Now(),
+	}
+}
+
+func (m *MemoryRateLimiter) Allow(ctx context.Context, key string) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	bucket, found := m.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: m.burst, updated: now}
+		m.buckets[key] = bucket
+	}
+
+	bucket.tokens = m.refilled(bucket, now)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / m.rate
+		return RateLimitResult{Allowed: false, RetryAfter: time.Duration(wait * float64(time.Second))}, nil
+	}
+
+	bucket.tokens--
+
+	return RateLimitResult{Allowed: true}, nil
+}
+
+func (m *MemoryRateLimiter) refilled(bucket *tokenBucket, now time.Time) float64 {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	return math.Min(m.burst, bucket.tokens+elapsed*m.rate)
+}
+
+// sweep forgets buckets that have refilled, as they're the same as a new one, so
+// the map doesn't grow with every IP that ever made a request.
+func (m *MemoryRateLimiter) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < RATE_LIMITER_SWEEP_INTERVAL {
+		return
+	}
+
+	for key, bucket := range m.buckets {
+		if m.refilled(bucket, now) >= m.burst {
+			delete(m.buckets, key)
+		}
+	}
+
+	m.lastSweep = now
+}
+
+// rateLimit limits requests per client IP, under a name so different groups of
+// routes get separate buckets when they share a limiter.
+func rateLimit(limiter RateLimiter, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := name + ":" + c.ClientIP()
+		if !checkRateLimit(c, limiter, key) {
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// checkRateLimit aborts with 429 when key is over its limit. Errors from the limiter
+// let the request through, so a shared store being down doesn't take logins with it.
+func checkRateLimit(c *gin.Context, limiter RateLimiter, key string) bool {
+	result, err := limiter.Allow(c, key)
+	if err != nil {
+		log.Printf("error checking rate limit for %s: %s", key, err)
+		return true
+	}
+
+	if !result.Allowed {
+		log.Printf("rate limited %s on %s %s", key, c.Request.Method, c.FullPath())
+		abortTooManyRequests(c, result.RetryAfter)
+		return false
+	}
+
+	return true
+}
+
+func abortTooManyRequests(c *gin.Context, retryAfter time.Duration) {
+	c.Header("Retry-After", fmt.Sprint(int(math.Ceil(retryAfter.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, "Too many attempts, try again later")
+}
+
+func accountRateLimitKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// RedirectCache is an in-process LRU of redirect records keyed by redirect path.
+// Entries also expire after ttl, which bounds how long another instance can keep
+// serving a link that was edited or deleted through this one.
+type RedirectCache struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	items    map[string]*list.Element
+	order    *list.List
+}
+
+type redirectCacheEntry struct {
+	path      string
+	record    RedirectRecord
+	expiresAt time.Time
+}
+
+func newRedirectCache(capacity int, ttl time.Duration) *RedirectCache {
+	return &RedirectCache{
+		capacity: capacity,
+		ttl:      ttl,
+		items:    map[string]*list.Element{},
+		order:    list.New(),
+	}
+}
+
+func (rc *RedirectCache) Get(path string) (RedirectRecord, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	element, found := rc.items[path]
+	if !found {
+		return RedirectRecord{}, false
+	}
+
+	entry := element.Value.(*redirectCacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		rc.removeElement(element)
+		return RedirectRecord{}, false
+	}
+
+	rc.order.MoveToFront(element)
+
+	return entry.record, true
+}
+
+func (rc *RedirectCache) Add(path string, record RedirectRecord) {
+	if rc.capacity <= 0 {
+		return
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	expiresAt := time.Now().Add(rc.ttl)
+
+	if element, found := rc.items[path]; found {
+		entry := element.Value.(*redirectCacheEntry)
+		entry.record = record
+		entry.expiresAt = expiresAt
+		rc.order.MoveToFront(element)
+		return
+	}
+
+	rc.items[path] = rc.order.PushFront(&redirectCacheEntry{path: path, record: record, expiresAt: expiresAt})
+
+	for rc.order.Len() > rc.capacity {
+		rc.removeElement(rc.order.Back())
+	}
+}
+
+func (rc *RedirectCache) Remove(path string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if element, found := rc.items[path]; found {
+		rc.removeElement(element)
+	}
+}
+
+func (rc *RedirectCache) removeElement(element *list.Element) {
+	rc.order.Remove(element)
+	delete(rc.items, element.Value.(*redirectCacheEntry).path)
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -16,75 +18,88 @@ func (r *Controller) Redirect(c *gin.Context) {
 		return
 	}
 
-	url, err := r.Database.GetRedirectUrl(c, path)
+	record, err := r.getRedirectRecord(c, path)
 	if err != nil {
-		log.Printf("error getting redirect url for path %s: %s", path, err)
+		log.Printf("error getting redirect record for path %s: %s", path, err)
 		c.Redirect(http.StatusTemporaryRedirect, r.ErrorRedirectUrl)
 		return
 	}
 
-	c.Redirect(http.StatusTemporaryRedirect, url)
+	c.Redirect(http.StatusTemporaryRedirect, record.RedirectUrl)
 
-	record, err := r.Database.GetRedirectRecord(c, path)
-	if err != nil {
-		log.Printf("error getting redirect data for path %s: %s", path, err)
-		return
-	}
-
-	isPreview, err := r.BotChecker.IsBotRequest(c.Request)
-	if err != nil {
-		log.Printf("error checking if request for link path %s is for a preview: %s", record.Path, err)
-		return
+	if !r.ClickQueue.Enqueue(newClickEvent(c, record)) {
+		log.Printf("click queue full or shutting down, dropping click for link path %s", path)
 	}
+}
 
-	if isPreview {
-		log.Printf("not tracking redirect for link path %s as it is preview request", record.Path)
-		return
+func (r *Controller) getRedirectRecord(ctx context.Context, path string) (RedirectRecord, error) {
+	if record, found := r.RedirectCache.Get(path); found {
+		return record, nil
 	}
 
-	err = r.Database.AddLinkClick(c, record.LinkId)
+	record, err := r.Database.GetRedirectRecord(ctx, path)
 	if err != nil {
-		log.Printf("error adding link click for link path %s: %s", record.Path, err)
-		return
+		return record, err
 	}
 
-	if record.NumberOfTimesClicked > r.MaxNumberOfEmailAlerts {
-		log.Printf("not sending email notification for link path %s as number of clicks exceeded", record.Path)
-		return
-	}
+	r.RedirectCache.Add(path, record)
+
+	return record, nil
+}
 
-	err = r.sendEmail(record)
+func (r *Controller) processClick(ctx context.Context, event ClickEvent) error {
+	record := event.Record
+
+	isPreview, err := r.BotChecker.IsBotRequest(event.Request)
 	if err != nil {
-		log.Printf("error notifying that link path %s was clicked: %s", record.Path, err)
-		return
+		return fmt.Errorf("error checking if request is for a preview: %s", err)
 	}
 
-	log.Printf("sent email notification for link path %s", record.Path)
-}
+	click := event.Click
+	click.LinkId = record.LinkId
+	click.IsBot = isPreview
+	click.Device = r.UserAgentParser.Parse(click.UserAgent)
 
-func (r *Controller) sendEmail(record RedirectRecord) error {
-	subject_template := "LinkUp link id %s clicked"
-	subject := fmt.Sprintf(subject_template, record.Path)
+	click.Location, err = r.GeoResolver.Resolve(click.IpAddress)
+	if err != nil {
+		log.Printf("error resolving location for click on link path %s: %s", record.Path, err)
+	}
 
-	var content_template string
-	if lengthOfString(record.Tag) > 0 {
-		content_template = fmt.Sprintf("LinkUp link with tag '%s' has been clicked!", record.Tag)
-		content_template = content_template + " The link's URL is %s and redirects to %s."
+	if isPreview {
+		log.Printf("not notifying about redirect for link path %s as it is preview request", record.Path)
 	} else {
-		content_template = "LinkUp link %s that redirects to %s has been clicked!"
+		notification := r.newClickNotification(record, click)
+		click.Notification = &notification
 	}
 
-	content := fmt.Sprintf(content_template, fmt.Sprintf("%s/%s", r.RedirectUri, record.Path), record.RedirectUrl)
-
-	if record.NumberOfTimesClicked == r.MaxNumberOfEmailAlerts-1 {
-		content = content + " This is the last email alert you'll receive for this link. Please contact mihailthebuilder@gmail.com if you wish to receive more alerts."
+	_, err = r.Database.AddLinkClick(ctx, click)
+	if err != nil {
+		return fmt.Errorf("error adding link click: %s", err)
 	}
 
-	ser := SendEmailRequest{Email: record.UserEmail, Subject: subject, Content: content}
-	err := r.Emailer.SendEmail(ser)
-	if err != nil {
-		return fmt.Errorf("error sending email: %s", err)
+	if click.Notification != nil {
+		r.OutboxDispatcher.Wake()
 	}
 
 	return nil
 }
+
+func (r *Controller) GetClickQueueStats(c *gin.Context) {
+	c.JSON(http.StatusOK, r.ClickQueue.Stats())
+}
+
+const MAX_CLICK_HEADER_LENGTH = 1024
+
+func newClickEvent(c *gin.Context, record RedirectRecord) ClickEvent {
+	return ClickEvent{
+		Record:  record,
+		Request: c.Request.Clone(context.Background()),
+		Click: AddLinkClickRequest{
+			Referrer:       truncateString(c.Request.Referer(), MAX_CLICK_HEADER_LENGTH),
+			UserAgent:      truncateString(c.Request.UserAgent(), MAX_CLICK_HEADER_LENGTH),
+			IpAddress:      c.ClientIP(),
+			AcceptLanguage: truncateString(c.GetHeader("Accept-Language"), MAX_CLICK_HEADER_LENGTH),
+			ClickedOn:      time.Now().UTC(),
+		},
+	}
+}
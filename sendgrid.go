@@ -10,23 +10,37 @@ import (
 type Sendgrid struct {
 	client *sendgrid.Client
 	from   *mail.Email
+	apiKey string
 }
 
-func newSendGridClient() *Sendgrid {
-	client := sendgrid.NewSendClient(getEnv("SENDGRID_API_KEY"))
-	from := mail.NewEmail("Sender", getEnv("EMAILS_FROM"))
-	return &Sendgrid{client: client, from: from}
+func newSendGridClient(apiKey string, emailsFrom string) *Sendgrid {
+	client := sendgrid.NewSendClient(apiKey)
+	from := mail.NewEmail("Sender", emailsFrom)
+	return &Sendgrid{client: client, from: from, apiKey: apiKey}
 }
 
+func (s *Sendgrid) IsConfigured() bool {
+	return s.apiKey != "" && s.from.Address != ""
+}
+
+// SendEmailRequest's Content is the plain text body. When there's HtmlContent as well
+// the email is sent with both, for the recipient's client to choose from.
 type SendEmailRequest struct {
-	Email   string
-	Subject string
-	Content string
+	Email       string `json:"email"`
+	Subject     string `json:"subject"`
+	Content     string `json:"content"`
+	HtmlContent string `json:"html_content,omitempty"`
 }
 
 func (s *Sendgrid) SendEmail(request SendEmailRequest) error {
 	to := mail.NewEmail("Recipient", request.Email)
-	message := mail.NewSingleEmailPlainText(s.from, request.Subject, to, request.Content)
+	var message *mail.SGMailV3
+	if request.HtmlContent != "" {
+		message = mail.NewSingleEmail(s.from, request.Subject, to, request.Content, request.HtmlContent)
+	} else {
+		message = mail.NewSingleEmailPlainText(s.from, request.Subject, to, request.Content)
+	}
+
 	response, err := s.client.Send(message)
 	if err != nil {
 		return fmt.Errorf("error sending email %#v: %s", request, err)
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const REFRESH_TOKEN_LENGTH = 48
+
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type SessionResponse struct {
+	Id         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IpAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// issueTokens starts a new session for the user, from the device making the request.
+func (r *Controller) issueTokens(c *gin.Context, userId string) (TokenResponse, error) {
+	refreshToken := uniuri.NewLen(REFRESH_TOKEN_LENGTH)
+
+	csr := CreateSessionRequest{
+		UserId:           userId,
+		RefreshTokenHash: hashToken(refreshToken),
+		UserAgent:        truncateString(c.Request.UserAgent(), MAX_CLICK_HEADER_LENGTH),
+		IpAddress:        c.ClientIP(),
+		Ttl:              r.RefreshTokenTtl,
+	}
+
+	sessionId, err := r.Database.CreateSession(c, csr)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	return r.newTokenResponse(userId, sessionId, refreshToken)
+}
+
+func (r *Controller) newTokenResponse(userId string, sessionId string, refreshToken string) (TokenResponse, error) {
+	accessToken, err := r.TokenClient.GenerateToken(userId, sessionId)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+
+	response := TokenResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(r.AccessTokenTtl.Seconds()),
+	}
+
+	return response, nil
+}
+
+func (r *Controller) GetSessions(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	currentSessionId := c.GetString("sessionId")
+
+	sessions, err := r.Database.GetSessions(c, userId)
+	if err != nil {
+		log.Printf("error getting sessions for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []SessionResponse{}
+	for _, session := range sessions {
+		response = append(response, SessionResponse{
+			Id:         session.Id,
+			UserAgent:  session.UserAgent,
+			IpAddress:  session.IpAddress,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.Id == currentSessionId,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) RevokeSession(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	sessionId := c.Param("id")
+	if _, err := uuid.Parse(sessionId); err != nil {
+		log.Printf("invalid session id %s: %s", sessionId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	revoked, err := r.Database.RevokeSession(c, userId, sessionId)
+	if err != nil {
+		log.Printf("error revoking session id %s for user id %s: %s", sessionId, userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		log.Printf("active session id %s not found for user id %s", sessionId, userId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeOtherSessions signs the user out everywhere except the device making the request.
+func (r *Controller) RevokeOtherSessions(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	revoked, err := r.Database.RevokeOtherSessions(c, userId, c.GetString("sessionId"))
+	if err != nil {
+		log.Printf("error revoking sessions for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("revoked %d sessions for user id %s", revoked, userId)
+
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// GetJwks publishes the keys access tokens can be verified with, so other services
+// can check our tokens without sharing a secret.
+func (r *Controller) GetJwks(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, r.Jwks)
+}
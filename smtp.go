@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP_TLS_STARTTLS upgrades a plain connection, usually on port 587, while
+// SMTP_TLS_IMPLICIT connects over TLS from the start, usually on port 465.
+// SMTP_TLS_NONE is only meant for local relays and development servers.
+const SMTP_TLS_STARTTLS = "starttls"
+const SMTP_TLS_IMPLICIT = "tls"
+const SMTP_TLS_NONE = "none"
+
+const SMTP_AUTH_PLAIN = "plain"
+const SMTP_AUTH_LOGIN = "login"
+
+// SmtpEmailer sends emails through an SMTP server, such as a company relay. The
+// connection is kept open between emails and closed after idleTimeout without any.
+type SmtpEmailer struct {
+	address     string
+	host        string
+	from        string
+	tlsMode     string
+	tlsConfig   *tls.Config
+	auth        smtp.Auth
+	timeout     time.Duration
+	idleTimeout time.Duration
+
+	mu        sync.Mutex
+	conn      net.Conn
+	client    *smtp.Client
+	idleTimer *time.Timer
+}
+
+func newSmtpEmailer(config *Config) *SmtpEmailer {
+	s := &SmtpEmailer{
+		address:     net.JoinHostPort(config.SmtpHost, strconv.Itoa(config.SmtpPort)),
+		host:        config.SmtpHost,
+		from:        config.EmailsFrom,
+		tlsMode:     config.SmtpTls,
+		tlsConfig:   &tls.Config{ServerName: config.SmtpHost},
+		timeout:     config.SmtpTimeout,
+		idleTimeout: config.SmtpIdleTimeout,
+	}
+
+	if config.SmtpUsername != "" {
+		if config.SmtpAuth == SMTP_AUTH_LOGIN {
+			s.auth = &loginAuth{username: config.SmtpUsername, password: config.SmtpPassword, host: config.SmtpHost}
+		} else {
+			s.auth = smtp.PlainAuth("", config.SmtpUsername, config.SmtpPassword, config.SmtpHost)
+		}
+	}
+
+	return s
+}
+
+func (s *SmtpEmailer) IsConfigured() bool {
+	return s.host != "" && s.from != ""
+}
+
+func (s *SmtpEmailer) SendEmail(request SendEmailRequest) error {
+	message, err := buildEmailMessage(s.from, request, time.Now())
+	if err != nil {
+		return err
+	}
+
+	// buildEmailMessage has checked the addresses parse
+	sender, _ := mail.ParseAddress(s.from)
+	recipient, _ := mail.ParseAddress(request.Email)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+
+	err = s.send(client, sender.Address, recipient.Address, message)
+	if err != nil {
+		// the connection may be left mid-transaction, so start afresh next time
+		s.close()
+		return fmt.Errorf("error sending email to %s: %s", request.Email, err)
+	}
+
+	s.resetIdleTimer()
+
+	return nil
+}
+
+func (s *SmtpEmailer) send(client *smtp.Client, from string, to string, message []byte) error {
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	err := client.Mail(from)
+	if err != nil {
+		return err
+	}
+
+	err = client.Rcpt(to)
+	if err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(message)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+// connect reuses the open connection if the server still answers on it, or dials a
+// new one.
+func (s *SmtpEmailer) connect() (*smtp.Client, error) {
+	if s.client != nil {
+		s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+		if err := s.client.Noop(); err == nil {
+			return s.client, nil
+		}
+
+		s.close()
+	}
+
+	dialer := &net.Dialer{Timeout: s.timeout}
+
+	var conn net.Conn
+	var err error
+	if s.tlsMode == SMTP_TLS_IMPLICIT {
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", s.address)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to SMTP server %s: %s", s.address, err)
+	}
+
+	conn.SetDeadline(time.Now().Add(s.timeout))
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error starting SMTP session with %s: %s", s.address, err)
+	}
+
+	err = s.handshake(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	s.conn = conn
+	s.client = client
+
+	return client, nil
+}
+
+func (s *SmtpEmailer) handshake(client *smtp.Client) error {
+	if s.tlsMode == SMTP_TLS_STARTTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't support STARTTLS", s.address)
+		}
+
+		err := client.StartTLS(s.tlsConfig)
+		if err != nil {
+			return fmt.Errorf("error starting TLS with %s: %s", s.address, err)
+		}
+	}
+
+	if s.auth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't support AUTH", s.address)
+		}
+
+		err := client.Auth(s.auth)
+		if err != nil {
+			return fmt.Errorf("error authenticating with %s: %s", s.address, err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SmtpEmailer) resetIdleTimer() {
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+
+	s.idleTimer = time.AfterFunc(s.idleTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.close()
+	})
+}
+
+// close ends the session politely if it can, and drops the connection either way.
+func (s *SmtpEmailer) close() {
+	if s.client == nil {
+		return
+	}
+
+	s.conn.SetDeadline(time.Now().Add(s.timeout))
+
+	if err := s.client.Quit(); err != nil {
+		s.client.Close()
+	}
+
+	s.client = nil
+	s.conn = nil
+}
+
+// loginAuth is the LOGIN mechanism, which net/smtp doesn't have but Office 365 and
+// some older relays still ask for. Like smtp.PlainAuth it only sends the password
+// over TLS or to localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSuffix(strings.TrimSpace(string(fromServer)), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const smtpTestUsername = "links"
+const smtpTestPassword = "hunter2"
+
+// smtpStandIn is just enough of an SMTP server to send through. It only advertises
+// STARTTLS when starttls is set, and then refuses to start it. Recipients containing
+// "reject" are refused, and with dropAfterData it hangs up after each email.
+type smtpStandIn struct {
+	starttls      bool
+	dropAfterData bool
+
+	listener net.Listener
+	wg       sync.WaitGroup
+	quit     chan struct{}
+
+	mu          sync.Mutex
+	connections int
+	commands    []string
+	logins      []string
+	messages    []string
+}
+
+func (s *smtpStandIn) start(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %s", err)
+	}
+
+	s.listener = listener
+	s.quit = make(chan struct{}, 10)
+
+	s.wg.Add(1)
+	go s.serve()
+
+	t.Cleanup(func() {
+		listener.Close()
+		s.wg.Wait()
+	})
+}
+
+func (s *smtpStandIn) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpStandIn) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+
+		s.mu.Lock()
+		s.commands = append(s.commands, verb)
+		s.mu.Unlock()
+
+		switch verb {
+		case "EHLO":
+			extensions := []string{"localhost", "AUTH PLAIN LOGIN"}
+			if s.starttls {
+				extensions = append(extensions, "STARTTLS")
+			}
+
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+
+				text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			text.PrintfLine("454 TLS not available")
+		case "AUTH":
+			s.auth(text, arg)
+		case "MAIL", "NOOP", "RSET":
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if strings.Contains(arg, "reject") {
+				text.PrintfLine("550 No such user")
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+
+			message, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			s.mu.Lock()
+			s.messages = append(s.messages, string(message))
+			s.mu.Unlock()
+
+			text.PrintfLine("250 OK")
+
+			if s.dropAfterData {
+				return
+			}
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			s.quit <- struct{}{}
+			return
+		default:
+			text.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *smtpStandIn) auth(text *textproto.Conn, arg string) {
+	mechanism, initial, _ := strings.Cut(arg, " ")
+	mechanism = strings.ToUpper(mechanism)
+
+	var username, password string
+	switch mechanism {
+	case "PLAIN":
+		decoded, err := base64.StdEncoding.DecodeString(initial)
+		fields := strings.Split(string(decoded), "\x00")
+		if err != nil || len(fields) != 3 {
+			text.PrintfLine("501 Malformed PLAIN response")
+			return
+		}
+
+		username, password = fields[1], fields[2]
+	case "LOGIN":
+		username = s.challenge(text, "Username:")
+		password = s.challenge(text, "Password:")
+	default:
+		text.PrintfLine("504 Unrecognized mechanism")
+		return
+	}
+
+	s.mu.Lock()
+	s.logins = append(s.logins, mechanism+" "+username)
+	s.mu.Unlock()
+
+	if username != smtpTestUsername || password != smtpTestPassword {
+		text.PrintfLine("535 Authentication failed")
+		return
+	}
+
+	text.PrintfLine("235 Authenticated")
+}
+
+func (s *smtpStandIn) challenge(text *textproto.Conn, prompt string) string {
+	text.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+
+	line, err := text.ReadLine()
+	if err != nil {
+		return ""
+	}
+
+	decoded, _ := base64.StdEncoding.DecodeString(line)
+	return string(decoded)
+}
+
+func (s *smtpStandIn) connectionCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connections
+}
+
+func (s *smtpStandIn) receivedLogins() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.logins...)
+}
+
+func (s *smtpStandIn) receivedMessages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.messages...)
+}
+
+// received counts the times the verb was sent, on any connection.
+func (s *smtpStandIn) received(verb string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, command := range s.commands {
+		if command == verb {
+			count++
+		}
+	}
+
+	return count
+}
+
+func newTestSmtpEmailer(t *testing.T, standIn *smtpStandIn, tlsMode string, auth string, password string) *SmtpEmailer {
+	port := standIn.listener.Addr().(*net.TCPAddr).Port
+
+	emailer := newSmtpEmailer(&Config{
+		EmailsFrom:      "Links <links@example.com>",
+		SmtpHost:        "127.0.0.1",
+		SmtpPort:        port,
+		SmtpUsername:    smtpTestUsername,
+		SmtpPassword:    password,
+		SmtpTls:         tlsMode,
+		SmtpAuth:        auth,
+		SmtpTimeout:     5 * time.Second,
+		SmtpIdleTimeout: time.Minute,
+	})
+
+	t.Cleanup(func() {
+		emailer.mu.Lock()
+		defer emailer.mu.Unlock()
+
+		if emailer.idleTimer != nil {
+			emailer.idleTimer.Stop()
+		}
+
+		emailer.close()
+	})
+
+	return emailer
+}
+
+func testEmail(to string) SendEmailRequest {
+	return SendEmailRequest{
+		Email:       to,
+		Subject:     "Someone clicked your link",
+		Content:     "Your link was clicked.\n",
+		HtmlContent: "<p>Your link was clicked.</p>",
+	}
+}
+
+func TestSmtpEmailerSendsWithPlainAuth(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	err := emailer.SendEmail(testEmail("someone@example.com"))
+	if err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+
+	logins := standIn.receivedLogins()
+	if len(logins) != 1 || logins[0] != "PLAIN "+smtpTestUsername {
+		t.Errorf("logins = %v, want a PLAIN one", logins)
+	}
+
+	messages := standIn.receivedMessages()
+	if len(messages) != 1 {
+		t.Fatalf("%d messages received, want 1", len(messages))
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(messages[0]))
+	if err != nil {
+		t.Fatalf("error parsing message: %s", err)
+	}
+
+	if to := message.Header.Get("To"); to != "<someone@example.com>" {
+		t.Errorf("To = %s", to)
+	}
+}
+
+func TestSmtpEmailerSendsWithLoginAuth(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_LOGIN, smtpTestPassword)
+
+	err := emailer.SendEmail(testEmail("someone@example.com"))
+	if err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+
+	logins := standIn.receivedLogins()
+	if len(logins) != 1 || logins[0] != "LOGIN "+smtpTestUsername {
+		t.Errorf("logins = %v, want a LOGIN one", logins)
+	}
+
+	if len(standIn.receivedMessages()) != 1 {
+		t.Errorf("%d messages received, want 1", len(standIn.receivedMessages()))
+	}
+}
+
+func TestSmtpEmailerFailsWithWrongPassword(t *testing.T) {
+	for _, auth := range []string{SMTP_AUTH_PLAIN, SMTP_AUTH_LOGIN} {
+		standIn := &smtpStandIn{}
+		standIn.start(t)
+
+		emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, auth, "wrong")
+
+		err := emailer.SendEmail(testEmail("someone@example.com"))
+		if err == nil {
+			t.Errorf("%s: sent with the wrong password", auth)
+		}
+
+		if standIn.received("MAIL") != 0 {
+			t.Errorf("%s: MAIL sent after failing to authenticate", auth)
+		}
+	}
+}
+
+func TestSmtpEmailerRefusesServerWithoutStartTls(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_STARTTLS, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	err := emailer.SendEmail(testEmail("someone@example.com"))
+	if err == nil || !strings.Contains(err.Error(), "doesn't support STARTTLS") {
+		t.Fatalf("err = %v, want STARTTLS not supported", err)
+	}
+
+	if standIn.received("AUTH") != 0 || standIn.received("MAIL") != 0 {
+		t.Error("AUTH or MAIL sent in the clear")
+	}
+}
+
+func TestSmtpEmailerFailsWhenStartTlsIsRefused(t *testing.T) {
+	standIn := &smtpStandIn{starttls: true}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_STARTTLS, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	err := emailer.SendEmail(testEmail("someone@example.com"))
+	if err == nil || !strings.Contains(err.Error(), "error starting TLS") {
+		t.Fatalf("err = %v, want an error starting TLS", err)
+	}
+
+	if standIn.received("AUTH") != 0 || standIn.received("MAIL") != 0 {
+		t.Error("AUTH or MAIL sent in the clear")
+	}
+}
+
+func TestSmtpEmailerReusesConnection(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	for i := 0; i < 3; i++ {
+		err := emailer.SendEmail(testEmail("someone@example.com"))
+		if err != nil {
+			t.Fatalf("error sending email %d: %s", i, err)
+		}
+	}
+
+	if standIn.connectionCount() != 1 {
+		t.Errorf("%d connections, want 1", standIn.connectionCount())
+	}
+
+	if standIn.received("NOOP") != 2 {
+		t.Errorf("%d NOOPs, want one before each reuse", standIn.received("NOOP"))
+	}
+
+	if standIn.received("AUTH") != 1 {
+		t.Errorf("%d AUTHs, want 1", standIn.received("AUTH"))
+	}
+
+	if len(standIn.receivedMessages()) != 3 {
+		t.Errorf("%d messages received, want 3", len(standIn.receivedMessages()))
+	}
+}
+
+func TestSmtpEmailerReconnectsAfterFailedSend(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	err := emailer.SendEmail(testEmail("reject@example.com"))
+	if err == nil {
+		t.Fatal("sent to a rejected recipient")
+	}
+
+	err = emailer.SendEmail(testEmail("someone@example.com"))
+	if err != nil {
+		t.Fatalf("error sending after a failure: %s", err)
+	}
+
+	if standIn.connectionCount() != 2 {
+		t.Errorf("%d connections, want a new one after the failure", standIn.connectionCount())
+	}
+
+	if standIn.received("QUIT") != 1 {
+		t.Errorf("%d QUITs, want the failed connection ended", standIn.received("QUIT"))
+	}
+
+	if len(standIn.receivedMessages()) != 1 {
+		t.Errorf("%d messages received, want 1", len(standIn.receivedMessages()))
+	}
+}
+
+func TestSmtpEmailerReconnectsWhenServerHangsUp(t *testing.T) {
+	standIn := &smtpStandIn{dropAfterData: true}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_PLAIN, smtpTestPassword)
+
+	for i := 0; i < 2; i++ {
+		err := emailer.SendEmail(testEmail("someone@example.com"))
+		if err != nil {
+			t.Fatalf("error sending email %d: %s", i, err)
+		}
+	}
+
+	if standIn.connectionCount() != 2 {
+		t.Errorf("%d connections, want a new one once the NOOP fails", standIn.connectionCount())
+	}
+
+	if len(standIn.receivedMessages()) != 2 {
+		t.Errorf("%d messages received, want 2", len(standIn.receivedMessages()))
+	}
+}
+
+func TestSmtpEmailerClosesIdleConnection(t *testing.T) {
+	standIn := &smtpStandIn{}
+	standIn.start(t)
+
+	emailer := newTestSmtpEmailer(t, standIn, SMTP_TLS_NONE, SMTP_AUTH_PLAIN, smtpTestPassword)
+	emailer.idleTimeout = 50 * time.Millisecond
+
+	err := emailer.SendEmail(testEmail("someone@example.com"))
+	if err != nil {
+		t.Fatalf("error sending: %s", err)
+	}
+
+	select {
+	case <-standIn.quit:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+
+	// the timer holds the lock until it's done closing
+	emailer.mu.Lock()
+	client := emailer.client
+	emailer.mu.Unlock()
+
+	if client != nil {
+		t.Error("client kept after closing")
+	}
+
+	err = emailer.SendEmail(testEmail("someone@example.com"))
+	if err != nil {
+		t.Fatalf("error sending after closing: %s", err)
+	}
+
+	if standIn.connectionCount() != 2 {
+		t.Errorf("%d connections, want a new one after closing", standIn.connectionCount())
+	}
+}
+
+func TestLoginAuthOnlySendsPasswordOverTlsOrToLocalhost(t *testing.T) {
+	auth := &loginAuth{username: smtpTestUsername, password: smtpTestPassword, host: "smtp.example.com"}
+
+	_, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: false})
+	if err == nil {
+		t.Error("started over an unencrypted connection")
+	}
+
+	_, _, err = auth.Start(&smtp.ServerInfo{Name: "other.example.com", TLS: true})
+	if err == nil {
+		t.Error("started with the wrong host")
+	}
+
+	mechanism, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", TLS: true})
+	if err != nil || mechanism != "LOGIN" {
+		t.Errorf("Start = %s, %v, want LOGIN", mechanism, err)
+	}
+
+	_, err = auth.Next([]byte("Something else:"), true)
+	if err == nil {
+		t.Error("answered an unexpected challenge")
+	}
+}
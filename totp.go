@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// TOTP as in RFC 6238 with the defaults every authenticator app supports: SHA1,
+// 6 digits and 30 second steps.
+const TOTP_SECRET_LENGTH = 20
+const TOTP_DIGITS = 6
+const TOTP_PERIOD = 30
+
+// TOTP_SKEW is how many steps either side of the current one are accepted, to allow
+// for clock drift and slow typing.
+const TOTP_SKEW = 1
+
+const RECOVERY_CODE_COUNT = 10
+const RECOVERY_CODE_LENGTH = 10
+
+var recoveryCodeChars = []byte("abcdefghjkmnpqrstuvwxyz23456789")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() (string, error) {
+	secret := make([]byte, TOTP_SECRET_LENGTH)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", fmt.Errorf("error generating totp secret: %s", err)
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+func totpUri(issuer string, email string, secret string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	query.Set("period", fmt.Sprint(TOTP_PERIOD))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + email,
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// validateTotpCode returns the time step the code is valid for, which callers record
+// so the same code can't be used twice.
+func validateTotpCode(secret string, code string, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+
+	current := now.Unix() / TOTP_PERIOD
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		expected := totpCode(key, step)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpCode(key []byte, step int64) string {
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%06d", truncated%1000000)
+}
+
+// generateRecoveryCodes returns the codes to show the user, formatted as xxxxx-xxxxx,
+// along with the hashes to store.
+func generateRecoveryCodes() ([]string, []string) {
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		code := uniuri.NewLenChars(RECOVERY_CODE_LENGTH, recoveryCodeChars)
+		codes = append(codes, code[:RECOVERY_CODE_LENGTH/2]+"-"+code[RECOVERY_CODE_LENGTH/2:])
+		hashes = append(hashes, hashToken(code))
+	}
+
+	return codes, hashes
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash, in any case.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	return code
+}
+
+func isTotpCodeFormat(code string) bool {
+	if len(code) != TOTP_DIGITS {
+		return false
+	}
+
+	for _, char := range code {
+		if char < '0' || char > '9' {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 vectors from RFC 6238 Appendix B. They're 8 digits, and a 6 digit code is
+// their last 6.
+var rfc6238Key = []byte("12345678901234567890")
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+func TestTotpCodeMatchesRfc6238(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		step := vector.unix / TOTP_PERIOD
+
+		code := totpCode(rfc6238Key, step)
+		if code != vector.code[2:] {
+			t.Errorf("code at %d = %s, want %s", vector.unix, code, vector.code[2:])
+		}
+	}
+}
+
+func TestValidateTotpCodeMatchesRfc6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+
+	for _, vector := range rfc6238Vectors {
+		step, valid := validateTotpCode(secret, vector.code[2:], time.Unix(vector.unix, 0))
+		if !valid {
+			t.Errorf("code %s not valid at %d", vector.code[2:], vector.unix)
+			continue
+		}
+
+		if step != vector.unix/TOTP_PERIOD {
+			t.Errorf("code %s at %d valid for step %d, want %d", vector.code[2:], vector.unix, step, vector.unix/TOTP_PERIOD)
+		}
+	}
+}
+
+func TestValidateTotpCodeAllowsOneStepOfSkew(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	now := time.Unix(1111111111, 0)
+	current := now.Unix() / TOTP_PERIOD
+
+	tests := []struct {
+		offset int64
+		valid  bool
+	}{
+		{-2, false},
+		{-1, true},
+		{0, true},
+		{1, true},
+		{2, false},
+	}
+
+	for _, test := range tests {
+		code := totpCode(rfc6238Key, current+test.offset)
+
+		step, valid := validateTotpCode(secret, code, now)
+		if valid != test.valid {
+			t.Errorf("code for step %+d: valid = %t, want %t", test.offset, valid, test.valid)
+			continue
+		}
+
+		if valid && step != current+test.offset {
+			t.Errorf("code for step %+d valid for step %d, want %d", test.offset, step, current+test.offset)
+		}
+	}
+}
+
+func TestValidateTotpCodeRejectsMalformedInput(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Key)
+	now := time.Unix(59, 0)
+
+	tests := []struct {
+		name   string
+		secret string
+		code   string
+	}{
+		{"8 digit code", secret, "94287082"},
+		{"short code", secret, "28708"},
+		{"empty code", secret, ""},
+		{"invalid secret", "not base32!", "287082"},
+	}
+
+	for _, test := range tests {
+		if _, valid := validateTotpCode(test.secret, test.code, now); valid {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import "strings"
+
+const DEVICE_DESKTOP = "desktop"
+const DEVICE_MOBILE = "mobile"
+const DEVICE_TABLET = "tablet"
+
+func newUserAgentParser() *RuleBasedUserAgentParser {
+	return &RuleBasedUserAgentParser{}
+}
+
+type DeviceInfo struct {
+	DeviceType string
+	Browser    string
+	OS         string
+}
+
+// RuleBasedUserAgentParser classifies user agents by looking for well known tokens.
+// Rules are checked in order and the first match wins, so more specific tokens
+// (e.g. "Edg/" or "like Mac OS X") need to come before the generic ones they contain.
+type RuleBasedUserAgentParser struct{}
+
+type userAgentRule struct {
+	tokens []string
+	name   string
+}
+
+var tabletTokens = []string{"iPad", "Tablet", "Kindle", "Silk/", "PlayBook"}
+
+var mobileTokens = []string{"Mobi", "iPhone", "iPod", "Android", "Windows Phone", "BlackBerry", "Opera Mini"}
+
+var browserRules = []userAgentRule{
+	{tokens: []string{"Edg/", "Edge/", "EdgA/", "EdgiOS/"}, name: "Edge"},
+	{tokens: []string{"OPR/", "Opera"}, name: "Opera"},
+	{tokens: []string{"SamsungBrowser/"}, name: "Samsung Internet"},
+	{tokens: []string{"Microsoft Outlook", "Outlook-iOS", "Outlook-Android"}, name: "Outlook"},
+	{tokens: []string{"Thunderbird/"}, name: "Thunderbird"},
+	{tokens: []string{"Firefox/", "FxiOS/"}, name: "Firefox"},
+	{tokens: []string{"CriOS/", "Chrome/", "Chromium/"}, name: "Chrome"},
+	{tokens: []string{"MSIE ", "Trident/"}, name: "Internet Explorer"},
+	{tokens: []string{"Safari/"}, name: "Safari"},
+}
+
+var osRules = []userAgentRule{
+	{tokens: []string{"Windows Phone"}, name: "Windows Phone"},
+	{tokens: []string{"iPhone", "iPad", "iPod"}, name: "iOS"},
+	{tokens: []string{"Android"}, name: "Android"},
+	{tokens: []string{"CrOS"}, name: "Chrome OS"},
+	{tokens: []string{"Windows"}, name: "Windows"},
+	{tokens: []string{"Macintosh", "Mac OS X"}, name: "macOS"},
+	{tokens: []string{"Linux", "X11"}, name: "Linux"},
+}
+
+func (p *RuleBasedUserAgentParser) Parse(userAgent string) DeviceInfo {
+	info := DeviceInfo{}
+
+	if lengthOfString(userAgent) == 0 {
+		return info
+	}
+
+	info.DeviceType = classifyDeviceType(userAgent)
+	info.Browser = matchUserAgentRule(userAgent, browserRules)
+	info.OS = matchUserAgentRule(userAgent, osRules)
+
+	return info
+}
+
+func classifyDeviceType(userAgent string) string {
+	if containsAny(userAgent, tabletTokens) {
+		return DEVICE_TABLET
+	}
+
+	// Android phones advertise "Mobile", Android tablets don't
+	if strings.Contains(userAgent, "Android") && !strings.Contains(userAgent, "Mobile") {
+		return DEVICE_TABLET
+	}
+
+	if containsAny(userAgent, mobileTokens) {
+		return DEVICE_MOBILE
+	}
+
+	return DEVICE_DESKTOP
+}
+
+func matchUserAgentRule(userAgent string, rules []userAgentRule) string {
+	for _, rule := range rules {
+		if containsAny(userAgent, rule.tokens) {
+			return rule.name
+		}
+	}
+
+	return ""
+}
+
+func containsAny(input string, tokens []string) bool {
+	for _, token := range tokens {
+		if strings.Contains(input, token) {
+			return true
+		}
+	}
+
+	return false
+}
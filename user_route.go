@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/dchest/uniuri"
 	"github.com/gin-gonic/gin"
@@ -18,30 +19,113 @@ func (r *Controller) SetAuthenticatedUser(c *gin.Context) {
 		return
 	}
 
-	userId, err := r.TokenClient.GetUserId(token)
+	if strings.HasPrefix(token, API_KEY_PREFIX) {
+		r.authenticateApiKey(c, token)
+		return
+	}
+
+	claims, err := r.TokenClient.ParseToken(token)
 	if err != nil {
 		log.Println("error to fetch user id from token:", err)
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
-	exists, err := r.Database.UserIdExists(c, userId)
+	userId := claims.UserId
+
+	result, err := r.Database.GetSessionUser(c, claims.SessionId)
 	if err != nil {
-		log.Printf("error to check if user id %s exists: %s", userId, err)
+		log.Printf("error to check if session id %s is active: %s", claims.SessionId, err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	if !exists {
-		log.Printf("user id %s does not exist", userId)
+	if !result.Found || result.User.Id != userId {
+		log.Printf("session id %s for user id %s is not active", claims.SessionId, userId)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	if tokenIssuedBefore(claims.IssuedAt, result.User.TokensValidAfter) {
+		log.Printf("token for user id %s was issued before its sessions were invalidated", userId)
 		c.AbortWithStatus(http.StatusUnauthorized)
 		return
 	}
 
 	c.Set("userId", userId)
+	c.Set("sessionId", claims.SessionId)
+	c.Set("authScope", SCOPE_FULL)
+	c.Next()
+}
+
+func (r *Controller) authenticateApiKey(c *gin.Context, key string) {
+	result, err := r.Database.UseApiKey(c, hashToken(key))
+	if err != nil {
+		log.Println("error to look up api key:", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Found {
+		log.Printf("api key %s is unknown or revoked", apiKeyPrefix(key))
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	c.Set("userId", result.ApiKey.UserId)
+	c.Set("apiKeyId", result.ApiKey.Id)
+	c.Set("authScope", result.ApiKey.Scope)
+	c.Next()
+}
+
+// requireScope lets requests through when they're authenticated with the full
+// scope (any session, or an unrestricted API key) or one of the given scopes.
+func requireScope(scopes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scope := c.GetString("authScope")
+
+		if scope == SCOPE_FULL {
+			c.Next()
+			return
+		}
+
+		for _, allowed := range scopes {
+			if scope == allowed {
+				c.Next()
+				return
+			}
+		}
+
+		log.Printf("scope %s not allowed for %s %s", scope, c.Request.Method, c.FullPath())
+		c.AbortWithStatusJSON(http.StatusForbidden, "API key scope doesn't allow this")
+	}
+}
+
+// requireSession only lets through requests authenticated by logging in, not by API key.
+func requireSession(c *gin.Context) {
+	if c.GetString("sessionId") == "" {
+		log.Printf("%s %s requires a session", c.Request.Method, c.FullPath())
+		c.AbortWithStatusJSON(http.StatusForbidden, "This requires logging in rather than an API key")
+		return
+	}
+
 	c.Next()
 }
 
+// tokenIssuedBefore compares at the JWT's one second precision, so a token issued
+// in the same second as a password reset is still accepted.
+func tokenIssuedBefore(issuedAt *time.Time, validAfter *time.Time) bool {
+	if validAfter == nil {
+		return false
+	}
+
+	if issuedAt == nil {
+		return true
+	}
+
+	return issuedAt.Before(validAfter.Truncate(time.Second))
+}
+
 func getTokenFromRequest(c *gin.Context) (string, error) {
 	header := c.GetHeader("Authorization")
 	if lengthOfString(header) == 0 {
@@ -50,7 +134,8 @@ func getTokenFromRequest(c *gin.Context) (string, error) {
 
 	bearerSlice := strings.Split(header, " ")
 	if len(bearerSlice) != 2 || bearerSlice[0] != "Bearer" || lengthOfString(bearerSlice[1]) == 0 {
-		return "", fmt.Errorf("invalid Authorization header: %s", header)
+		// the header may be a bare secret, so none of it is logged
+		return "", fmt.Errorf("invalid Authorization header")
 	}
 
 	return bearerSlice[1], nil
@@ -77,10 +162,11 @@ func (r *Controller) TrackLink(c *gin.Context) {
 	url := addHttpsToUrlIfNotIncludedAlready(apiRequest.Url)
 
 	redirectRequest := AddRedirectRequest{
-		UserId: userId,
-		Url:    url,
-		Path:   path,
-		Tag:    apiRequest.Tag,
+		UserId:      userId,
+		WorkspaceId: c.GetString("workspaceId"),
+		Url:         url,
+		Path:        path,
+		Tag:         apiRequest.Tag,
 	}
 
 	err = r.Database.AddRedirect(c, redirectRequest)
@@ -1,29 +1,25 @@
 package main
 
 import (
-	"log"
-	"os"
-	"strconv"
+	"crypto/sha256"
+	"encoding/hex"
 )
 
 func lengthOfString(input string) int {
 	return len([]rune(input))
 }
 
-func getEnv(env string) string {
-	val := os.Getenv(env)
-
-	if val == "" {
-		log.Panicf("environment variable %s not found", env)
+func truncateString(input string, maxLength int) string {
+	runes := []rune(input)
+	if len(runes) <= maxLength {
+		return input
 	}
-
-	return val
+	return string(runes[:maxLength])
 }
 
-func getInt(val string) int {
-	valInt, err := strconv.Atoi(val)
-	if err != nil {
-		log.Fatalf("couldn't convert val = %s from string to int: %s", val, err)
-	}
-	return valInt
+// hashToken is for random, high-entropy tokens we hand out and only need to look
+// up again. Passwords are hashed with bcrypt instead.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
 }
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const WEBHOOK_EVENT_LINK_CLICKED = "link.clicked"
+const WEBHOOK_EVENT_PING = "ping"
+
+const WEBHOOK_MAX_ERROR_LENGTH = 500
+
+// WebhookEvent is the JSON body POSTed to webhook endpoints.
+type WebhookEvent struct {
+	Id        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type WebhookClickData struct {
+	LinkId      string               `json:"link_id"`
+	WorkspaceId string               `json:"workspace_id"`
+	TrackedUrl  string               `json:"tracked_url"`
+	Url         string               `json:"url"`
+	Tag         string               `json:"tag"`
+	ClickCount  int                  `json:"click_count"`
+	ClickedAt   time.Time            `json:"clicked_at"`
+	Referrer    string               `json:"referrer"`
+	Location    WebhookClickLocation `json:"location"`
+	Device      WebhookClickDevice   `json:"device"`
+}
+
+type WebhookClickLocation struct {
+	CountryCode string `json:"country_code"`
+	Region      string `json:"region"`
+	City        string `json:"city"`
+}
+
+type WebhookClickDevice struct {
+	Type    string `json:"type"`
+	Browser string `json:"browser"`
+	OS      string `json:"os"`
+}
+
+func (d WebhookDeliveryRecord) Succeeded() bool {
+	return d.Error == ""
+}
+
+// webhookDelivery is one event on its way to one endpoint.
+type webhookDelivery struct {
+	Webhook WebhookRecord
+	EventId string
+	Payload []byte
+	Attempt int
+}
+
+// WebhookMessage is the outbox payload for one event to one endpoint. The body is
+// stored as it will be sent, so every attempt is signed over the same bytes.
+type WebhookMessage struct {
+	WebhookId   string `json:"webhook_id"`
+	WorkspaceId string `json:"workspace_id"`
+	EventId     string `json:"event_id"`
+	Body        []byte `json:"body"`
+}
+
+// WebhookNotifier POSTs clicks to the endpoints registered for the link's workspace,
+// as signed JSON events or as Slack or Teams messages. Each endpoint gets its own
+// outbox message, so a failing endpoint is retried without holding up the others,
+// and every attempt is recorded in the endpoint's delivery log.
+type WebhookNotifier struct {
+	database Database
+	client   *http.Client
+}
+
+func newWebhookNotifier(database Database, config *Config) *WebhookNotifier {
+	return &WebhookNotifier{
+		database: database,
+		client:   newWebhookHttpClient(config.WebhookTimeout, config.WebhookAllowPrivateNetworks),
+	}
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhooks"
+}
+
+func (n *WebhookNotifier) ClickMessages(ctx context.Context, notification ClickNotification) ([]OutboxMessage, error) {
+	webhooks, err := n.database.GetWebhooks(ctx, notification.WorkspaceId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhooks: %s", err)
+	}
+
+	payloads := map[string][]byte{}
+	messages := []OutboxMessage{}
+
+	for _, webhook := range webhooks {
+		if !webhookWantsClick(webhook, notification) {
+			continue
+		}
+
+		payload, encoded := payloads[webhook.Format]
+		if !encoded {
+			payload, err = json.Marshal(clickPayload(webhook.Format, notification))
+			if err != nil {
+				return nil, fmt.Errorf("error encoding %s webhook payload: %s", webhook.Format, err)
+			}
+			payloads[webhook.Format] = payload
+		}
+
+		wm := WebhookMessage{WebhookId: webhook.Id, WorkspaceId: webhook.WorkspaceId, EventId: notification.EventId, Body: payload}
+		message, err := newOutboxMessage(OUTBOX_KIND_WEBHOOK, wm)
+		if err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, nil
+}
+
+// HandleMessage makes one attempt at delivering a webhook message from the outbox.
+// Messages for endpoints that have since been deleted are dropped.
+func (n *WebhookNotifier) HandleMessage(ctx context.Context, message OutboxMessage) ([]OutboxMessage, error) {
+	wm := WebhookMessage{}
+	err := json.Unmarshal(message.Payload, &wm)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding webhook message: %s", err)
+	}
+
+	result, err := n.database.GetWebhook(ctx, wm.WorkspaceId, wm.WebhookId)
+	if err != nil {
+		return nil, fmt.Errorf("error getting webhook id %s: %s", wm.WebhookId, err)
+	}
+
+	if !result.Found {
+		log.Printf("webhook id %s no longer exists, dropping event %s", wm.WebhookId, wm.EventId)
+		return nil, nil
+	}
+
+	record := n.deliver(ctx, webhookDelivery{Webhook: result.Webhook, EventId: wm.EventId, Payload: wm.Body, Attempt: message.Attempts})
+	if !record.Succeeded() {
+		return nil, fmt.Errorf("error delivering event %s to webhook id %s: %s", wm.EventId, wm.WebhookId, record.Error)
+	}
+
+	return nil, nil
+}
+
+func webhookWantsClick(webhook WebhookRecord, notification ClickNotification) bool {
+	if webhook.Tag != "" && !strings.EqualFold(webhook.Tag, notification.Tag) {
+		return false
+	}
+
+	return webhook.LinkCreatorId == "" || webhook.LinkCreatorId == notification.CreatedBy
+}
+
+func clickPayload(format string, notification ClickNotification) any {
+	switch format {
+	case WEBHOOK_FORMAT_SLACK:
+		return slackClickMessage(notification)
+	case WEBHOOK_FORMAT_TEAMS:
+		return teamsClickMessage(notification)
+	default:
+		return WebhookEvent{
+			Id:        notification.EventId,
+			Type:      WEBHOOK_EVENT_LINK_CLICKED,
+			CreatedAt: time.Now().UTC(),
+			Data:      newWebhookClickData(notification),
+		}
+	}
+}
+
+func pingPayload(webhook WebhookRecord, eventId string) any {
+	text := "This is a test notification from LinkUp. Clicks on your links will show up here."
+
+	switch webhook.Format {
+	case WEBHOOK_FORMAT_SLACK:
+		return slackTextMessage(text)
+	case WEBHOOK_FORMAT_TEAMS:
+		return teamsTextMessage(text)
+	default:
+		return WebhookEvent{Id: eventId, Type: WEBHOOK_EVENT_PING, CreatedAt: time.Now().UTC(), Data: map[string]string{"webhook_id": webhook.Id}}
+	}
+}
+
+func newWebhookClickData(notification ClickNotification) WebhookClickData {
+	return WebhookClickData{
+		LinkId:      notification.LinkId,
+		WorkspaceId: notification.WorkspaceId,
+		TrackedUrl:  notification.TrackedUrl,
+		Url:         notification.RedirectUrl,
+		Tag:         notification.Tag,
+		ClickCount:  notification.ClickCount,
+		ClickedAt:   notification.ClickedOn,
+		Referrer:    notification.Referrer,
+		Location: WebhookClickLocation{
+			CountryCode: notification.Location.CountryCode,
+			Region:      notification.Location.Region,
+			City:        notification.Location.City,
+		},
+		Device: WebhookClickDevice{
+			Type:    notification.Device.DeviceType,
+			Browser: notification.Device.Browser,
+			OS:      notification.Device.OS,
+		},
+	}
+}
+
+// deliver makes one attempt at the delivery and records how it went.
+func (n *WebhookNotifier) deliver(ctx context.Context, delivery webhookDelivery) WebhookDeliveryRecord {
+	record := WebhookDeliveryRecord{WebhookId: delivery.Webhook.Id, EventId: delivery.EventId, Attempt: delivery.Attempt}
+
+	started := time.Now()
+	statusCode, err := n.post(ctx, delivery)
+	record.Duration = time.Since(started)
+	record.StatusCode = statusCode
+
+	if err != nil {
+		record.Error = truncateString(err.Error(), WEBHOOK_MAX_ERROR_LENGTH)
+	}
+
+	record, err = n.database.AddWebhookDelivery(ctx, record)
+	if err != nil {
+		log.Printf("error recording delivery of event %s to webhook id %s: %s", delivery.EventId, delivery.Webhook.Id, err)
+	}
+
+	return record
+}
+
+func (n *WebhookNotifier) post(ctx context.Context, delivery webhookDelivery) (int, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("error creating request: %s", err)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "LinkUp-Webhooks/1.0")
+	request.Header.Set("X-LinkUp-Delivery", delivery.EventId)
+	request.Header.Set("X-LinkUp-Timestamp", timestamp)
+	request.Header.Set("X-LinkUp-Signature", signWebhookPayload(delivery.Webhook.Secret, timestamp, delivery.Payload))
+
+	response, err := n.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("endpoint responded with status %d", response.StatusCode)
+	}
+
+	return response.StatusCode, nil
+}
+
+// Ping sends a test event to the endpoint straight away, without retrying.
+func (n *WebhookNotifier) Ping(ctx context.Context, webhook WebhookRecord) (WebhookDeliveryRecord, error) {
+	eventId := uuid.NewString()
+
+	payload, err := json.Marshal(pingPayload(webhook, eventId))
+	if err != nil {
+		return WebhookDeliveryRecord{}, fmt.Errorf("error encoding webhook event: %s", err)
+	}
+
+	return n.deliver(ctx, webhookDelivery{Webhook: webhook, EventId: eventId, Payload: payload, Attempt: 1}), nil
+}
+
+// signWebhookPayload is what receivers check X-LinkUp-Signature against: the
+// HMAC-SHA256 of "<timestamp>.<body>" keyed with the endpoint's secret. Including the
+// timestamp lets them reject old deliveries being replayed.
+func signWebhookPayload(secret string, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookHttpClient doesn't follow redirects, and unless allowPrivate is set
+// refuses to connect to loopback, private and link-local addresses, so webhooks can't
+// be used to reach services on our own network. The check is made on the address
+// actually dialled, after DNS resolution.
+func newWebhookHttpClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = rejectPrivateAddress
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+func rejectPrivateAddress(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("invalid address %s", address)
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("address %s is not publicly routable", ip)
+	}
+
+	return nil
+}
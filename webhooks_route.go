@@ -0,0 +1,331 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const WEBHOOK_SECRET_PREFIX = "whsec_"
+const WEBHOOK_SECRET_LENGTH = 32
+const MAX_WEBHOOKS_PER_WORKSPACE = 10
+const MAX_WEBHOOK_URL_LENGTH = 2048
+const MAX_WEBHOOK_DESCRIPTION_LENGTH = 200
+const WEBHOOK_DELIVERIES_PAGE_SIZE = 50
+
+// CreateWebhookApiRequest can narrow the webhook down to clicks on links with a tag,
+// or on links the user creating it made.
+type CreateWebhookApiRequest struct {
+	Url         string `json:"url" binding:"required"`
+	Description string `json:"description"`
+	Format      string `json:"format"`
+	Tag         string `json:"tag"`
+	OnlyMyLinks bool   `json:"only_my_links"`
+}
+
+type WebhookResponse struct {
+	Id          string    `json:"id"`
+	Url         string    `json:"url"`
+	Description string    `json:"description"`
+	Format      string    `json:"format"`
+	Tag         string    `json:"tag"`
+	OnlyMyLinks bool      `json:"only_my_links"`
+	CreatedAt   time.Time `json:"created_at"`
+	Secret      string    `json:"secret,omitempty"`
+}
+
+type WebhookDeliveryResponse struct {
+	Id         string    `json:"id"`
+	EventId    string    `json:"event_id"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Succeeded  bool      `json:"succeeded"`
+	DurationMs int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// CreateWebhook registers an endpoint for the workspace's clicks. The secret the
+// deliveries are signed with is only shown in this response. Members can only
+// register webhooks for the clicks on their own links, as if only_my_links were set.
+func (r *Controller) CreateWebhook(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apiRequest := CreateWebhookApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !isValidWebhookUrl(apiRequest.Url) {
+		log.Printf("invalid webhook url %s", apiRequest.Url)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "url must be an absolute http or https URL")
+		return
+	}
+
+	if apiRequest.Format == "" {
+		apiRequest.Format = WEBHOOK_FORMAT_JSON
+	}
+
+	if !isValidWebhookFormat(apiRequest.Format) {
+		log.Printf("invalid webhook format %s", apiRequest.Format)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "format must be one of "+strings.Join(webhookFormats, ", "))
+		return
+	}
+
+	webhooks, err := r.Database.GetWebhooks(c, workspaceId)
+	if err != nil {
+		log.Printf("error getting webhooks for workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if len(webhooks) >= MAX_WEBHOOKS_PER_WORKSPACE {
+		log.Printf("workspace id %s already has %d webhooks", workspaceId, len(webhooks))
+		c.AbortWithStatusJSON(http.StatusConflict, fmt.Sprintf("A workspace can have at most %d webhooks", MAX_WEBHOOKS_PER_WORKSPACE))
+		return
+	}
+
+	cwr := CreateWebhookRequest{
+		WorkspaceId: workspaceId,
+		Url:         apiRequest.Url,
+		Secret:      WEBHOOK_SECRET_PREFIX + uniuri.NewLen(WEBHOOK_SECRET_LENGTH),
+		Description: truncateString(apiRequest.Description, MAX_WEBHOOK_DESCRIPTION_LENGTH),
+		Format:      apiRequest.Format,
+		Tag:         strings.TrimSpace(apiRequest.Tag),
+		CreatedBy:   userId,
+	}
+
+	if apiRequest.OnlyMyLinks || ownWebhooksOnly(c) {
+		cwr.LinkCreatorId = userId
+	}
+
+	webhook, err := r.Database.CreateWebhook(c, cwr)
+	if err != nil {
+		log.Printf("error creating webhook for workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := toWebhookResponse(webhook)
+	response.Secret = webhook.Secret
+
+	c.JSON(http.StatusCreated, response)
+}
+
+func (r *Controller) GetWebhooks(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	webhooks, err := r.Database.GetWebhooks(c, workspaceId)
+	if err != nil {
+		log.Printf("error getting webhooks for workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []WebhookResponse{}
+	for _, webhook := range webhooks {
+		if canManageWebhook(c, webhook, userId) {
+			response = append(response, toWebhookResponse(webhook))
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) DeleteWebhook(c *gin.Context) {
+	webhook, found := r.getWebhook(c)
+	if !found {
+		return
+	}
+
+	deleted, err := r.Database.DeleteWebhook(c, webhook.WorkspaceId, webhook.Id)
+	if err != nil {
+		log.Printf("error deleting webhook id %s: %s", webhook.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !deleted {
+		log.Printf("webhook id %s not found for workspace id %s", webhook.Id, webhook.WorkspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GetWebhookDeliveries is the endpoint's delivery log, most recent attempts first.
+func (r *Controller) GetWebhookDeliveries(c *gin.Context) {
+	webhook, found := r.getWebhook(c)
+	if !found {
+		return
+	}
+
+	deliveries, err := r.Database.GetWebhookDeliveries(c, webhook.Id, WEBHOOK_DELIVERIES_PAGE_SIZE)
+	if err != nil {
+		log.Printf("error getting deliveries for webhook id %s: %s", webhook.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []WebhookDeliveryResponse{}
+	for _, delivery := range deliveries {
+		response = append(response, toWebhookDeliveryResponse(delivery))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// PingWebhook sends a test event so the endpoint can be checked before real clicks
+// come in.
+func (r *Controller) PingWebhook(c *gin.Context) {
+	webhook, found := r.getWebhook(c)
+	if !found {
+		return
+	}
+
+	delivery, err := r.WebhookNotifier.Ping(c, webhook)
+	if err != nil {
+		log.Printf("error pinging webhook id %s: %s", webhook.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, toWebhookDeliveryResponse(delivery))
+}
+
+// getWebhook finds the webhook in the URL, treating members' requests for webhooks
+// other than their own as not found.
+func (r *Controller) getWebhook(c *gin.Context) (WebhookRecord, bool) {
+	workspaceId, webhookId, ok := getWorkspaceIdAndWebhookId(c)
+	if !ok {
+		return WebhookRecord{}, false
+	}
+
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return WebhookRecord{}, false
+	}
+
+	result, err := r.Database.GetWebhook(c, workspaceId, webhookId)
+	if err != nil {
+		log.Printf("error getting webhook id %s: %s", webhookId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return WebhookRecord{}, false
+	}
+
+	if !result.Found {
+		log.Printf("webhook id %s not found for workspace id %s", webhookId, workspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return WebhookRecord{}, false
+	}
+
+	if !canManageWebhook(c, result.Webhook, userId) {
+		log.Printf("user id %s can't manage webhook id %s in workspace id %s", userId, webhookId, workspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return WebhookRecord{}, false
+	}
+
+	return result.Webhook, true
+}
+
+// ownWebhooksOnly is whether the user is limited to webhooks for the clicks on their
+// own links. Admins manage all of the workspace's webhooks, members only those.
+func ownWebhooksOnly(c *gin.Context) bool {
+	return !hasWorkspaceRole(c.GetString("workspaceRole"), WORKSPACE_ROLE_ADMIN)
+}
+
+func canManageWebhook(c *gin.Context, webhook WebhookRecord, userId string) bool {
+	return !ownWebhooksOnly(c) || webhook.LinkCreatorId == userId
+}
+
+func getWorkspaceIdAndWebhookId(c *gin.Context) (string, string, bool) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", "", false
+	}
+
+	webhookId := c.Param("id")
+	if _, err := uuid.Parse(webhookId); err != nil {
+		log.Printf("invalid webhook id %s: %s", webhookId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return "", "", false
+	}
+
+	return workspaceId, webhookId, true
+}
+
+func isValidWebhookUrl(rawUrl string) bool {
+	if lengthOfString(rawUrl) > MAX_WEBHOOK_URL_LENGTH {
+		return false
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return false
+	}
+
+	return (parsed.Scheme == "https" || parsed.Scheme == "http") && parsed.Host != "" && parsed.User == nil
+}
+
+func toWebhookResponse(webhook WebhookRecord) WebhookResponse {
+	return WebhookResponse{
+		Id:          webhook.Id,
+		Url:         webhook.Url,
+		Description: webhook.Description,
+		Format:      webhook.Format,
+		Tag:         webhook.Tag,
+		OnlyMyLinks: webhook.LinkCreatorId != "",
+		CreatedAt:   webhook.CreatedAt,
+	}
+}
+
+func toWebhookDeliveryResponse(delivery WebhookDeliveryRecord) WebhookDeliveryResponse {
+	return WebhookDeliveryResponse{
+		Id:         delivery.Id,
+		EventId:    delivery.EventId,
+		Attempt:    delivery.Attempt,
+		StatusCode: delivery.StatusCode,
+		Error:      delivery.Error,
+		Succeeded:  delivery.Succeeded(),
+		DurationMs: delivery.Duration.Milliseconds(),
+		CreatedAt:  delivery.CreatedAt,
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeWebhookDatabase has the webhooks and delivery log WebhookNotifier uses, and
+// panics on anything else.
+type fakeWebhookDatabase struct {
+	Database
+
+	mu         sync.Mutex
+	webhooks   []WebhookRecord
+	deliveries []WebhookDeliveryRecord
+}
+
+func (d *fakeWebhookDatabase) GetWebhooks(ctx context.Context, workspaceId string) ([]WebhookRecord, error) {
+	webhooks := []WebhookRecord{}
+	for _, webhook := range d.webhooks {
+		if webhook.WorkspaceId == workspaceId {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (d *fakeWebhookDatabase) GetWebhook(ctx context.Context, workspaceId string, webhookId string) (ResultForGetWebhookRequest, error) {
+	for _, webhook := range d.webhooks {
+		if webhook.WorkspaceId == workspaceId && webhook.Id == webhookId {
+			return ResultForGetWebhookRequest{Found: true, Webhook: webhook}, nil
+		}
+	}
+
+	return ResultForGetWebhookRequest{}, nil
+}
+
+func (d *fakeWebhookDatabase) AddWebhookDelivery(ctx context.Context, delivery WebhookDeliveryRecord) (WebhookDeliveryRecord, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.deliveries = append(d.deliveries, delivery)
+
+	return delivery, nil
+}
+
+// webhookRequest is a request the stand-in endpoint received.
+type webhookRequest struct {
+	Path    string
+	Headers http.Header
+	Body    []byte
+}
+
+// newWebhookEndpoint is a stand-in for the endpoints webhooks are POSTed to. Requests
+// to /fail are answered with a 500.
+func newWebhookEndpoint(t *testing.T) (*httptest.Server, func() []webhookRequest) {
+	var mu sync.Mutex
+	requests := []webhookRequest{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, webhookRequest{Path: r.URL.Path, Headers: r.Header.Clone(), Body: body})
+		mu.Unlock()
+
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(server.Close)
+
+	received := func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]webhookRequest{}, requests...)
+	}
+
+	return server, received
+}
+
+func newTestWebhookNotifier(database Database) *WebhookNotifier {
+	return newWebhookNotifier(database, &Config{WebhookTimeout: 5 * time.Second, WebhookAllowPrivateNetworks: true})
+}
+
+func newTestClickNotification() ClickNotification {
+	return ClickNotification{
+		EventId:     "event-1",
+		LinkId:      "link-1",
+		WorkspaceId: "workspace-1",
+		CreatedBy:   "user-1",
+		Path:        "abc123",
+		TrackedUrl:  "https://linkup.example.com/r/abc123",
+		RedirectUrl: "https://example.com/pricing",
+		Tag:         "Bob <CEO> & co",
+		ClickCount:  3,
+		ClickedOn:   time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Location:    GeoLocation{CountryCode: "ES", Region: "Madrid", City: "Madrid"},
+		Device:      DeviceInfo{DeviceType: "mobile", Browser: "Safari", OS: "iOS"},
+	}
+}
+
+// deliverClick queues the click the way handleClickMessage does and delivers every
+// message, returning the errors by webhook id.
+func deliverClick(t *testing.T, notifier *WebhookNotifier, notification ClickNotification) map[string]error {
+	messages, err := notifier.ClickMessages(context.Background(), notification)
+	if err != nil {
+		t.Fatalf("error getting click messages: %s", err)
+	}
+
+	errs := map[string]error{}
+	for _, message := range messages {
+		wm := WebhookMessage{}
+		if err := json.Unmarshal(message.Payload, &wm); err != nil {
+			t.Fatalf("error decoding webhook message: %s", err)
+		}
+
+		message.Attempts = 1
+		_, errs[wm.WebhookId] = notifier.HandleMessage(context.Background(), message)
+	}
+
+	return errs
+}
+
+func findWebhookRequest(t *testing.T, requests []webhookRequest, path string) webhookRequest {
+	for _, request := range requests {
+		if request.Path == path {
+			return request
+		}
+	}
+
+	t.Fatalf("no request to %s", path)
+	return webhookRequest{}
+}
+
+func TestWebhookClicksAreFilteredAndPostedInEachFormat(t *testing.T) {
+	server, received := newWebhookEndpoint(t)
+
+	database := &fakeWebhookDatabase{webhooks: []WebhookRecord{
+		{Id: "json", WorkspaceId: "workspace-1", Url: server.URL + "/json", Secret: "whsec_test", Format: WEBHOOK_FORMAT_JSON},
+		{Id: "slack", WorkspaceId: "workspace-1", Url: server.URL + "/slack", Format: WEBHOOK_FORMAT_SLACK, Tag: "bob <ceo> & CO"},
+		{Id: "teams", WorkspaceId: "workspace-1", Url: server.URL + "/teams", Format: WEBHOOK_FORMAT_TEAMS, LinkCreatorId: "user-1"},
+		{Id: "other-tag", WorkspaceId: "workspace-1", Url: server.URL + "/other-tag", Format: WEBHOOK_FORMAT_SLACK, Tag: "alice"},
+		{Id: "other-creator", WorkspaceId: "workspace-1", Url: server.URL + "/other-creator", Format: WEBHOOK_FORMAT_TEAMS, LinkCreatorId: "user-2"},
+		{Id: "other-workspace", WorkspaceId: "workspace-2", Url: server.URL + "/other-workspace", Format: WEBHOOK_FORMAT_JSON},
+	}}
+	notifier := newTestWebhookNotifier(database)
+
+	errs := deliverClick(t, notifier, newTestClickNotification())
+
+	if len(errs) != 3 {
+		t.Fatalf("delivered to %d webhooks, want json, slack and teams", len(errs))
+	}
+
+	for webhookId, err := range errs {
+		if err != nil {
+			t.Errorf("error delivering to %s: %s", webhookId, err)
+		}
+	}
+
+	requests := received()
+	if len(requests) != 3 {
+		t.Fatalf("endpoint received %d requests, want 3", len(requests))
+	}
+
+	for _, request := range requests {
+		if request.Headers.Get("Content-Type") != "application/json" {
+			t.Errorf("%s content type = %s", request.Path, request.Headers.Get("Content-Type"))
+		}
+
+		if request.Headers.Get("X-LinkUp-Delivery") != "event-1" {
+			t.Errorf("%s delivery header = %s", request.Path, request.Headers.Get("X-LinkUp-Delivery"))
+		}
+	}
+
+	if len(database.deliveries) != 3 {
+		t.Errorf("recorded %d deliveries, want 3", len(database.deliveries))
+	}
+
+	for _, delivery := range database.deliveries {
+		if !delivery.Succeeded() || delivery.StatusCode != http.StatusOK {
+			t.Errorf("delivery to %s recorded as %d %q", delivery.WebhookId, delivery.StatusCode, delivery.Error)
+		}
+	}
+}
+
+func TestWebhookJsonEventIsSigned(t *testing.T) {
+	server, received := newWebhookEndpoint(t)
+
+	database := &fakeWebhookDatabase{webhooks: []WebhookRecord{
+		{Id: "json", WorkspaceId: "workspace-1", Url: server.URL + "/json", Secret: "whsec_test", Format: WEBHOOK_FORMAT_JSON},
+	}}
+
+	deliverClick(t, newTestWebhookNotifier(database), newTestClickNotification())
+	request := findWebhookRequest(t, received(), "/json")
+
+	signature := signWebhookPayload("whsec_test", request.Headers.Get("X-LinkUp-Timestamp"), request.Body)
+	if request.Headers.Get("X-LinkUp-Signature") != signature {
+		t.Errorf("signature = %s, want %s", request.Headers.Get("X-LinkUp-Signature"), signature)
+	}
+
+	event := struct {
+		Id   string           `json:"id"`
+		Type string           `json:"type"`
+		Data WebhookClickData `json:"data"`
+	}{}
+	if err := json.Unmarshal(request.Body, &event); err != nil {
+		t.Fatalf("error decoding event: %s", err)
+	}
+
+	if event.Id != "event-1" || event.Type != WEBHOOK_EVENT_LINK_CLICKED {
+		t.Errorf("event = %s %s, want event-1 %s", event.Id, event.Type, WEBHOOK_EVENT_LINK_CLICKED)
+	}
+
+	if event.Data.Url != "https://example.com/pricing" || event.Data.ClickCount != 3 || event.Data.Location.CountryCode != "ES" {
+		t.Errorf("unexpected click data %+v", event.Data)
+	}
+}
+
+func TestWebhookSlackMessage(t *testing.T) {
+	server, received := newWebhookEndpoint(t)
+
+	database := &fakeWebhookDatabase{webhooks: []WebhookRecord{
+		{Id: "slack", WorkspaceId: "workspace-1", Url: server.URL + "/slack", Format: WEBHOOK_FORMAT_SLACK},
+	}}
+
+	deliverClick(t, newTestWebhookNotifier(database), newTestClickNotification())
+	request := findWebhookRequest(t, received(), "/slack")
+
+	message := struct {
+		Text   string `json:"text"`
+		Blocks []struct {
+			Type string `json:"type"`
+			Text struct {
+				Text string `json:"text"`
+			} `json:"text"`
+			Fields []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"fields"`
+			Elements []struct {
+				Text string `json:"text"`
+			} `json:"elements"`
+		} `json:"blocks"`
+	}{}
+	if err := json.Unmarshal(request.Body, &message); err != nil {
+		t.Fatalf("error decoding slack message: %s", err)
+	}
+
+	if message.Text != "Bob &lt;CEO&gt; &amp; co just clicked your link" {
+		t.Errorf("text = %q", message.Text)
+	}
+
+	if len(message.Blocks) != 3 || message.Blocks[0].Type != "section" || message.Blocks[1].Type != "section" || message.Blocks[2].Type != "context" {
+		t.Fatalf("unexpected blocks %+v", message.Blocks)
+	}
+
+	fields := []string{}
+	for _, field := range message.Blocks[1].Fields {
+		if field.Type != "mrkdwn" {
+			t.Errorf("field type = %s, want mrkdwn", field.Type)
+		}
+		fields = append(fields, field.Text)
+	}
+
+	expected := []string{
+		"*Tag*\nBob &lt;CEO&gt; &amp; co",
+		"*Destination*\nhttps://example.com/pricing",
+		"*Clicks*\n3",
+		"*Location*\nMadrid, Madrid, ES",
+		"*Device*\nmobile · Safari · iOS",
+	}
+	if strings.Join(fields, "|") != strings.Join(expected, "|") {
+		t.Errorf("fields = %q, want %q", fields, expected)
+	}
+
+	if len(message.Blocks[2].Elements) != 1 || !strings.HasPrefix(message.Blocks[2].Elements[0].Text, "<https://linkup.example.com/r/abc123|") {
+		t.Errorf("unexpected context %+v", message.Blocks[2].Elements)
+	}
+}
+
+func TestWebhookTeamsMessage(t *testing.T) {
+	server, received := newWebhookEndpoint(t)
+
+	database := &fakeWebhookDatabase{webhooks: []WebhookRecord{
+		{Id: "teams", WorkspaceId: "workspace-1", Url: server.URL + "/teams", Format: WEBHOOK_FORMAT_TEAMS},
+	}}
+
+	deliverClick(t, newTestWebhookNotifier(database), newTestClickNotification())
+	request := findWebhookRequest(t, received(), "/teams")
+
+	message := struct {
+		Type        string `json:"type"`
+		Attachments []struct {
+			ContentType string `json:"contentType"`
+			Content     struct {
+				Type    string `json:"type"`
+				Version string `json:"version"`
+				Body    []struct {
+					Type  string `json:"type"`
+					Text  string `json:"text"`
+					Facts []struct {
+						Title string `json:"title"`
+						Value string `json:"value"`
+					} `json:"facts"`
+				} `json:"body"`
+				Actions []struct {
+					Type string `json:"type"`
+					Url  string `json:"url"`
+				} `json:"actions"`
+			} `json:"content"`
+		} `json:"attachments"`
+	}{}
+	if err := json.Unmarshal(request.Body, &message); err != nil {
+		t.Fatalf("error decoding teams message: %s", err)
+	}
+
+	if message.Type != "message" || len(message.Attachments) != 1 {
+		t.Fatalf("unexpected envelope %+v", message)
+	}
+
+	card := message.Attachments[0]
+	if card.ContentType != "application/vnd.microsoft.card.adaptive" || card.Content.Type != "AdaptiveCard" {
+		t.Errorf("attachment is %s %s, want an adaptive card", card.ContentType, card.Content.Type)
+	}
+
+	if len(card.Content.Body) != 2 || card.Content.Body[0].Text != "Bob <CEO> & co just clicked your link" || card.Content.Body[1].Type != "FactSet" {
+		t.Fatalf("unexpected card body %+v", card.Content.Body)
+	}
+
+	facts := map[string]string{}
+	for _, fact := range card.Content.Body[1].Facts {
+		facts[fact.Title] = fact.Value
+	}
+
+	expected := map[string]string{
+		"Tag":         "Bob <CEO> & co",
+		"Destination": "https://example.com/pricing",
+		"Clicks":      "3",
+		"Location":    "Madrid, Madrid, ES",
+		"Device":      "mobile · Safari · iOS",
+	}
+	for title, value := range expected {
+		if facts[title] != value {
+			t.Errorf("fact %s = %q, want %q", title, facts[title], value)
+		}
+	}
+
+	if len(card.Content.Actions) != 1 || card.Content.Actions[0].Type != "Action.OpenUrl" || card.Content.Actions[0].Url != "https://example.com/pricing" {
+		t.Errorf("unexpected actions %+v", card.Content.Actions)
+	}
+}
+
+func TestWebhookFailedDeliveryIsRecordedAndRetried(t *testing.T) {
+	server, _ := newWebhookEndpoint(t)
+
+	database := &fakeWebhookDatabase{webhooks: []WebhookRecord{
+		{Id: "slack", WorkspaceId: "workspace-1", Url: server.URL + "/fail", Format: WEBHOOK_FORMAT_SLACK},
+	}}
+
+	errs := deliverClick(t, newTestWebhookNotifier(database), newTestClickNotification())
+
+	if errs["slack"] == nil {
+		t.Errorf("delivery to an endpoint answering 500 succeeded")
+	}
+
+	if len(database.deliveries) != 1 || database.deliveries[0].StatusCode != http.StatusInternalServerError || database.deliveries[0].Succeeded() {
+		t.Errorf("unexpected deliveries %+v", database.deliveries)
+	}
+}
+
+func TestWebhookPingInEachFormat(t *testing.T) {
+	server, received := newWebhookEndpoint(t)
+	notifier := newTestWebhookNotifier(&fakeWebhookDatabase{})
+
+	for _, format := range webhookFormats {
+		webhook := WebhookRecord{Id: format, WorkspaceId: "workspace-1", Url: server.URL + "/" + format, Format: format}
+
+		delivery, err := notifier.Ping(context.Background(), webhook)
+		if err != nil || !delivery.Succeeded() {
+			t.Errorf("error pinging %s webhook: %v %s", format, err, delivery.Error)
+		}
+	}
+
+	slack := map[string]any{}
+	json.Unmarshal(findWebhookRequest(t, received(), "/slack").Body, &slack)
+	if !strings.Contains(slack["text"].(string), "test notification") {
+		t.Errorf("slack ping = %v", slack)
+	}
+
+	teams := map[string]any{}
+	json.Unmarshal(findWebhookRequest(t, received(), "/teams").Body, &teams)
+	if teams["type"] != "message" {
+		t.Errorf("teams ping = %v", teams)
+	}
+
+	event := WebhookEvent{}
+	json.Unmarshal(findWebhookRequest(t, received(), "/json").Body, &event)
+	if event.Type != WEBHOOK_EVENT_PING {
+		t.Errorf("json ping type = %s, want %s", event.Type, WEBHOOK_EVENT_PING)
+	}
+}
+
+func TestMembersOnlyManageTheirOwnWebhooks(t *testing.T) {
+	workspaceWide := WebhookRecord{Id: "workspace-wide"}
+	own := WebhookRecord{Id: "own", LinkCreatorId: "user-1"}
+	someoneElses := WebhookRecord{Id: "someone-elses", LinkCreatorId: "user-2"}
+
+	tests := []struct {
+		role    string
+		webhook WebhookRecord
+		allowed bool
+	}{
+		{WORKSPACE_ROLE_OWNER, workspaceWide, true},
+		{WORKSPACE_ROLE_ADMIN, workspaceWide, true},
+		{WORKSPACE_ROLE_ADMIN, someoneElses, true},
+		{WORKSPACE_ROLE_MEMBER, own, true},
+		{WORKSPACE_ROLE_MEMBER, workspaceWide, false},
+		{WORKSPACE_ROLE_MEMBER, someoneElses, false},
+	}
+
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Set("workspaceRole", test.role)
+
+		if allowed := canManageWebhook(c, test.webhook, "user-1"); allowed != test.allowed {
+			t.Errorf("%s managing %s webhook: %t, want %t", test.role, test.webhook.Id, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const WORKSPACE_ROLE_OWNER = "owner"
+const WORKSPACE_ROLE_ADMIN = "admin"
+const WORKSPACE_ROLE_MEMBER = "member"
+const WORKSPACE_ROLE_VIEWER = "viewer"
+
+// Each role can do everything the ones ranked below it can.
+var workspaceRoleRanks = map[string]int{
+	WORKSPACE_ROLE_VIEWER: 1,
+	WORKSPACE_ROLE_MEMBER: 2,
+	WORKSPACE_ROLE_ADMIN:  3,
+	WORKSPACE_ROLE_OWNER:  4,
+}
+
+// Clicks are notified to whoever created the link, or to the workspace's list of recipients.
+const NOTIFY_MODE_CREATOR = "creator"
+const NOTIFY_MODE_LIST = "list"
+
+const WORKSPACE_INVITATION_TOKEN_LENGTH = 48
+const MAX_WORKSPACE_NAME_LENGTH = 100
+const MAX_NOTIFICATION_RECIPIENTS = 20
+
+type WorkspaceApiRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type UpdateWorkspaceMemberApiRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type CreateWorkspaceInvitationApiRequest struct {
+	Email string `json:"email" binding:"required"`
+	Role  string `json:"role"`
+}
+
+type AcceptWorkspaceInvitationApiRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type WorkspaceNotificationsApiRequest struct {
+	Mode       string   `json:"mode" binding:"required"`
+	Recipients []string `json:"recipients"`
+}
+
+type WorkspaceResponse struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Personal    bool      `json:"personal"`
+	Role        string    `json:"role"`
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type WorkspaceMemberResponse struct {
+	UserId    string    `json:"user_id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceInvitationResponse struct {
+	Id        string    `json:"id"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WorkspaceNotificationsResponse struct {
+	Mode       string   `json:"mode"`
+	Recipients []string `json:"recipients"`
+}
+
+// requireWorkspaceRole picks the workspace a request is for and lets it through if the
+// user's role there is at least the given one. The workspace comes from the URL, else
+// the X-Workspace-Id header or workspace_id query parameter, else it's the user's
+// personal workspace.
+func (r *Controller) requireWorkspaceRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userId, err := getUserIdFromContext(c)
+		if err != nil {
+			log.Println("error getting user id from context: ", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		workspaceId := requestedWorkspaceId(c)
+
+		var result ResultForGetWorkspaceRequest
+		if workspaceId == "" {
+			result, err = r.Database.GetPersonalWorkspace(c, userId)
+		} else if _, parseErr := uuid.Parse(workspaceId); parseErr == nil {
+			result, err = r.Database.GetWorkspace(c, workspaceId, userId)
+		}
+
+		if err != nil {
+			log.Printf("error getting workspace id %s for user id %s: %s", workspaceId, userId, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		if !result.Found {
+			log.Printf("workspace id %s not found for user id %s", workspaceId, userId)
+			c.AbortWithStatusJSON(http.StatusNotFound, "Workspace not found")
+			return
+		}
+
+		if !hasWorkspaceRole(result.Workspace.Role, role) {
+			log.Printf("user id %s is %s in workspace id %s, %s %s needs %s", userId, result.Workspace.Role, result.Workspace.Id, c.Request.Method, c.FullPath(), role)
+			c.AbortWithStatusJSON(http.StatusForbidden, "Your role in this workspace doesn't allow this")
+			return
+		}
+
+		c.Set("workspaceId", result.Workspace.Id)
+		c.Set("workspaceRole", result.Workspace.Role)
+		c.Set("workspace", result.Workspace)
+		c.Next()
+	}
+}
+
+func requestedWorkspaceId(c *gin.Context) string {
+	if id := c.Param("workspaceId"); id != "" {
+		return id
+	}
+
+	if id := c.GetHeader("X-Workspace-Id"); id != "" {
+		return id
+	}
+
+	return c.Query("workspace_id")
+}
+
+func getWorkspaceIdFromContext(c *gin.Context) (string, error) {
+	id := c.GetString("workspaceId")
+	if id == "" {
+		return "", fmt.Errorf("no value set for workspaceId key in context")
+	}
+
+	return id, nil
+}
+
+func getWorkspaceFromContext(c *gin.Context) (WorkspaceRecord, bool) {
+	workspace, exists := c.Get("workspace")
+	if !exists {
+		log.Println("workspace key not set in context")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return WorkspaceRecord{}, false
+	}
+
+	return workspace.(WorkspaceRecord), true
+}
+
+func hasWorkspaceRole(role string, required string) bool {
+	return workspaceRoleRanks[role] >= workspaceRoleRanks[required]
+}
+
+func isValidWorkspaceRole(role string) bool {
+	_, valid := workspaceRoleRanks[role]
+	return valid
+}
+
+func (r *Controller) GetWorkspaces(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	workspaces, err := r.Database.GetWorkspaces(c, userId)
+	if err != nil {
+		log.Printf("error getting workspaces for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []WorkspaceResponse{}
+	for _, workspace := range workspaces {
+		response = append(response, toWorkspaceResponse(workspace))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) CreateWorkspace(c *gin.Context) {
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	name, ok := bindWorkspaceName(c)
+	if !ok {
+		return
+	}
+
+	workspace, err := r.Database.CreateWorkspace(c, userId, name)
+	if err != nil {
+		log.Printf("error creating workspace for user id %s: %s", userId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusCreated, toWorkspaceResponse(workspace))
+}
+
+func (r *Controller) GetWorkspace(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, toWorkspaceResponse(workspace))
+}
+
+func (r *Controller) UpdateWorkspace(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	name, ok := bindWorkspaceName(c)
+	if !ok {
+		return
+	}
+
+	err := r.Database.UpdateWorkspace(c, UpdateWorkspaceRequest{WorkspaceId: workspace.Id, Name: &name})
+	if err != nil {
+		log.Printf("error updating workspace id %s: %s", workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	workspace.Name = name
+
+	c.JSON(http.StatusOK, toWorkspaceResponse(workspace))
+}
+
+func (r *Controller) DeleteWorkspace(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	if workspace.IsPersonal {
+		log.Printf("can't delete personal workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Personal workspaces can't be deleted")
+		return
+	}
+
+	paths, err := r.Database.DeleteWorkspace(c, workspace.Id)
+	if err != nil {
+		log.Printf("error deleting workspace id %s: %s", workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for _, path := range paths {
+		r.RedirectCache.Remove(path)
+	}
+
+	log.Printf("deleted workspace id %s along with %d links", workspace.Id, len(paths))
+
+	c.Status(http.StatusNoContent)
+}
+
+func (r *Controller) GetWorkspaceMembers(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	members, err := r.Database.GetWorkspaceMembers(c, workspaceId)
+	if err != nil {
+		log.Printf("error getting members of workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []WorkspaceMemberResponse{}
+	for _, member := range members {
+		response = append(response, WorkspaceMemberResponse{UserId: member.UserId, Email: member.Email, Role: member.Role, CreatedAt: member.CreatedAt})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// UpdateWorkspaceMember changes a member's role. Only owners can make someone an
+// owner or change another owner's role.
+func (r *Controller) UpdateWorkspaceMember(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	apiRequest := UpdateWorkspaceMemberApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if !isValidWorkspaceRole(apiRequest.Role) {
+		log.Printf("invalid workspace role %s", apiRequest.Role)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "role must be one of owner, admin, member, viewer")
+		return
+	}
+
+	member, found := r.getWorkspaceMember(c, workspace.Id, c.Param("userId"))
+	if !found {
+		return
+	}
+
+	if (member.Role == WORKSPACE_ROLE_OWNER || apiRequest.Role == WORKSPACE_ROLE_OWNER) && workspace.Role != WORKSPACE_ROLE_OWNER {
+		log.Printf("%s can't change owners of workspace id %s", workspace.Role, workspace.Id)
+		c.AbortWithStatusJSON(http.StatusForbidden, "Only owners can change who's an owner")
+		return
+	}
+
+	updated, err := r.Database.UpdateWorkspaceMemberRole(c, workspace.Id, member.UserId, apiRequest.Role)
+	if err != nil {
+		log.Printf("error updating role of user id %s in workspace id %s: %s", member.UserId, workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !updated {
+		log.Printf("can't demote the last owner of workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "A workspace needs at least one owner")
+		return
+	}
+
+	member.Role = apiRequest.Role
+
+	c.JSON(http.StatusOK, WorkspaceMemberResponse{UserId: member.UserId, Email: member.Email, Role: member.Role, CreatedAt: member.CreatedAt})
+}
+
+// RemoveWorkspaceMember lets anyone leave a workspace, and admins remove others.
+// Only owners can remove an owner.
+func (r *Controller) RemoveWorkspaceMember(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if workspace.IsPersonal {
+		log.Printf("can't remove members of personal workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Personal workspaces can't be left")
+		return
+	}
+
+	member, found := r.getWorkspaceMember(c, workspace.Id, c.Param("userId"))
+	if !found {
+		return
+	}
+
+	if member.UserId != userId {
+		required := WORKSPACE_ROLE_ADMIN
+		if member.Role == WORKSPACE_ROLE_OWNER {
+			required = WORKSPACE_ROLE_OWNER
+		}
+
+		if !hasWorkspaceRole(workspace.Role, required) {
+			log.Printf("%s can't remove %s from workspace id %s", workspace.Role, member.Role, workspace.Id)
+			c.AbortWithStatusJSON(http.StatusForbidden, "Your role in this workspace doesn't allow this")
+			return
+		}
+	}
+
+	removed, err := r.Database.RemoveWorkspaceMember(c, workspace.Id, member.UserId)
+	if err != nil {
+		log.Printf("error removing user id %s from workspace id %s: %s", member.UserId, workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !removed {
+		log.Printf("can't remove the last owner of workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusConflict, "A workspace needs at least one owner")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (r *Controller) getWorkspaceMember(c *gin.Context, workspaceId string, userId string) (WorkspaceMemberRecord, bool) {
+	members, err := r.Database.GetWorkspaceMembers(c, workspaceId)
+	if err != nil {
+		log.Printf("error getting members of workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return WorkspaceMemberRecord{}, false
+	}
+
+	for _, member := range members {
+		if member.UserId == userId {
+			return member, true
+		}
+	}
+
+	log.Printf("user id %s is not a member of workspace id %s", userId, workspaceId)
+	c.AbortWithStatus(http.StatusNotFound)
+	return WorkspaceMemberRecord{}, false
+}
+
+func (r *Controller) CreateWorkspaceInvitation(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	userId, err := getUserIdFromContext(c)
+	if err != nil {
+		log.Println("error getting user id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	apiRequest := CreateWorkspaceInvitationApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if workspace.IsPersonal {
+		log.Printf("can't invite to personal workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Nobody can be invited to a personal workspace")
+		return
+	}
+
+	email := strings.TrimSpace(apiRequest.Email)
+	if !strings.Contains(email, "@") {
+		log.Printf("invalid invitation email %s", email)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid email")
+		return
+	}
+
+	if apiRequest.Role == "" {
+		apiRequest.Role = WORKSPACE_ROLE_MEMBER
+	}
+
+	if !isValidWorkspaceRole(apiRequest.Role) {
+		log.Printf("invalid workspace role %s", apiRequest.Role)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "role must be one of owner, admin, member, viewer")
+		return
+	}
+
+	if apiRequest.Role == WORKSPACE_ROLE_OWNER && workspace.Role != WORKSPACE_ROLE_OWNER {
+		log.Printf("%s can't invite owners to workspace id %s", workspace.Role, workspace.Id)
+		c.AbortWithStatusJSON(http.StatusForbidden, "Only owners can change who's an owner")
+		return
+	}
+
+	token := uniuri.NewLen(WORKSPACE_INVITATION_TOKEN_LENGTH)
+
+	// people who aren't users yet get the email in the inviter's language
+	locale := r.localeForEmail(c, email, matchLocale(c.GetHeader("Accept-Language")))
+
+	data := WorkspaceInvitationEmailData{
+		WorkspaceName: workspace.Name,
+		Role:          apiRequest.Role,
+		Url:           fmt.Sprintf("%s?token=%s", r.WorkspaceInvitationUrl, url.QueryEscape(token)),
+		ExpiresIn:     r.WorkspaceInvitationTtl,
+	}
+
+	ser, err := r.EmailTemplates.Render(EMAIL_TEMPLATE_WORKSPACE_INVITATION, locale, email, data)
+	if err != nil {
+		log.Printf("error rendering workspace invitation to %s: %s", email, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	cwir := CreateWorkspaceInvitationRequest{
+		WorkspaceId:     workspace.Id,
+		Email:           email,
+		Role:            apiRequest.Role,
+		TokenHash:       hashToken(token),
+		InvitedBy:       userId,
+		Ttl:             r.WorkspaceInvitationTtl,
+		InvitationEmail: ser,
+	}
+
+	invitation, err := r.Database.CreateWorkspaceInvitation(c, cwir)
+	if err != nil {
+		log.Printf("error creating invitation to workspace id %s: %s", workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	r.OutboxDispatcher.Wake()
+
+	c.JSON(http.StatusCreated, toWorkspaceInvitationResponse(invitation))
+}
+
+func (r *Controller) GetWorkspaceInvitations(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	invitations, err := r.Database.GetWorkspaceInvitations(c, workspaceId)
+	if err != nil {
+		log.Printf("error getting invitations to workspace id %s: %s", workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	response := []WorkspaceInvitationResponse{}
+	for _, invitation := range invitations {
+		response = append(response, toWorkspaceInvitationResponse(invitation))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (r *Controller) RevokeWorkspaceInvitation(c *gin.Context) {
+	workspaceId, err := getWorkspaceIdFromContext(c)
+	if err != nil {
+		log.Println("error getting workspace id from context: ", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	invitationId := c.Param("id")
+	if _, err := uuid.Parse(invitationId); err != nil {
+		log.Printf("invalid invitation id %s: %s", invitationId, err)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	revoked, err := r.Database.RevokeWorkspaceInvitation(c, workspaceId, invitationId)
+	if err != nil {
+		log.Printf("error revoking invitation id %s to workspace id %s: %s", invitationId, workspaceId, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !revoked {
+		log.Printf("pending invitation id %s not found for workspace id %s", invitationId, workspaceId)
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// AcceptWorkspaceInvitation adds the user to the workspace they were invited to, as
+// long as the invitation was sent to their email.
+func (r *Controller) AcceptWorkspaceInvitation(c *gin.Context) {
+	user, found := r.getAuthenticatedUserRecord(c)
+	if !found {
+		return
+	}
+
+	apiRequest := AcceptWorkspaceInvitationApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	awir := AcceptWorkspaceInvitationRequest{TokenHash: hashToken(apiRequest.Token), UserId: user.Id, Email: user.Email}
+
+	result, err := r.Database.AcceptWorkspaceInvitation(c, awir)
+	if err != nil {
+		log.Printf("error accepting workspace invitation for user id %s: %s", user.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if !result.Found {
+		log.Printf("no pending workspace invitation for user id %s with the given token", user.Id)
+		c.AbortWithStatusJSON(http.StatusNotFound, "Invitation not found, expired or sent to another email")
+		return
+	}
+
+	log.Printf("user id %s joined workspace id %s as %s", user.Id, result.WorkspaceId, result.Role)
+
+	c.JSON(http.StatusOK, gin.H{"workspace_id": result.WorkspaceId, "role": result.Role})
+}
+
+func (r *Controller) GetWorkspaceNotifications(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	recipients, err := r.Database.GetNotificationRecipients(c, workspace.Id)
+	if err != nil {
+		log.Printf("error getting notification recipients of workspace id %s: %s", workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, WorkspaceNotificationsResponse{Mode: workspace.NotifyMode, Recipients: recipients})
+}
+
+// SetWorkspaceNotifications chooses who's emailed about clicks on the workspace's
+// links. Recipients have to be members, so nobody outside the workspace is sent
+// alerts they didn't ask for.
+func (r *Controller) SetWorkspaceNotifications(c *gin.Context) {
+	workspace, ok := getWorkspaceFromContext(c)
+	if !ok {
+		return
+	}
+
+	apiRequest := WorkspaceNotificationsApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if apiRequest.Mode != NOTIFY_MODE_CREATOR && apiRequest.Mode != NOTIFY_MODE_LIST {
+		log.Printf("invalid notify mode %s", apiRequest.Mode)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "mode must be one of creator, list")
+		return
+	}
+
+	recipients := []string{}
+	for _, email := range apiRequest.Recipients {
+		address, err := mail.ParseAddress(strings.TrimSpace(email))
+		if err != nil {
+			log.Printf("invalid notification recipient %s: %s", email, err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid email")
+			return
+		}
+		recipients = append(recipients, address.Address)
+	}
+
+	if len(recipients) > MAX_NOTIFICATION_RECIPIENTS {
+		log.Printf("too many notification recipients for workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, fmt.Sprintf("There can be at most %d recipients", MAX_NOTIFICATION_RECIPIENTS))
+		return
+	}
+
+	if apiRequest.Mode == NOTIFY_MODE_LIST && len(recipients) == 0 {
+		log.Printf("no notification recipients given for workspace id %s", workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "recipients are needed to notify a list")
+		return
+	}
+
+	swnr := SetWorkspaceNotificationsRequest{WorkspaceId: workspace.Id, NotifyMode: apiRequest.Mode, Recipients: recipients}
+	result, err := r.Database.SetWorkspaceNotifications(c, swnr)
+	if err != nil {
+		log.Printf("error setting notifications of workspace id %s: %s", workspace.Id, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if len(result.NotMembers) > 0 {
+		log.Printf("notification recipients %v aren't members of workspace id %s", result.NotMembers, workspace.Id)
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Recipients must be members of the workspace: "+strings.Join(result.NotMembers, ", "))
+		return
+	}
+
+	// cached links still have the old recipients
+	for _, path := range result.Paths {
+		r.RedirectCache.Remove(path)
+	}
+
+	c.JSON(http.StatusOK, WorkspaceNotificationsResponse{Mode: apiRequest.Mode, Recipients: recipients})
+}
+
+func bindWorkspaceName(c *gin.Context) (string, bool) {
+	apiRequest := WorkspaceApiRequest{}
+	if err := c.ShouldBindJSON(&apiRequest); err != nil {
+		log.Println("error parsing API request: ", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return "", false
+	}
+
+	name := strings.TrimSpace(apiRequest.Name)
+	if name == "" {
+		log.Println("empty workspace name given")
+		c.AbortWithStatusJSON(http.StatusBadRequest, "Invalid name")
+		return "", false
+	}
+
+	return truncateString(name, MAX_WORKSPACE_NAME_LENGTH), true
+}
+
+func toWorkspaceResponse(workspace WorkspaceRecord) WorkspaceResponse {
+	return WorkspaceResponse{
+		Id:          workspace.Id,
+		Name:        workspace.Name,
+		Personal:    workspace.IsPersonal,
+		Role:        workspace.Role,
+		MemberCount: workspace.MemberCount,
+		CreatedAt:   workspace.CreatedAt,
+	}
+}
+
+func toWorkspaceInvitationResponse(invitation WorkspaceInvitationRecord) WorkspaceInvitationResponse {
+	return WorkspaceInvitationResponse{
+		Id:        invitation.Id,
+		Email:     invitation.Email,
+		Role:      invitation.Role,
+		ExpiresAt: invitation.ExpiresAt,
+		CreatedAt: invitation.CreatedAt,
+	}
+}
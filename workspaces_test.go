@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeNotificationsDatabase sets a workspace's notifications the way Postgres does,
+// refusing recipients who aren't in members, and panics on anything else.
+type fakeNotificationsDatabase struct {
+	Database
+
+	members  map[string]bool
+	paths    []string
+	requests []SetWorkspaceNotificationsRequest
+}
+
+func (d *fakeNotificationsDatabase) SetWorkspaceNotifications(ctx context.Context, request SetWorkspaceNotificationsRequest) (ResultForSetWorkspaceNotificationsRequest, error) {
+	result := ResultForSetWorkspaceNotificationsRequest{}
+	for _, email := range request.Recipients {
+		if !d.members[strings.ToLower(email)] {
+			result.NotMembers = append(result.NotMembers, email)
+		}
+	}
+
+	if len(result.NotMembers) > 0 {
+		return result, nil
+	}
+
+	d.requests = append(d.requests, request)
+	result.Paths = d.paths
+
+	return result, nil
+}
+
+func setWorkspaceNotifications(r *Controller, body string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPut, "/v1/workspaces/workspace-1/notifications", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set("workspace", WorkspaceRecord{Id: "workspace-1", NotifyMode: NOTIFY_MODE_CREATOR})
+
+	r.SetWorkspaceNotifications(c)
+
+	return recorder
+}
+
+func newTestNotificationsController() (*Controller, *fakeNotificationsDatabase) {
+	database := &fakeNotificationsDatabase{
+		members: map[string]bool{"ana@example.com": true, "luis@example.com": true},
+		paths:   []string{"abc", "def"},
+	}
+
+	r := &Controller{Database: database, RedirectCache: newRedirectCache(10, time.Minute)}
+
+	return r, database
+}
+
+func TestSetWorkspaceNotificationsRejectsInvalidEmails(t *testing.T) {
+	r, database := newTestNotificationsController()
+
+	for _, email := range []string{"ana", "ana@", "@example.com", "ana@example.com, luis@example.com"} {
+		recorder := setWorkspaceNotifications(r, `{"mode":"list","recipients":["`+email+`"]}`)
+		if recorder.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", email, recorder.Code)
+		}
+	}
+
+	if len(database.requests) != 0 {
+		t.Errorf("notifications set %d times, want none", len(database.requests))
+	}
+}
+
+func TestSetWorkspaceNotificationsOnlyToMembers(t *testing.T) {
+	r, database := newTestNotificationsController()
+	r.RedirectCache.Add("abc", RedirectRecord{NotifyEmails: []string{"ana@example.com"}})
+
+	recorder := setWorkspaceNotifications(r, `{"mode":"list","recipients":["ana@example.com","stranger@example.org"]}`)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", recorder.Code)
+	}
+
+	if !strings.Contains(recorder.Body.String(), "stranger@example.org") {
+		t.Errorf("body %s doesn't name the recipient who isn't a member", recorder.Body.String())
+	}
+
+	if len(database.requests) != 0 {
+		t.Errorf("notifications set %d times, want none", len(database.requests))
+	}
+
+	if _, found := r.RedirectCache.Get("abc"); !found {
+		t.Error("cache cleared without a change")
+	}
+}
+
+func TestSetWorkspaceNotificationsClearsCachedLinks(t *testing.T) {
+	r, database := newTestNotificationsController()
+	r.RedirectCache.Add("abc", RedirectRecord{NotifyEmails: []string{"old@example.com"}})
+	r.RedirectCache.Add("other", RedirectRecord{})
+
+	recorder := setWorkspaceNotifications(r, `{"mode":"list","recipients":["Ana <Ana@example.com>"," luis@example.com "]}`)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", recorder.Code, recorder.Body.String())
+	}
+
+	if len(database.requests) != 1 {
+		t.Fatalf("notifications set %d times, want once", len(database.requests))
+	}
+
+	request := database.requests[0]
+	if request.NotifyMode != NOTIFY_MODE_LIST || strings.Join(request.Recipients, ",") != "Ana@example.com,luis@example.com" {
+		t.Errorf("set %s to %v", request.NotifyMode, request.Recipients)
+	}
+
+	if _, found := r.RedirectCache.Get("abc"); found {
+		t.Error("workspace link still cached")
+	}
+
+	if _, found := r.RedirectCache.Get("other"); !found {
+		t.Error("another workspace's link dropped from the cache")
+	}
+}